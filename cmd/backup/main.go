@@ -1,32 +1,202 @@
 package main
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/samphillips/backup/internal/config"
+	"github.com/samphillips/backup/internal/crypt"
 	"github.com/samphillips/backup/internal/file"
 	"github.com/samphillips/backup/internal/logging"
 	"github.com/samphillips/backup/internal/progress"
+	"github.com/samphillips/backup/internal/repo"
+	"github.com/samphillips/backup/internal/throttle"
 )
 
 func main() {
-	config := config.ParseConfig()
+	cfg := config.ParseConfig()
 
-	if config.Verbose {
+	// Keep standard output for the tar stream
+	if cfg.DstDir == config.StdioPath {
+		logging.SetOutput(os.Stderr)
+	}
+
+	if cfg.Verbose {
 		logging.SetLogLevel(logging.DEBUG)
 	}
 
+	limiter, err := newLimiter(cfg)
+	if err != nil {
+		logging.Fatal("Invalid bandwidth limit: %s", err)
+		os.Exit(1)
+	}
+
+	if _, err := file.NewHasher(cfg.Hash); err != nil {
+		logging.Fatal("Invalid hash algorithm: %s", err)
+		os.Exit(1)
+	}
+
+	if err := file.ValidateCompression(cfg.Compress); err != nil {
+		logging.Fatal("Invalid compression: %s", err)
+		os.Exit(1)
+	}
+
+	if cfg.Compress != "" && (cfg.Append || cfg.Delta) {
+		logging.Fatal("Compressed files cannot be appended to or transferred as deltas")
+		os.Exit(1)
+	}
+
+	if cfg.Compress != "" && (cfg.Repository || cfg.Encrypt) {
+		logging.Fatal("Compression only applies to plain backup locations and snapshots, not repositories or encrypted backups")
+		os.Exit(1)
+	}
+
+	archivePath, toArchive := archiveDestination(cfg)
+
+	if cfg.DstDir == config.StdioPath && !toArchive {
+		logging.Fatal("Only backups can be written to standard output, as a tar stream")
+		os.Exit(1)
+	}
+
+	if toArchive && (cfg.Repository || cfg.Snapshot || cfg.Encrypt || cfg.Compress != "") {
+		logging.Fatal("Archive destinations cannot be combined with repository, snapshot, encrypted or compressed backups")
+		os.Exit(1)
+	}
+
+	sourcePath, fromArchive := archiveSource(cfg)
+
+	if fromArchive && (cfg.Command != config.CommandBackup || cfg.Repository || cfg.Encrypt || toArchive) {
+		logging.Fatal("Archive sources can only be backed up directly to backup locations and snapshots, not with plan and apply or to repositories, encrypted backups or archives")
+		os.Exit(1)
+	}
+
+	if fromArchive && (cfg.Append || cfg.Delta) {
+		logging.Fatal("Files in archive sources cannot be appended or transferred as deltas")
+		os.Exit(1)
+	}
+
+	if cfg.Repository && cfg.Command != config.CommandBackup {
+		logging.Fatal("Repositories can only be backed up to directly, not with plan and apply")
+		os.Exit(1)
+	}
+
+	if cfg.Snapshot && cfg.Command != config.CommandBackup {
+		logging.Fatal("Snapshots can only be taken directly, not with plan and apply")
+		os.Exit(1)
+	}
+
+	if cfg.Snapshot && cfg.Repository {
+		logging.Fatal("Snapshot and repository backups cannot be combined")
+		os.Exit(1)
+	}
+
+	if cfg.Encrypt && cfg.Command != config.CommandBackup {
+		logging.Fatal("Encrypted backup locations can only be backed up to directly, not with plan and apply")
+		os.Exit(1)
+	}
+
+	if cfg.Encrypt && (cfg.Snapshot || cfg.Repository) {
+		logging.Fatal("Encrypted backups cannot be combined with snapshot or repository backups")
+		os.Exit(1)
+	}
+
+	switch cfg.Command {
+	case config.CommandPlan:
+		plan := generatePlan(cfg, nil)
+
+		if err := plan.Save(cfg.PlanFile); err != nil {
+			logging.Fatal("Failed to write plan file %s: %s", cfg.PlanFile, err)
+			os.Exit(1)
+		}
+
+		logging.Info("Wrote backup plan to %s", cfg.PlanFile)
+	case config.CommandApply:
+		plan, err := file.LoadPlan(cfg.PlanFile)
+		if err != nil {
+			logging.Fatal("Failed to read plan file %s: %s", cfg.PlanFile, err)
+			os.Exit(1)
+		}
+
+		logging.Info("Checking source directory has not changed since the plan was generated")
+		if file.Fingerprint(file.ExcludeStateDir(file.ScanDirectory(plan.SrcDir))) != plan.Fingerprint {
+			logging.Fatal("Source directory %s has changed since the plan was generated, refusing to apply", plan.SrcDir)
+			os.Exit(1)
+		}
+
+		runPlan(cfg, plan, limiter)
+	case config.CommandPrune:
+		if cfg.Keep.Empty() {
+			logging.Fatal("Refusing to prune every snapshot, set at least one of the keep flags")
+			os.Exit(1)
+		}
+
+		if repo.Exists(cfg.DstDir) {
+			pruneRepository(cfg)
+		} else {
+			pruneSnapshots(cfg)
+		}
+	case config.CommandRestore:
+		restore(cfg)
+	case config.CommandVerify:
+		verify(cfg)
+	default:
+		if cfg.Repository {
+			backupToRepository(cfg)
+			return
+		}
+
+		var source fs.FS
+		if fromArchive {
+			archive, err := file.OpenArchive(sourcePath)
+			if err != nil {
+				logging.Fatal("Failed to open archive %s: %s", sourcePath, err)
+				os.Exit(1)
+			}
+			defer archive.Close()
+
+			if cfg.Xattrs || cfg.Acls {
+				logging.Warn("Extended attributes and ACLs are not read from archive sources, they will not be preserved")
+			}
+			source = archive
+		}
+
+		if cfg.Snapshot {
+			backupToSnapshot(cfg, source, limiter)
+			return
+		}
+
+		if cfg.Encrypt {
+			backupEncrypted(cfg, limiter)
+			return
+		}
+
+		if toArchive {
+			backupToArchive(cfg, archivePath, limiter)
+			return
+		}
+
+		runPlan(cfg, generatePlan(cfg, source), limiter)
+	}
+}
+
+// generatePlan scans the source, or the archive opened as the source if given, and the
+// destination directory and determines the backup plan
+func generatePlan(cfg config.Config, source fs.FS) *file.Plan {
 	srcSDChan := make(chan map[string]os.FileInfo)
 	dstSDChan := make(chan map[string]os.FileInfo)
 
 	logging.Debug("Scanning source and destination directories")
 	go func() {
-		srcIndex := file.ScanDirectory(config.SrcDir)
+		srcIndex := file.ExcludeStateDir(scanSource(cfg, source))
 		srcSDChan <- srcIndex
 	}()
 	go func() {
-		dstIndex := file.ScanDirectory(config.DstDir)
+		dstIndex := file.ScanDirectory(cfg.DstDir)
 		dstSDChan <- dstIndex
 	}()
 
@@ -44,66 +214,745 @@ func main() {
 	close(srcSDChan)
 	close(dstSDChan)
 
+	cache := loadHashCache(cfg)
+
 	logging.Info("Determining files to be backed up")
-	files, directories, symlinks := file.GenerateBackupDetails(srcIndex, dstIndex, config.SrcDir, config.DstDir, config.Fast)
+	opts := backupOptions(cfg, cache)
+	opts.Source = source
+	plan := file.GenerateBackupDetails(srcIndex, dstIndex, cfg.SrcDir, cfg.DstDir, opts)
+
+	saveHashCache(cfg, cache)
+
+	if !cfg.IncludeSymlinks {
+		plan.Symlinks = []file.Operation{}
+	}
+
+	if cfg.Mirror {
+		plan.AddRemovals(file.GenerateRemovals(srcIndex, dstIndex))
+	}
+
+	return plan
+}
+
+// scanSource scans the source directory, or the archive opened as the source if given
+func scanSource(cfg config.Config, source fs.FS) map[string]os.FileInfo {
+	if source == nil {
+		return file.ScanDirectory(cfg.SrcDir)
+	}
+
+	srcIndex, err := file.ScanFS(source)
+	if err != nil {
+		logging.Fatal("Failed to read source archive: %s", err)
+		os.Exit(1)
+	}
+
+	return srcIndex
+}
+
+// backupOptions returns the options that decide how files are compared and copied
+func backupOptions(cfg config.Config, cache *file.HashCache) file.Options {
+	return file.Options{
+		SkipHashsum:      cfg.Fast,
+		Archive:          cfg.Archive,
+		Xattrs:           cfg.Xattrs,
+		ACLs:             cfg.Acls,
+		HardLinks:        cfg.HardLinks,
+		QuickCheck:       cfg.QuickCheck,
+		ModifyWindow:     cfg.ModifyWindow,
+		HashMtimeChanges: cfg.QuickCheckHash,
+		Hash:             cfg.Hash,
+		Append:           cfg.Append,
+		Delta:            cfg.Delta,
+		DigestXattrs:     cfg.RecordDigests,
+		Compression:      cfg.Compress,
+		Cache:            cache,
+	}
+}
+
+// backupToSnapshot takes a new snapshot of the source directory in a directory named after the
+// current time in the destination. Files are compared with the snapshot the latest symlink points
+// at, and unchanged files are hard linked from it. The snapshot is written under a hidden name and
+// only takes its own name, and has the latest symlink moved to it, once it has been written
+// without errors. The source is read from the archive opened as the source, if given.
+func backupToSnapshot(cfg config.Config, source fs.FS, limiter *throttle.Limiter) {
+	baseDir, err := file.LatestSnapshotDir(cfg.DstDir)
+	if err != nil {
+		logging.Fatal("Failed to read the latest snapshot in %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+
+	name := file.NewSnapshotName(cfg.DstDir, time.Now())
+	snapshotDir := filepath.Join(cfg.DstDir, name) + "/"
+
+	logging.Debug("Scanning source directory")
+	srcIndex := file.ExcludeStateDir(scanSource(cfg, source))
+
+	baseIndex := map[string]os.FileInfo{}
+	if baseDir != "" {
+		logging.Info("Comparing with snapshot %s", baseDir)
+		baseIndex = file.ScanDirectory(baseDir)
+	}
+
+	cache := loadHashCache(cfg)
+
+	logging.Info("Determining files to be backed up")
+	opts := backupOptions(cfg, cache)
+	opts.Source = source
+	plan := file.GenerateSnapshotDetails(srcIndex, baseIndex, cfg.SrcDir, baseDir, snapshotDir, opts)
+
+	saveHashCache(cfg, cache)
+
+	if !cfg.IncludeSymlinks {
+		plan.Symlinks = []file.Operation{}
+	}
+
+	if cfg.DryRun {
+		if err := plan.Report(os.Stdout); err != nil {
+			logging.Error("Failed to write plan report: %s", err)
+		}
+		logging.Info("Dry run: %d files to copy and %d unchanged files to link into snapshot %s", len(plan.Files), len(plan.Reuse), name)
+		return
+	}
+
+	// The plan was generated for the snapshot's own name, so symlinks into the source point at
+	// where the files will be once the snapshot is complete
+	partialDir, err := file.CreatePartialSnapshot(cfg.DstDir, name)
+	if err != nil {
+		logging.Fatal("Failed to create snapshot %s: %s", snapshotDir, err)
+		os.Exit(1)
+	}
+	plan.DstDir = partialDir
+
+	if err := plan.Apply(file.ApplyOptions{Jobs: cfg.Jobs, Limiter: limiter, Manifest: true}); err != nil {
+		logging.Error("Snapshot %s finished with errors, removing it: %s", name, err)
+		if err := file.RemovePartialSnapshot(cfg.DstDir, name); err != nil {
+			logging.Error("Failed to remove incomplete snapshot %s: %s", partialDir, err)
+		}
+		os.Exit(1)
+	}
+
+	if err := file.CompleteSnapshot(cfg.DstDir, name); err != nil {
+		logging.Fatal("Failed to rename snapshot %s to %s: %s", partialDir, snapshotDir, err)
+		os.Exit(1)
+	}
+
+	if err := file.UpdateLatestSnapshot(cfg.DstDir, name); err != nil {
+		logging.Fatal("Failed to point %s at snapshot %s: %s", file.LatestSnapshot, name, err)
+		os.Exit(1)
+	}
+
+	logging.Info("Saved snapshot %s: copied %d files and linked %d unchanged files", name, len(plan.Files), len(plan.Reuse))
+}
+
+// backupToRepository stores a snapshot of the source directory in the repository at the
+// destination, creating the repository if needed. Files are compared with the latest snapshot of
+// the source directory the same way they are compared with a backup location, except only sizes
+// and modification times are compared.
+func backupToRepository(cfg config.Config) {
+	r, err := openRepository(cfg)
+	if err != nil {
+		logging.Fatal("Failed to open repository %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+
+	logging.Debug("Scanning source directory")
+	srcIndex := file.ScanDirectory(cfg.SrcDir)
+
+	var parent *repo.Snapshot
+	if r != nil {
+		defer r.Close()
+		if parent, err = r.LatestSnapshot(cfg.SrcDir); err != nil {
+			logging.Fatal("Failed to read snapshots from repository %s: %s", cfg.DstDir, err)
+			os.Exit(1)
+		}
+	}
+
+	parentNodes, parentIndex := map[string]*repo.Node{}, map[string]os.FileInfo{}
+	if parent != nil {
+		logging.Info("Comparing with snapshot %s from %s", parent.ID[:8], parent.Time.Local().Format(time.RFC3339))
+		if parentNodes, parentIndex, err = r.Index(parent.Tree); err != nil {
+			logging.Fatal("Failed to read snapshot %s: %s", parent.ID, err)
+			os.Exit(1)
+		}
+	}
+
+	logging.Info("Determining files to be backed up")
+	plan := file.GenerateBackupDetails(srcIndex, parentIndex, cfg.SrcDir, cfg.DstDir, file.Options{QuickCheck: true, ModifyWindow: cfg.ModifyWindow})
+
+	if cfg.DryRun {
+		if err := plan.Report(os.Stdout); err != nil {
+			logging.Error("Failed to write plan report: %s", err)
+		}
+		logging.Info("Dry run: %d files to store", len(plan.Files))
+		return
+	}
+
+	snapshot, stats, err := r.Backup(cfg.SrcDir, srcIndex, plan, parent, parentNodes, cfg.IncludeSymlinks)
+	if err != nil {
+		logging.Fatal("Failed to store snapshot: %s", err)
+		os.Exit(1)
+	}
+
+	logging.Info("Saved snapshot %s of %d files: read %d bytes from %d changed files and stored %d new bytes",
+		snapshot.ID[:8], stats.Files, stats.Bytes, stats.ChunkedFiles, stats.NewBytes)
+
+	if stats.Failed > 0 {
+		logging.Error("Backup finished with errors: %d files could not be stored", stats.Failed)
+		os.Exit(1)
+	}
+}
+
+// archiveDestination returns the archive path the backup is written to, and false if the
+// destination is a directory. Paths with an archive extension that are existing directories are
+// backed up to as directories.
+func archiveDestination(cfg config.Config) (string, bool) {
+	if cfg.Command != config.CommandBackup {
+		return "", false
+	}
+
+	if cfg.DstDir == config.StdioPath {
+		return file.ArchiveStdout, true
+	}
+
+	path := strings.TrimSuffix(cfg.DstDir, "/")
+	if _, ok := file.ArchiveFormat(path); !ok {
+		return "", false
+	}
+
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return "", false
+	}
+
+	return path, true
+}
+
+// archiveSource returns the archive path the source of a backup is read from, and false if the
+// source is a directory. Paths with an archive extension that are directories are backed up as
+// directories.
+func archiveSource(cfg config.Config) (string, bool) {
+	if cfg.Command != config.CommandBackup && cfg.Command != config.CommandPlan {
+		return "", false
+	}
+
+	if cfg.SrcDir == config.StdioPath {
+		return file.ArchiveStdin, true
+	}
+
+	path := strings.TrimSuffix(cfg.SrcDir, "/")
+	if _, ok := file.ArchiveFormat(path); !ok {
+		return "", false
+	}
+
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", false
+	}
+
+	return path, true
+}
+
+// backupToArchive writes the whole source directory to a tar or zip archive, or as a tar stream
+// to standard output
+func backupToArchive(cfg config.Config, archivePath string, limiter *throttle.Limiter) {
+	logging.Debug("Scanning source directory")
+	srcIndex := file.ScanDirectory(cfg.SrcDir)
+
+	if cfg.DryRun {
+		entries, size := 0, int64(0)
+		for _, info := range srcIndex {
+			if info.Mode()&os.ModeSymlink != 0 && !cfg.IncludeSymlinks {
+				continue
+			}
+			entries++
+			if info.Mode().IsRegular() {
+				size += info.Size()
+			}
+		}
+		logging.Info("Dry run: %d entries holding %d bytes to write to archive %s", entries, size, archivePath)
+		return
+	}
+
+	name := archivePath
+	if archivePath == file.ArchiveStdout {
+		name = "standard output"
+	}
+
+	logging.Info("Writing archive to %s", name)
+	stats, err := file.WriteArchive(srcIndex, cfg.SrcDir, archivePath, file.ArchiveOptions{
+		Metadata:        file.Options{Xattrs: cfg.Xattrs, ACLs: cfg.Acls},
+		IncludeSymlinks: cfg.IncludeSymlinks,
+		Limiter:         limiter,
+	})
+	if err != nil {
+		logging.Fatal("Failed to write archive to %s: %s", name, err)
+		os.Exit(1)
+	}
+
+	logging.Info("Wrote %d entries holding %d bytes to %s", stats.Entries, stats.Bytes, name)
+
+	if stats.Failed > 0 {
+		logging.Error("Backup finished with errors: %d entries could not be archived", stats.Failed)
+		os.Exit(1)
+	}
+}
+
+// backupEncrypted backs up the source directory to the encrypted destination, creating it if
+// needed. Files are compared with the digests of their contents recorded in the encrypted
+// manifest, so the backed up files do not need to be decrypted to find the changed ones.
+func backupEncrypted(cfg config.Config, limiter *throttle.Limiter) {
+	secret, err := encryptionSecret(cfg)
+	if err != nil {
+		logging.Fatal("Failed to read the encryption key: %s", err)
+		os.Exit(1)
+	}
 
-	logging.Info("Creating new directories")
-	bar := progress.Start(len(directories) + 1)
-	for _, dir := range directories {
+	var store *crypt.Store
+	manifest := crypt.NewManifest()
+	if crypt.Exists(cfg.DstDir) {
+		if store, err = crypt.Open(cfg.DstDir, secret); err != nil {
+			logging.Fatal("Failed to open encrypted backup location %s: %s", cfg.DstDir, err)
+			os.Exit(1)
+		}
+		manifest = store.Manifest()
+	} else if !cfg.DryRun {
+		logging.Info("Creating encrypted backup location %s", cfg.DstDir)
+		if store, err = crypt.Init(cfg.DstDir, secret); err != nil {
+			logging.Fatal("Failed to create encrypted backup location %s: %s", cfg.DstDir, err)
+			os.Exit(1)
+		}
+	}
+
+	logging.Debug("Scanning source directory")
+	srcIndex := file.ScanDirectory(cfg.SrcDir)
+
+	logging.Info("Determining files to be backed up")
+	plan, err := manifest.Plan(cfg.SrcDir, cfg.DstDir, srcIndex, backupOptions(cfg, nil), cfg.Mirror, cfg.IncludeSymlinks)
+	if err != nil {
+		logging.Fatal("Failed to plan backup: %s", err)
+		os.Exit(1)
+	}
+
+	if cfg.DryRun {
+		if err := plan.Report(os.Stdout); err != nil {
+			logging.Error("Failed to write plan report: %s", err)
+		}
+		logging.Info("Dry run: %d files to encrypt and %d entries to remove", len(plan.Files), len(plan.Removals))
+		return
+	}
+
+	if err := store.Apply(plan, srcIndex, limiter); err != nil {
+		logging.Error("Backup finished with errors: %s", err)
+		os.Exit(1)
+	}
+
+	logging.Info("Encrypted %d files and removed %d entries", len(plan.Files), len(plan.Removals))
+}
+
+// encryptionSecret returns the key file or the passphrase from the environment that an encrypted
+// backup location is encrypted with
+func encryptionSecret(cfg config.Config) (crypt.Secret, error) {
+	secret := crypt.Secret{Passphrase: os.Getenv(config.PassphraseEnv), KeyFile: cfg.KeyFile}
+	if secret.Passphrase == "" && secret.KeyFile == "" {
+		return secret, fmt.Errorf("no passphrase in %s or key file given", config.PassphraseEnv)
+	}
+
+	return secret, nil
+}
+
+// pruneSnapshots removes the snapshot directories in the destination that the retention policy does
+// not keep. The latest snapshot is always kept.
+func pruneSnapshots(cfg config.Config) {
+	names, err := file.ListSnapshots(cfg.DstDir)
+	if err != nil {
+		logging.Fatal("Failed to list snapshots in %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+
+	// Partial snapshots are still being written, or were left by a backup that was interrupted, so
+	// they are neither counted nor removed
+	if partial, err := file.ListPartialSnapshots(cfg.DstDir); err == nil && len(partial) > 0 {
+		logging.Warn("Ignoring %d incomplete snapshots: %s", len(partial), strings.Join(partial, ", "))
+	}
+
+	latest, err := file.LatestSnapshotDir(cfg.DstDir)
+	if err != nil {
+		logging.Fatal("Failed to read the latest snapshot in %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+
+	times := make([]time.Time, len(names))
+	for i, name := range names {
+		times[i], _ = file.ParseSnapshotName(name)
+	}
+
+	decisions := cfg.Keep.Apply(times)
+	remove := []string{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i, name := range names {
+		if latest != "" && filepath.Base(latest) == name {
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, file.LatestSnapshot)
+		}
+
+		if decisions[i].Keep {
+			fmt.Fprintf(w, "keep\t%s\t(%s)\n", name, strings.Join(decisions[i].Reasons, ", "))
+		} else {
+			fmt.Fprintf(w, "remove\t%s\n", name)
+			remove = append(remove, name)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		logging.Error("Failed to write prune report: %s", err)
+	}
+
+	size := file.SnapshotsSize(cfg.DstDir, remove)
+
+	if cfg.DryRun {
+		logging.Info("Dry run: %d of %d snapshots to remove with %s, freeing %d bytes", len(remove), len(names), cfg.Keep, size)
+		return
+	}
+
+	if len(remove) == 0 {
+		logging.Info("No snapshots to remove")
+		return
+	}
+
+	logging.Info("Removing %d of %d snapshots", len(remove), len(names))
+	failed := 0
+	bar := progress.Start(len(remove) + 1)
+	for _, name := range remove {
+		logging.Debug("Removing snapshot %s", name)
+		if err := file.RemoveSnapshot(cfg.DstDir, name); err != nil {
+			logging.Error("Failed to remove snapshot %s: %s", name, err)
+			failed++
+		}
 		bar.Increment()
-		logging.Debug("Create directory %s", filepath.Join(config.DstDir, dir))
-		os.MkdirAll(filepath.Join(config.DstDir, dir), os.ModePerm)
 	}
 	bar.Increment()
 	bar.Finish()
 
-	logging.Info("Copying files")
-	bar = progress.Start(len(files) + 1)
-	for _, f := range files {
-		bar.Increment()
-		logging.Debug("Copying %s to backup location %s", filepath.Join(config.SrcDir, f), filepath.Join(config.DstDir, f))
-		err := file.CopyFile(filepath.Join(config.SrcDir, f), filepath.Join(config.DstDir, f))
+	if failed > 0 {
+		logging.Error("Prune finished with errors: %d snapshots could not be removed", failed)
+		os.Exit(1)
+	}
+
+	logging.Info("Removed %d snapshots, freeing %d bytes", len(remove), size)
+}
+
+// pruneRepository removes the snapshots in the repository at the destination that the retention
+// policy does not keep, applying the policy to the snapshots of each source directory separately,
+// then removes the data that only those snapshots referred to
+func pruneRepository(cfg config.Config) {
+	r, err := repo.OpenExclusive(cfg.DstDir)
+	if err != nil {
+		logging.Fatal("Failed to open repository %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		logging.Fatal("Failed to read snapshots from repository %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+
+	sources := map[string][]*repo.Snapshot{}
+	for _, s := range snapshots {
+		sources[s.Source] = append(sources[s.Source], s)
+	}
+
+	forget := []*repo.Snapshot{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, s := range snapshots {
+		group := sources[s.Source]
+		if group == nil {
+			continue
+		}
+		delete(sources, s.Source)
+
+		times := make([]time.Time, len(group))
+		for i, s := range group {
+			times[i] = s.Time.Local()
+		}
+
+		for i, d := range cfg.Keep.Apply(times) {
+			when := times[i].Format(time.RFC3339)
+			if d.Keep {
+				fmt.Fprintf(w, "keep\t%s\t%s\t%s\t(%s)\n", group[i].ID[:8], when, group[i].Source, strings.Join(d.Reasons, ", "))
+			} else {
+				fmt.Fprintf(w, "remove\t%s\t%s\t%s\n", group[i].ID[:8], when, group[i].Source)
+				forget = append(forget, group[i])
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		logging.Error("Failed to write prune report: %s", err)
+	}
+
+	if len(forget) == 0 {
+		logging.Info("No snapshots to remove")
+		return
+	}
+
+	logging.Info("Finding data no longer referred to by the snapshots that are kept")
+	stats, err := r.Prune(forget, cfg.DryRun)
+	if err != nil {
+		logging.Fatal("Failed to prune repository %s: %s", cfg.DstDir, err)
+		os.Exit(1)
+	}
+
+	if cfg.DryRun {
+		logging.Info("Dry run: %d of %d snapshots to remove with %s, freeing %d bytes by deleting %d packs and rewriting %d",
+			len(forget), len(snapshots), cfg.Keep, stats.UnusedBytes, stats.DeletedPacks, stats.RepackedPacks)
+		return
+	}
+
+	logging.Info("Removed %d snapshots, freeing %d bytes by deleting %d packs and rewriting %d",
+		len(forget), stats.UnusedBytes, stats.DeletedPacks, stats.RepackedPacks)
+}
+
+// restore restores the selected entries from the backup location, snapshot or repository at the
+// source to the target directory at the destination
+func restore(cfg config.Config) {
+	source, err := openRestoreSource(cfg)
+	if err != nil {
+		logging.Fatal("Failed to open backup %s: %s", cfg.SrcDir, err)
+		os.Exit(1)
+	}
+
+	logging.Info("Determining entries to restore")
+	plan, err := file.PlanRestore(source, cfg.DstDir, file.RestoreOptions{
+		Paths:    cfg.Paths,
+		Conflict: cfg.Conflict,
+		Metadata: file.Options{Archive: cfg.Archive, Xattrs: cfg.Xattrs, ACLs: cfg.Acls},
+		Jobs:     cfg.Jobs,
+	})
+	if err != nil {
+		logging.Fatal("Failed to plan restore: %s", err)
+		os.Exit(1)
+	}
+
+	if cfg.DryRun {
+		if err := plan.Report(os.Stdout); err != nil {
+			logging.Error("Failed to write restore report: %s", err)
+		}
+		logging.Info("Dry run: %d directories to create, %d files and %d symlinks to restore, %d entries skipped",
+			len(plan.Directories), len(plan.Files), len(plan.Symlinks), len(plan.Skipped))
+		return
+	}
+
+	if plan.Empty() {
+		logging.Info("Nothing to restore, %d entries skipped", len(plan.Skipped))
+		return
+	}
+
+	if err := plan.Apply(); err != nil {
+		logging.Error("Restore finished with errors: %s", err)
+		os.Exit(1)
+	}
+
+	logging.Info("Restored %d files and %d symlinks, skipped %d existing entries", len(plan.Files), len(plan.Symlinks), len(plan.Skipped))
+}
+
+// verify checks the backup location, or the snapshot in it, against the manifest written by the
+// last backup and exits with an error if any entry is missing, extra, corrupt or has different
+// metadata
+func verify(cfg config.Config) {
+	sample, err := file.ParseSample(cfg.Sample)
+	if err != nil {
+		logging.Fatal("Invalid sample: %s", err)
+		os.Exit(1)
+	}
+
+	dir := cfg.DstDir
+	if cfg.FromSnapshot != "" {
+		dir = filepath.Join(cfg.DstDir, cfg.FromSnapshot)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			logging.Fatal("No snapshot named %s in %s", cfg.FromSnapshot, cfg.DstDir)
+			os.Exit(1)
+		}
+	} else if file.IsSnapshotLocation(dir) {
+		latest, err := file.LatestSnapshotDir(dir)
 		if err != nil {
-			logging.Error("Failed to copy file %s: %s", filepath.Join(config.SrcDir, f), err)
+			logging.Fatal("Failed to read the latest snapshot in %s: %s", dir, err)
+			os.Exit(1)
 		}
+
+		logging.Info("Verifying the latest snapshot, %s", filepath.Base(latest))
+		dir = latest
 	}
-	bar.Increment()
-	bar.Finish()
 
-	if config.IncludeSymlinks {
-		logging.Info("Copying symlinks")
-		bar = progress.Start(len(symlinks) + 1)
-		for link, target := range symlinks {
-			bar.Increment()
-			logging.Debug("Creating symlink to %s at %s", target, filepath.Join(config.DstDir, link))
-			if _, err := os.Lstat(filepath.Join(config.DstDir, link)); err == nil {
-				if err := os.Remove(filepath.Join(config.DstDir, link)); err != nil {
-					logging.Error("Failed to unlink: %+v", err)
-				}
-			}
-			err := os.Symlink(target, filepath.Join(config.DstDir, link))
-			if err != nil {
-				logging.Error("Failed to create symlink %s: %s", filepath.Join(config.DstDir, link), err)
-			}
+	logging.Info("Verifying %s", dir)
+	report, err := file.Verify(dir, file.VerifyOptions{Sample: sample, Jobs: cfg.Jobs})
+	if err != nil {
+		logging.Fatal("Failed to verify %s: %s", dir, err)
+		os.Exit(1)
+	}
+
+	if err := report.Write(os.Stdout); err != nil {
+		logging.Error("Failed to write verify report: %s", err)
+	}
+
+	logging.Info("Checked %d entries and read %d of %d files", report.Entries, report.Read, report.Files)
+
+	if len(report.Problems) > 0 {
+		logging.Error("Verification failed: found %d problems", len(report.Problems))
+		os.Exit(1)
+	}
+
+	logging.Info("Backup verified, no problems found")
+}
+
+// openRestoreSource opens the backup to restore from. A repository restores its latest snapshot
+// or the one chosen by ID, an encrypted backup location is decrypted, a snapshot destination
+// restores the snapshot latest points at or the one chosen by name, and any other directory is
+// restored from as is, even if its source had a latest symlink of its own.
+func openRestoreSource(cfg config.Config) (file.RestoreSource, error) {
+	if repo.Exists(cfg.SrcDir) {
+		r, err := repo.Open(cfg.SrcDir)
+		if err != nil {
+			return nil, err
 		}
-		bar.Increment()
-		bar.Finish()
-	}
-
-	if config.Mirror {
-		logging.Info("Removing excess files in backup directory")
-		bar = progress.Start(len(dstIndex) + 1)
-		for dstPath := range dstIndex {
-			bar.Increment()
-			if _, ok := srcIndex[dstPath]; !ok {
-				logging.Debug("Removing file %s", filepath.Join(config.DstDir, dstPath))
-				err := os.RemoveAll(dstPath)
-				if err != nil {
-					logging.Error("Failed to remove file %s: %s", filepath.Join(config.DstDir, dstPath), err)
-				}
+
+		snapshot, err := r.FindSnapshot(cfg.FromSnapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		logging.Info("Restoring snapshot %s of %s from %s", snapshot.ID[:8], snapshot.Source, snapshot.Time.Local().Format(time.RFC3339))
+		return r.RestoreSource(snapshot)
+	}
+
+	if crypt.Exists(cfg.SrcDir) {
+		secret, err := encryptionSecret(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		store, err := crypt.Open(cfg.SrcDir, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		return store.RestoreSource(), nil
+	}
+
+	if cfg.FromSnapshot != "" {
+		dir := filepath.Join(cfg.SrcDir, cfg.FromSnapshot)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("no snapshot named %s", cfg.FromSnapshot)
+		}
+
+		logging.Info("Restoring snapshot %s", cfg.FromSnapshot)
+		return file.NewDirSource(dir), nil
+	}
+
+	if file.IsSnapshotLocation(cfg.SrcDir) {
+		latest, err := file.LatestSnapshotDir(cfg.SrcDir)
+		if err != nil {
+			return nil, err
+		}
+
+		logging.Info("Restoring the latest snapshot, %s", filepath.Base(latest))
+		return file.NewDirSource(latest), nil
+	}
+
+	return file.NewDirSource(cfg.SrcDir), nil
+}
+
+// openRepository opens the repository at the destination, creating it if the destination is not
+// yet a repository. A dry run does not create a repository and returns nil instead.
+func openRepository(cfg config.Config) (*repo.Repository, error) {
+	if repo.Exists(cfg.DstDir) {
+		return repo.Open(cfg.DstDir)
+	}
+
+	if cfg.DryRun {
+		return nil, nil
+	}
+
+	logging.Info("Creating repository at %s", cfg.DstDir)
+	return repo.Init(cfg.DstDir)
+}
+
+// loadHashCache reads the hash cache when caching is enabled, or returns nil. A cache that cannot
+// be read is ignored and overwritten.
+func loadHashCache(cfg config.Config) *file.HashCache {
+	if !cfg.CacheHashes && cfg.StateDir == "" {
+		return nil
+	}
+
+	hasher, _ := file.NewHasher(cfg.Hash)
+	path := file.HashCachePath(cfg.StateDir, cfg.SrcDir, cfg.DstDir)
+
+	cache, err := file.LoadHashCache(path, hasher.Name())
+	if err != nil {
+		logging.Warn("Failed to read hash cache %s, starting a new one: %s", path, err)
+		cache = file.NewHashCache(path, hasher.Name())
+	}
+
+	return cache
+}
+
+// saveHashCache writes the hash cache, if any, unless running dry
+func saveHashCache(cfg config.Config, cache *file.HashCache) {
+	if cache == nil || cfg.DryRun {
+		return
+	}
+
+	if err := cache.Save(); err != nil {
+		logging.Warn("Failed to write hash cache: %s", err)
+	}
+}
+
+// runPlan applies the plan, or only reports it when running dry
+func runPlan(cfg config.Config, plan *file.Plan, limiter *throttle.Limiter) {
+	if cfg.DryRun {
+		if err := plan.Report(os.Stdout); err != nil {
+			logging.Error("Failed to write plan report: %s", err)
+		}
+		logging.Info("Dry run: %d directories to create, %d files to copy, %d hard links to create, %d symlinks to create, %d metadata updates, %d paths to remove",
+			len(plan.Directories), len(plan.Files), len(plan.Links), len(plan.Symlinks), len(plan.Metadata), len(plan.Removals))
+		return
+	}
+
+	if plan.Empty() {
+		// A backup location last backed up before manifests were written still needs one
+		if _, err := os.Stat(file.ManifestPath(plan.DstDir)); os.IsNotExist(err) {
+			logging.Info("Writing manifest")
+			if err := plan.WriteManifest(); err != nil {
+				logging.Fatal("Failed to write manifest %s: %s", file.ManifestPath(plan.DstDir), err)
+				os.Exit(1)
 			}
 		}
-		bar.Increment()
-		bar.Finish()
+		logging.Info("Backup location is already up to date")
+		return
+	}
+
+	if err := plan.Apply(file.ApplyOptions{Jobs: cfg.Jobs, Limiter: limiter, Manifest: true}); err != nil {
+		logging.Error("Backup finished with errors: %s", err)
+		os.Exit(1)
 	}
 }
+
+// newLimiter creates the bandwidth limiter configured by the bwlimit and bwschedule flags, or nil
+// if neither is set
+func newLimiter(cfg config.Config) (*throttle.Limiter, error) {
+	if cfg.Bwlimit == "" && cfg.Bwschedule == "" {
+		return nil, nil
+	}
+
+	var rate int64
+	if cfg.Bwlimit != "" {
+		var err error
+		if rate, err = throttle.ParseRate(cfg.Bwlimit); err != nil {
+			return nil, err
+		}
+	}
+
+	schedule, err := throttle.ParseSchedule(cfg.Bwschedule, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	return throttle.New(schedule), nil
+}
@@ -1,34 +1,207 @@
 package config
 
 import (
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/jpillora/opts"
 	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/retention"
 )
 
+const (
+	// CommandBackup scans, plans and applies a backup in a single run
+	CommandBackup = "backup"
+	// CommandPlan scans the source and destination and writes the backup plan to a file
+	CommandPlan = "plan"
+	// CommandApply applies a previously written backup plan
+	CommandApply = "apply"
+	// CommandPrune removes the snapshots in a backup location that a retention policy does not keep
+	CommandPrune = "prune"
+	// CommandRestore restores entries from a backup location, snapshot or repository
+	CommandRestore = "restore"
+	// CommandVerify checks a backup location against the manifest written by the last backup
+	CommandVerify = "verify"
+
+	// PassphraseEnv is the environment variable the passphrase of an encrypted backup location is
+	// read from, so it is not visible in the process list
+	PassphraseEnv = "BACKUP_PASSPHRASE"
+
+	// StdioPath is the source that reads a tar stream from standard input, or the destination that
+	// writes one to standard output
+	StdioPath = "-"
+)
+
+// Options contains the flags shared by the commands that write to a backup location
+type Options struct {
+	Fast            bool          `opts:"help=Assume files of the same size are equal and don't do a hashsum check to test contents equality"`
+	Mirror          bool          `opts:"help=Ensure backup location is a mirror of the source location (This will remove any files in the destination that do not exist at the source)"`
+	IncludeSymlinks bool          `opts:"help=Also backup any symlinks found (If the symlink target is also in the source directory the backup symlink will target the backed-up file)"`
+	Archive         bool          `opts:"help=Preserve the permissions and timestamps (and ownership when running as root) of backed up entries"`
+	Xattrs          bool          `opts:"help=Preserve the user extended attributes (and trusted and security attributes when running as root) of backed up entries"`
+	Acls            bool          `opts:"help=Preserve the POSIX access and default ACLs of backed up entries"`
+	HardLinks       bool          `opts:"short=H,help=Copy hard linked files once and recreate their other paths as hard links in the backup location"`
+	QuickCheck      bool          `opts:"help=Treat files as changed only when their size or modification time differs and preserve the modification time of copied files"`
+	ModifyWindow    time.Duration `opts:"help=The largest difference in modification times treated as equal by the quick check (e.g. 2s for FAT destinations)"`
+	QuickCheckHash  bool          `opts:"help=Compare the hashsums of files whose size matches but whose modification time differs in quick check mode instead of copying them"`
+	Hash            string        `opts:"short=c,help=The checksum algorithm used to compare file contents: sha256 (default) or blake2b or xxh3 (fastest but not cryptographic)"`
+	CacheHashes     bool          `opts:"help=Keep the hashsums of files between runs in .backup-state/hash-cache.json at the backup location so unchanged files are not hashed again"`
+	StateDir        string        `opts:"help=Keep the hash cache in this directory instead of at the backup location (implies cache-hashes)"`
+	RecordDigests   bool          `opts:"help=Record the digest of each copied file in user.backup.* extended attributes at the backup location and use it instead of hashing the backed up file again"`
+	Append          bool          `opts:"help=Copy only the end of files that have grown when the file at the backup location matches the start of the file (for log files)"`
+	Delta           bool          `opts:"help=Transfer changed files by sending only the blocks that differ from the file at the backup location (rsync style)"`
+	Compress        string        `opts:"short=z,help=Compress files at the backup location with zstd or gzip (Already compressed formats and files that do not shrink are stored as is)"`
+	Repository      bool          `opts:"help=Store the backup as a snapshot in a deduplicating repository at the backup location where each distinct chunk of data is stored once"`
+	Snapshot        bool          `opts:"help=Back up to a new timestamped snapshot directory in the backup location with unchanged files hard linked from the previous snapshot"`
+	Encrypt         bool          `opts:"help=Encrypt the names and contents of backed up files with a key derived from the passphrase in BACKUP_PASSPHRASE or from the key file"`
+	KeyFile         string        `opts:"help=Derive the encryption key from the contents of this file (at least 32 random bytes) instead of a passphrase"`
+	Jobs            int           `opts:"help=The number of directories or files or symlinks to create at once (default 1)"`
+	Bwlimit         string        `opts:"help=Limit the total rate files are written to the backup location (e.g. 20MiB/s)"`
+	Bwschedule      string        `opts:"help=Limit the write rate by time of day (e.g. 08:00-18:00=10MiB with further windows after commas) falling back to bwlimit outside the schedule"`
+	DryRun          bool          `opts:"short=d,help=Print every change that would be made to the backup location and why (No changes are made)"`
+	Verbose         bool          `opts:"help=Enable debug logging"`
+}
+
 // Config contains the validated flags
 type Config struct {
-	SrcDir          string `opts:"mode=arg,help=(Required) The absolute directory path you wish to back up"`
-	DstDir          string `opts:"mode=arg,help=(Required) The absolute directory that the source directory will be backed up to"`
-	Fast            bool   `opts:"help=Assume files of the same size are equal and don't do a hashsum check to test contents equality"`
-	Mirror          bool   `opts:"help=Ensure backup location is a mirror of the source location (This will remove any files in the destination that do not exist at the source)"`
-	IncludeSymlinks bool   `opts:"help=Also backup any symlinks found (If the symlink target is also in the source directory the backup symlink will target the backed-up file)"`
-	Verbose         bool   `opts:"help=Enable debug logging"`
+	Command  string `opts:"-"`
+	SrcDir   string `opts:"mode=arg,help=(Required) The absolute directory path you wish to back up or an archive path ending in .tar or .tar.gz or .tar.zst or .zip or - for a tar stream on standard input"`
+	DstDir   string `opts:"mode=arg,help=(Required) The absolute directory that the source directory will be backed up to or an archive path ending in .tar or .tar.gz or .tar.zst or .zip or - for a tar stream on standard output"`
+	PlanFile string `opts:"-"`
+	Options
+	Keep         retention.Policy `opts:"-"`
+	FromSnapshot string           `opts:"-"`
+	Paths        []string         `opts:"-"`
+	Conflict     string           `opts:"-"`
+	Sample       string           `opts:"-"`
+}
+
+type planConfig struct {
+	SrcDir   string `opts:"mode=arg,help=(Required) The absolute directory path you wish to back up"`
+	DstDir   string `opts:"mode=arg,help=(Required) The absolute directory that the source directory will be backed up to"`
+	PlanFile string `opts:"mode=arg,help=(Required) The file the backup plan will be written to"`
+	Options
+}
+
+type applyConfig struct {
+	PlanFile   string `opts:"mode=arg,help=(Required) The backup plan file written by the plan command"`
+	Jobs       int    `opts:"help=The number of directories or files or symlinks to create at once (default 1)"`
+	Bwlimit    string `opts:"help=Limit the total rate files are written to the backup location (e.g. 20MiB/s)"`
+	Bwschedule string `opts:"help=Limit the write rate by time of day (e.g. 08:00-18:00=10MiB with further windows after commas) falling back to bwlimit outside the schedule"`
+	DryRun     bool   `opts:"help=Print every change in the plan and why (No changes are made)"`
+	Verbose    bool   `opts:"help=Enable debug logging"`
+}
+
+type pruneConfig struct {
+	DstDir      string `opts:"mode=arg,help=(Required) The backup location holding the snapshots or the repository to prune"`
+	KeepLast    int    `opts:"help=Keep the N most recent snapshots"`
+	KeepDaily   int    `opts:"help=Keep the most recent snapshot of each of the last N days with a snapshot"`
+	KeepWeekly  int    `opts:"help=Keep the most recent snapshot of each of the last N weeks with a snapshot"`
+	KeepMonthly int    `opts:"help=Keep the most recent snapshot of each of the last N months with a snapshot"`
+	KeepYearly  int    `opts:"help=Keep the most recent snapshot of each of the last N years with a snapshot"`
+	DryRun      bool   `opts:"short=d,help=Print which snapshots would be removed and why the others are kept (No changes are made)"`
+	Verbose     bool   `opts:"help=Enable debug logging"`
+}
+
+type restoreConfig struct {
+	BackupDir string   `opts:"mode=arg,help=(Required) The backup location or repository to restore from"`
+	TargetDir string   `opts:"mode=arg,help=(Required) The directory entries are restored to"`
+	Paths     []string `opts:"mode=arg,help=Paths or glob patterns of the entries to restore (default everything)"`
+	Snapshot  string   `opts:"help=The snapshot directory name or repository snapshot ID to restore from (default the latest)"`
+	Conflict  string   `opts:"help=What to do with entries that already exist in the target: skip (default) or overwrite or rename"`
+	KeyFile   string   `opts:"help=The key file an encrypted backup location was encrypted with (otherwise the passphrase is read from BACKUP_PASSPHRASE)"`
+	Xattrs    bool     `opts:"help=Restore extended attributes (and trusted and security attributes when running as root)"`
+	Acls      bool     `opts:"help=Restore POSIX access and default ACLs"`
+	Jobs      int      `opts:"help=The number of files or symlinks to restore at once (default 1)"`
+	DryRun    bool     `opts:"short=d,help=Print every entry that would be restored or skipped and why (No changes are made)"`
+	Verbose   bool     `opts:"help=Enable debug logging"`
+}
+
+type verifyConfig struct {
+	BackupDir string `opts:"mode=arg,help=(Required) The backup location or snapshot location to verify"`
+	Snapshot  string `opts:"help=The snapshot directory name to verify (default the latest)"`
+	Sample    string `opts:"help=Read only a random sample of the files (e.g. 5%) while still checking every entry's metadata"`
+	Jobs      int    `opts:"help=The number of files to read at once (default 1)"`
+	Verbose   bool   `opts:"help=Enable debug logging"`
 }
 
 // ParseConfig parses the command line flags and validates them
 func ParseConfig() Config {
-	c := Config{}
-	opts.Parse(&c)
+	c := Config{Command: CommandBackup}
+
+	command := CommandBackup
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case CommandPlan:
+		p := planConfig{}
+		opts.New(&p).Name("backup plan").ParseArgs(commandArgs())
+		c = Config{Command: CommandPlan, SrcDir: p.SrcDir, DstDir: p.DstDir, PlanFile: p.PlanFile, Options: p.Options}
+	case CommandApply:
+		a := applyConfig{}
+		opts.New(&a).Name("backup apply").ParseArgs(commandArgs())
+		return Config{Command: CommandApply, PlanFile: a.PlanFile, Options: Options{
+			Jobs:       a.Jobs,
+			Bwlimit:    a.Bwlimit,
+			Bwschedule: a.Bwschedule,
+			DryRun:     a.DryRun,
+			Verbose:    a.Verbose,
+		}}
+	case CommandPrune:
+		p := pruneConfig{}
+		opts.New(&p).Name("backup prune").ParseArgs(commandArgs())
+		c = Config{Command: CommandPrune, DstDir: p.DstDir, Options: Options{DryRun: p.DryRun, Verbose: p.Verbose}, Keep: retention.Policy{
+			Last:    p.KeepLast,
+			Daily:   p.KeepDaily,
+			Weekly:  p.KeepWeekly,
+			Monthly: p.KeepMonthly,
+			Yearly:  p.KeepYearly,
+		}}
+	case CommandRestore:
+		r := restoreConfig{}
+		opts.New(&r).Name("backup restore").ParseArgs(commandArgs())
+		c = Config{Command: CommandRestore, SrcDir: r.BackupDir, DstDir: r.TargetDir, FromSnapshot: r.Snapshot, Paths: r.Paths, Conflict: r.Conflict, Options: Options{
+			Archive: true,
+			KeyFile: r.KeyFile,
+			Xattrs:  r.Xattrs,
+			Acls:    r.Acls,
+			Jobs:    r.Jobs,
+			DryRun:  r.DryRun,
+			Verbose: r.Verbose,
+		}}
+	case CommandVerify:
+		v := verifyConfig{}
+		opts.New(&v).Name("backup verify").ParseArgs(commandArgs())
+		c = Config{Command: CommandVerify, DstDir: v.BackupDir, FromSnapshot: v.Snapshot, Sample: v.Sample, Options: Options{
+			Jobs:    v.Jobs,
+			Verbose: v.Verbose,
+		}}
+	default:
+		opts.Parse(&c)
+	}
 
 	var err error
 
-	c.SrcDir, err = filepath.Abs(c.SrcDir)
+	// Standard input is a source of archives rather than a path
+	if c.SrcDir != StdioPath {
+		c.SrcDir, err = filepath.Abs(c.SrcDir)
 
-	if err != nil {
-		logging.Fatal("Could not resolve absolute path for source directory: %s", err)
+		if err != nil {
+			logging.Fatal("Could not resolve absolute path for source directory: %s", err)
+		}
+
+		if !strings.HasSuffix(c.SrcDir, "/") {
+			c.SrcDir += "/"
+		}
+	}
+
+	// Standard output is a destination for archives rather than a path
+	if c.DstDir == StdioPath {
+		return c
 	}
 
 	c.DstDir, err = filepath.Abs(c.DstDir)
@@ -37,13 +210,14 @@ func ParseConfig() Config {
 		logging.Fatal("Could not resolve absolute path for source directory: %s", err)
 	}
 
-	if !strings.HasSuffix(c.SrcDir, "/") {
-		c.SrcDir += "/"
-	}
-
 	if !strings.HasSuffix(c.DstDir, "/") {
 		c.DstDir += "/"
 	}
 
 	return c
 }
+
+// commandArgs returns the program arguments with the command name removed
+func commandArgs() []string {
+	return append([]string{os.Args[0]}, os.Args[2:]...)
+}
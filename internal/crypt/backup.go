@@ -0,0 +1,269 @@
+package crypt
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/samphillips/backup/internal/file"
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/progress"
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+// Plan compares the scanned source directory with the manifest of the encrypted destination in
+// the destination directory and determines which files to encrypt, which entries only need their manifest entry updating and, when mirroring, which to
+// remove. Files are compared the way the options compare them with a backup location, except that
+// contents are compared with the digest recorded in the manifest instead of the backed up file.
+func (m *Manifest) Plan(srcDir, dstDir string, srcIndex map[string]os.FileInfo, opts file.Options, mirror, includeSymlinks bool) (*file.Plan, error) {
+	hasher, err := file.NewHasher(opts.Hash)
+	if err != nil {
+		return nil, err
+	}
+	opts.Hash = hasher.Name()
+
+	plan := &file.Plan{
+		SrcDir:      srcDir,
+		DstDir:      dstDir,
+		Created:     time.Now().UTC(),
+		Fingerprint: file.Fingerprint(srcIndex),
+		Options:     opts,
+		Directories: []file.Operation{},
+		Files:       []file.Operation{},
+		Reuse:       []file.Operation{},
+		Symlinks:    []file.Operation{},
+		Links:       []file.Operation{},
+		Metadata:    []file.Operation{},
+		Removals:    []file.Operation{},
+	}
+
+	paths := make([]string, 0, len(srcIndex))
+	for path := range srcIndex {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	bar := progress.Start(len(paths) + 1)
+	for _, path := range paths {
+		bar.Increment()
+		info := srcIndex[path]
+		entry := m.Entries[path]
+
+		switch {
+		case info.IsDir():
+			if entry == nil || entry.Type != EntryDir {
+				plan.Directories = append(plan.Directories, file.Operation{Path: path, Reason: file.ReasonMissing})
+			} else if metadataDiffers(info, entry, opts.ModifyWindow) {
+				plan.Metadata = append(plan.Metadata, file.Operation{Path: path, Reason: file.ReasonMetadataDiffers})
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if !includeSymlinks {
+				continue
+			}
+			target, err := os.Readlink(filepath.Join(srcDir, path))
+			if err != nil {
+				logging.Warn("Error reading file %s symlink: %s", path, err)
+				continue
+			}
+			if entry == nil || entry.Type != EntrySymlink {
+				plan.Symlinks = append(plan.Symlinks, file.Operation{Path: path, Target: target, Reason: file.ReasonMissing})
+			} else if entry.Target != target {
+				plan.Symlinks = append(plan.Symlinks, file.Operation{Path: path, Target: target, Reason: file.ReasonLinkDiffers})
+			} else if metadataDiffers(info, entry, opts.ModifyWindow) {
+				plan.Metadata = append(plan.Metadata, file.Operation{Path: path, Reason: file.ReasonMetadataDiffers})
+			}
+		case info.Mode().IsRegular():
+			if reason, changed := m.fileReason(srcDir, path, info, entry, hasher, opts); changed {
+				plan.Files = append(plan.Files, file.Operation{Path: path, Reason: reason})
+			} else if reason != "" {
+				plan.Metadata = append(plan.Metadata, file.Operation{Path: path, Reason: reason})
+			}
+		}
+	}
+	bar.Increment()
+	bar.Finish()
+
+	if mirror {
+		for path := range m.Entries {
+			if _, ok := srcIndex[path]; !ok {
+				plan.Removals = append(plan.Removals, file.Operation{Path: path, Reason: file.ReasonNotInSource})
+			}
+		}
+		sort.Slice(plan.Removals, func(i, j int) bool {
+			return plan.Removals[i].Path < plan.Removals[j].Path
+		})
+	}
+
+	return plan, nil
+}
+
+// fileReason returns why the source file differs from its manifest entry, or an empty string if
+// it does not, and whether its contents changed so it needs encrypting again rather than only its
+// manifest entry updating
+func (m *Manifest) fileReason(srcDir, path string, info os.FileInfo, entry *Entry, hasher file.Hasher, opts file.Options) (string, bool) {
+	if entry == nil || entry.Type != EntryFile {
+		return file.ReasonMissing, true
+	}
+	if entry.Size != info.Size() {
+		return file.ReasonSizeDiffers, true
+	}
+
+	mtimeDiffers := modTimeDiffers(info.ModTime(), entry.ModTime, opts.ModifyWindow)
+	hash := !opts.SkipHashsum
+	if opts.QuickCheck {
+		if mtimeDiffers && !opts.HashMtimeChanges {
+			return file.ReasonMtimeDiffers, true
+		}
+		hash = mtimeDiffers
+	}
+
+	if hash {
+		if m.Hash != hasher.Name() {
+			return file.ReasonHashDiffers, true
+		}
+
+		digest, err := file.HashFile(filepath.Join(srcDir, path), hasher)
+		if err != nil {
+			logging.Warn("Failed to hash %s: %s", path, err)
+			return file.ReasonHashDiffers, true
+		}
+		if digest != entry.Digest {
+			return file.ReasonHashDiffers, true
+		}
+	}
+
+	if metadataDiffers(info, entry, opts.ModifyWindow) {
+		return file.ReasonMetadataDiffers, false
+	}
+
+	return "", false
+}
+
+// metadataDiffers reports whether the permissions or modification time recorded in the manifest
+// differ from the source entry
+func metadataDiffers(info os.FileInfo, entry *Entry, window time.Duration) bool {
+	return info.Mode() != entry.Mode || modTimeDiffers(info.ModTime(), entry.ModTime, window)
+}
+
+// modTimeDiffers reports whether the modification times differ by more than the window
+func modTimeDiffers(a, b time.Time, window time.Duration) bool {
+	diff := a.Sub(b)
+	if diff < 0 {
+		diff = -diff
+	}
+
+	return diff > window
+}
+
+// Apply encrypts the files in the plan, updates the manifest for every other operation and saves
+// it. Failed files are logged, keep their previous manifest entry and the remaining operations are
+// still performed.
+func (s *Store) Apply(plan *file.Plan, srcIndex map[string]os.FileInfo, limiter *throttle.Limiter) error {
+	hasher, err := file.NewHasher(plan.Options.Hash)
+	if err != nil {
+		return err
+	}
+
+	// Digests of another algorithm cannot be compared, so every file is encrypted again and
+	// recorded with the new algorithm
+	if s.manifest.Hash != hasher.Name() {
+		for _, entry := range s.manifest.Entries {
+			entry.Digest = ""
+		}
+		s.manifest.Hash = hasher.Name()
+	}
+
+	failed := 0
+
+	logging.Info("Encrypting files")
+	bar := progress.Start(len(plan.Files) + 1)
+	for _, op := range plan.Files {
+		bar.Increment()
+		if err := s.encryptFile(plan.SrcDir, op.Path, hasher, limiter); err != nil {
+			logging.Error("Failed to encrypt %s: %s", filepath.Join(plan.SrcDir, op.Path), err)
+			failed++
+		}
+	}
+	bar.Increment()
+	bar.Finish()
+
+	for _, ops := range [][]file.Operation{plan.Directories, plan.Symlinks, plan.Metadata} {
+		for _, op := range ops {
+			info := srcIndex[op.Path]
+			entry := s.manifest.Entries[op.Path]
+			switch {
+			case info.IsDir():
+				s.manifest.Entries[op.Path] = &Entry{Type: EntryDir, Mode: info.Mode(), ModTime: info.ModTime()}
+			case info.Mode()&os.ModeSymlink != 0:
+				target := op.Target
+				if entry != nil && target == "" {
+					target = entry.Target
+				}
+				s.manifest.Entries[op.Path] = &Entry{Type: EntrySymlink, Mode: info.Mode(), ModTime: info.ModTime(), Target: target}
+			case entry != nil:
+				entry.Mode, entry.ModTime = info.Mode(), info.ModTime()
+			}
+		}
+	}
+
+	if len(plan.Removals) > 0 {
+		logging.Info("Removing files no longer in the source")
+	}
+	for _, op := range plan.Removals {
+		if entry := s.manifest.Entries[op.Path]; entry != nil && entry.Type == EntryFile {
+			if err := s.RemoveObject(op.Path); err != nil {
+				logging.Error("Failed to remove %s: %s", op.Path, err)
+				failed++
+				continue
+			}
+		}
+		delete(s.manifest.Entries, op.Path)
+	}
+
+	if err := s.SaveManifest(); err != nil {
+		return fmt.Errorf("failed to write manifest: %s", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d operations failed", failed)
+	}
+
+	return nil
+}
+
+// encryptFile encrypts the source file and records it in the manifest along with the digest of
+// the contents that were encrypted
+func (s *Store) encryptFile(srcDir, path string, hasher file.Hasher, limiter *throttle.Limiter) error {
+	srcPath := filepath.Join(srcDir, path)
+	logging.Debug("Encrypting %s", srcPath)
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	sum := hasher.New()
+	if err := s.WriteObject(path, io.TeeReader(f, sum), limiter.Writer); err != nil {
+		return err
+	}
+
+	s.manifest.Entries[path] = &Entry{
+		Type:    EntryFile,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Digest:  hex.EncodeToString(sum.Sum(nil)),
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package crypt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samphillips/backup/internal/file"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type CryptTestSuite struct {
+	srcDir  string
+	dstDir  string
+	keyFile string
+}
+
+var _ = Suite(&CryptTestSuite{})
+
+func (s *CryptTestSuite) SetUpTest(c *C) {
+	s.srcDir = c.MkDir() + "/"
+	s.dstDir = c.MkDir() + "/"
+	s.keyFile = filepath.Join(c.MkDir(), "key")
+
+	c.Assert(ioutil.WriteFile(s.keyFile, bytes.Repeat([]byte("k"), minKeyFileSize), 0600), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(s.srcDir, "docs"), os.ModePerm), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "docs", "a.txt"), []byte("secret a"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "b.txt"), []byte("secret b"), 0644), IsNil)
+	c.Assert(os.Symlink("b.txt", filepath.Join(s.srcDir, "link")), IsNil)
+}
+
+// backup backs up the source directory to the encrypted destination, returning the plan applied
+func (s *CryptTestSuite) backup(c *C, secret Secret, opts file.Options) *file.Plan {
+	store, err := Open(s.dstDir, secret)
+	if os.IsNotExist(err) {
+		store, err = Init(s.dstDir, secret)
+	}
+	c.Assert(err, IsNil)
+
+	srcIndex := file.ScanDirectory(s.srcDir)
+	plan, err := store.Manifest().Plan(s.srcDir, s.dstDir, srcIndex, opts, true, true)
+	c.Assert(err, IsNil)
+	c.Assert(store.Apply(plan, srcIndex, nil), IsNil)
+
+	return plan
+}
+
+func paths(ops []file.Operation) []string {
+	result := []string{}
+	for _, op := range ops {
+		result = append(result, op.Path)
+	}
+
+	return result
+}
+
+func (s *CryptTestSuite) TestStreamRoundTrip(c *C) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plain := bytes.Repeat([]byte{byte(size)}, size)
+
+		var sealed bytes.Buffer
+		w, err := newEncryptWriter(&sealed, key, "object")
+		c.Assert(err, IsNil)
+		_, err = w.Write(plain)
+		c.Assert(err, IsNil)
+		c.Assert(w.Close(), IsNil)
+
+		r, err := newDecryptReader(bytes.NewReader(sealed.Bytes()), key, "object")
+		c.Assert(err, IsNil)
+		opened, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil, Commentf("size %d", size))
+		c.Check(bytes.Equal(opened, plain), Equals, true, Commentf("size %d", size))
+	}
+}
+
+func (s *CryptTestSuite) TestStreamDetectsTampering(c *C) {
+	key := bytes.Repeat([]byte{1}, 32)
+	plain := bytes.Repeat([]byte("x"), 2*chunkSize)
+
+	var sealed bytes.Buffer
+	w, err := newEncryptWriter(&sealed, key, "object")
+	c.Assert(err, IsNil)
+	_, err = w.Write(plain)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	open := func(data []byte, id string) error {
+		r, err := newDecryptReader(bytes.NewReader(data), key, id)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	c.Check(open(sealed.Bytes(), "object"), IsNil)
+	c.Check(open(sealed.Bytes(), "other"), Equals, ErrCorrupt)
+
+	flipped := append([]byte{}, sealed.Bytes()...)
+	flipped[len(flipped)/2] ^= 1
+	c.Check(open(flipped, "object"), Equals, ErrCorrupt)
+
+	// Dropping the last chunk leaves a chunk that was not sealed as the last one
+	c.Check(open(sealed.Bytes()[:len(magic)+prefixSize+chunkSize+16], "object"), Equals, ErrCorrupt)
+	c.Check(open(sealed.Bytes()[:sealed.Len()-1], "object"), Equals, ErrCorrupt)
+}
+
+func (s *CryptTestSuite) TestWrongKeyIsRejected(c *C) {
+	_, err := Init(s.dstDir, Secret{Passphrase: "correct horse"})
+	c.Assert(err, IsNil)
+
+	_, err = Open(s.dstDir, Secret{Passphrase: "battery staple"})
+	c.Check(err, Equals, ErrWrongKey)
+
+	_, err = Open(s.dstDir, Secret{Passphrase: "correct horse"})
+	c.Check(err, IsNil)
+}
+
+func (s *CryptTestSuite) TestBackupHidesNamesAndContents(c *C) {
+	s.backup(c, Secret{KeyFile: s.keyFile}, file.Options{})
+
+	filepath.Walk(s.dstDir, func(path string, info os.FileInfo, err error) error {
+		c.Assert(err, IsNil)
+		c.Check(filepath.Base(path), Not(Matches), ".*(docs|a.txt|b.txt|link).*")
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			c.Assert(err, IsNil)
+			c.Check(bytes.Contains(data, []byte("secret")), Equals, false, Commentf(path))
+		}
+		return nil
+	})
+}
+
+func (s *CryptTestSuite) TestBackupOnlyEncryptsChangedFiles(c *C) {
+	secret := Secret{KeyFile: s.keyFile}
+
+	plan := s.backup(c, secret, file.Options{})
+	c.Check(paths(plan.Files), DeepEquals, []string{"b.txt", "docs/a.txt"})
+	c.Check(paths(plan.Symlinks), DeepEquals, []string{"link"})
+
+	plan = s.backup(c, secret, file.Options{})
+	c.Check(plan.Empty(), Equals, true)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "b.txt"), []byte("secret B"), 0644), IsNil)
+	c.Assert(os.Remove(filepath.Join(s.srcDir, "docs", "a.txt")), IsNil)
+
+	plan = s.backup(c, secret, file.Options{})
+	c.Check(plan.Files, DeepEquals, []file.Operation{{Path: "b.txt", Reason: file.ReasonHashDiffers}})
+	c.Check(plan.Removals, DeepEquals, []file.Operation{{Path: "docs/a.txt", Reason: file.ReasonNotInSource}})
+
+	store, err := Open(s.dstDir, secret)
+	c.Assert(err, IsNil)
+	_, ok := store.Manifest().Entries["docs/a.txt"]
+	c.Check(ok, Equals, false)
+	_, err = os.Stat(store.objectPath(store.keys.objectID("docs/a.txt")))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *CryptTestSuite) TestRestore(c *C) {
+	secret := Secret{Passphrase: "correct horse"}
+	s.backup(c, secret, file.Options{})
+
+	store, err := Open(s.dstDir, secret)
+	c.Assert(err, IsNil)
+
+	targetDir := c.MkDir() + "/"
+	plan, err := file.PlanRestore(store.RestoreSource(), targetDir, file.RestoreOptions{Metadata: file.Options{Archive: true}})
+	c.Assert(err, IsNil)
+	c.Assert(plan.Apply(), IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(targetDir, "docs", "a.txt"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "secret a")
+	target, err := os.Readlink(filepath.Join(targetDir, "link"))
+	c.Assert(err, IsNil)
+	c.Check(target, Equals, "b.txt")
+
+	// A file swapped with another's object fails to decrypt rather than restoring the wrong contents
+	a := store.objectPath(store.keys.objectID("docs/a.txt"))
+	b := store.objectPath(store.keys.objectID("b.txt"))
+	c.Assert(os.Rename(b, a), IsNil)
+	r, err := store.RestoreSource().Open("docs/a.txt")
+	c.Assert(err, IsNil)
+	_, err = io.Copy(ioutil.Discard, r)
+	c.Check(err, Equals, ErrCorrupt)
+}
@@ -0,0 +1,123 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFScrypt derives the key from a passphrase with scrypt
+	KDFScrypt = "scrypt"
+	// KDFKeyFile derives the key from the contents of a key file with HKDF-SHA256
+	KDFKeyFile = "keyfile"
+	// CipherXChaCha20Poly1305 names the authenticated cipher file contents are encrypted with
+	CipherXChaCha20Poly1305 = "xchacha20-poly1305"
+	// minKeyFileSize is the smallest key file accepted, so the key has at least 256 bits of entropy
+	// when the file is random
+	minKeyFileSize = 32
+	// saltSize is the size of the random salt the key is derived with
+	saltSize = 32
+)
+
+// ErrWrongKey is returned when the passphrase or key file does not match the destination
+var ErrWrongKey = errors.New("wrong passphrase or key file")
+
+// Secret is the passphrase or key file the key of an encrypted destination is derived from
+type Secret struct {
+	Passphrase string
+	KeyFile    string
+}
+
+// KDFParams records how the key of an encrypted destination is derived
+type KDFParams struct {
+	KDF  string `json:"kdf"`
+	Salt string `json:"salt"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+}
+
+// newKDFParams returns the parameters to derive a new key from the secret with
+func newKDFParams(secret Secret) (KDFParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return KDFParams{}, err
+	}
+
+	if secret.KeyFile != "" {
+		return KDFParams{KDF: KDFKeyFile, Salt: hex.EncodeToString(salt)}, nil
+	}
+
+	return KDFParams{KDF: KDFScrypt, Salt: hex.EncodeToString(salt), N: 1 << 15, R: 8, P: 1}, nil
+}
+
+// keys holds the keys derived from the secret
+type keys struct {
+	// data encrypts file contents and the manifest
+	data []byte
+	// names derives the names objects are stored under from the paths of files
+	names []byte
+}
+
+// deriveKeys derives the keys of an encrypted destination from the secret
+func deriveKeys(secret Secret, params KDFParams) (*keys, error) {
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %s", err)
+	}
+
+	var master []byte
+	switch params.KDF {
+	case KDFScrypt:
+		if secret.Passphrase == "" {
+			return nil, errors.New("the destination is encrypted with a passphrase, but none was given")
+		}
+		if master, err = scrypt.Key([]byte(secret.Passphrase), salt, params.N, params.R, params.P, 32); err != nil {
+			return nil, err
+		}
+	case KDFKeyFile:
+		if secret.KeyFile == "" {
+			return nil, errors.New("the destination is encrypted with a key file, but none was given")
+		}
+		contents, err := ioutil.ReadFile(secret.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) < minKeyFileSize {
+			return nil, fmt.Errorf("key file %s is shorter than %d bytes", secret.KeyFile, minKeyFileSize)
+		}
+		master = contents
+	default:
+		return nil, fmt.Errorf("unknown key derivation function %q", params.KDF)
+	}
+
+	k := &keys{data: make([]byte, chacha20poly1305.KeySize), names: make([]byte, 32)}
+	r := hkdf.New(sha256.New, master, salt, []byte("backup encryption keys"))
+	if _, err := io.ReadFull(r, k.data); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, k.names); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// objectID returns the name the contents of the file at the path are stored under, which reveals
+// nothing about the path without the key
+func (k *keys) objectID(path string) string {
+	mac := hmac.New(sha256.New, k.names)
+	mac.Write([]byte(path))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
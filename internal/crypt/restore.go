@@ -0,0 +1,89 @@
+package crypt
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/samphillips/backup/internal/file"
+)
+
+// storeSource restores the entries recorded in the manifest of an encrypted destination
+type storeSource struct {
+	store *Store
+}
+
+// RestoreSource returns a source that restores the entries of the encrypted destination
+func (s *Store) RestoreSource() file.RestoreSource {
+	return storeSource{store: s}
+}
+
+func (s storeSource) Index() (map[string]os.FileInfo, error) {
+	return s.store.manifest.Index(), nil
+}
+
+// Open decrypts the contents of the file, failing at the end if they do not match the digest
+// recorded when the file was backed up
+func (s storeSource) Open(path string) (io.ReadCloser, error) {
+	entry, ok := s.store.manifest.Entries[path]
+	if !ok || entry.Type != EntryFile {
+		return nil, fmt.Errorf("%s is not a file in the backup", path)
+	}
+
+	rc, err := s.store.OpenObject(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher, err := file.NewHasher(s.store.manifest.Hash)
+	if err != nil || entry.Digest == "" {
+		return rc, nil
+	}
+
+	return &verifyReader{ReadCloser: rc, path: path, digest: entry.Digest, sum: hasher.New()}, nil
+}
+
+func (s storeSource) Readlink(path string) (string, error) {
+	entry, ok := s.store.manifest.Entries[path]
+	if !ok || entry.Type != EntrySymlink {
+		return "", fmt.Errorf("%s is not a symlink in the backup", path)
+	}
+
+	return entry.Target, nil
+}
+
+// RestoreMetadata restores the permissions and modification time recorded in the manifest in
+// archive mode. The manifest does not record ownership or extended attributes.
+func (s storeSource) RestoreMetadata(path, dstPath string, opts file.Options) error {
+	entry, ok := s.store.manifest.Entries[path]
+	if !ok || !opts.Archive || entry.Type == EntrySymlink {
+		return nil
+	}
+
+	if err := os.Chmod(dstPath, entry.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dstPath, entry.ModTime, entry.ModTime)
+}
+
+// verifyReader hashes the contents as they are read and checks the digest once they have all
+// been read
+type verifyReader struct {
+	io.ReadCloser
+	path   string
+	digest string
+	sum    hash.Hash
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.sum.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.sum.Sum(nil)) != v.digest {
+		return n, fmt.Errorf("%s does not match the digest recorded when it was backed up", v.path)
+	}
+
+	return n, err
+}
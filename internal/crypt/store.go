@@ -0,0 +1,359 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// configFile records how an encrypted destination is encrypted
+	configFile = "encryption.json"
+	// manifestFile holds the encrypted manifest of every backed up entry
+	manifestFile = "manifest.enc"
+	// dataDir holds the encrypted contents of every backed up file
+	dataDir = "data"
+	// manifestID is the object name the manifest is encrypted as
+	manifestID = "manifest"
+	// keyCheckID is the object name of the value that checks a key is correct
+	keyCheckID = "key check"
+	// version is the encrypted destination format written by this version of backup
+	version = 1
+)
+
+// Config describes how an encrypted destination is encrypted
+type Config struct {
+	Version  int       `json:"version"`
+	Cipher   string    `json:"cipher"`
+	Key      KDFParams `json:"key"`
+	KeyCheck []byte    `json:"keyCheck"`
+}
+
+// Store is a destination whose file contents, names and metadata are encrypted. The contents of
+// each file are stored as an object named by a keyed hash of its path, and the paths, metadata and
+// source digests of every entry are kept in an encrypted manifest so changes can be detected
+// without decrypting the backed up files.
+type Store struct {
+	dir      string
+	keys     *keys
+	manifest *Manifest
+}
+
+// Exists reports whether the directory holds an encrypted destination
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, configFile))
+	return err == nil
+}
+
+// Init creates a new encrypted destination in the directory, which must not already hold one
+func Init(dir string, secret Secret) (*Store, error) {
+	if Exists(dir) {
+		return nil, fmt.Errorf("%s is already an encrypted destination", dir)
+	}
+
+	params, err := newKDFParams(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := deriveKeys(secret, params)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := encrypt(k.data, keyCheckID, []byte(keyCheckID))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, dataDir), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(Config{Version: version, Cipher: CipherXChaCha20Poly1305, Key: params, KeyCheck: check}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, configFile), append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	return &Store{dir: dir, keys: k, manifest: NewManifest()}, nil
+}
+
+// Open opens the encrypted destination in the directory, checking the secret is correct, and
+// decrypts its manifest
+func Open(dir string, secret Secret) (*Store, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, configFile))
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", configFile, err)
+	}
+	if config.Version != version || config.Cipher != CipherXChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported encrypted destination version %d using %s", config.Version, config.Cipher)
+	}
+
+	k, err := deriveKeys(secret, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if check, err := decrypt(k.data, keyCheckID, config.KeyCheck); err != nil || string(check) != keyCheckID {
+		return nil, ErrWrongKey
+	}
+
+	s := &Store{dir: dir, keys: k, manifest: NewManifest()}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := decrypt(k.data, manifestID, data)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %s", err)
+	}
+	if err := json.Unmarshal(plain, s.manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+
+	return s, nil
+}
+
+// Manifest returns the manifest of every backed up entry
+func (s *Store) Manifest() *Manifest {
+	return s.manifest
+}
+
+// SaveManifest encrypts and writes the manifest
+func (s *Store) SaveManifest() error {
+	plain, err := json.Marshal(s.manifest)
+	if err != nil {
+		return err
+	}
+
+	data, err := encrypt(s.keys.data, manifestID, plain)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(s.dir, manifestFile), data)
+}
+
+// objectPath returns the path an object is stored at, spread across subdirectories by the start
+// of its name
+func (s *Store) objectPath(id string) string {
+	return filepath.Join(s.dir, dataDir, id[:2], id)
+}
+
+// WriteObject encrypts the contents read from the reader as the contents of the file at the path,
+// and writes it to the writer wrapping the object file, if given, which may throttle it
+func (s *Store) WriteObject(path string, r io.Reader, wrap func(io.Writer) io.Writer) error {
+	id := s.keys.objectID(path)
+	objectPath := s.objectPath(id)
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(objectPath), "."+id+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = tmpFile
+	if wrap != nil {
+		w = wrap(w)
+	}
+
+	err = func() error {
+		ew, err := newEncryptWriter(w, s.keys.data, id)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ew, r); err != nil {
+			return err
+		}
+		if err := ew.Close(); err != nil {
+			return err
+		}
+		return tmpFile.Sync()
+	}()
+	if err == nil {
+		err = tmpFile.Close()
+	} else {
+		tmpFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), objectPath)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// OpenObject returns a reader of the decrypted contents of the file at the path
+func (s *Store) OpenObject(path string) (io.ReadCloser, error) {
+	id := s.keys.objectID(path)
+
+	f, err := os.Open(s.objectPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newDecryptReader(f, s.keys.data, id)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// RemoveObject removes the stored contents of the file at the path
+func (s *Store) RemoveObject(path string) error {
+	err := os.Remove(s.objectPath(s.keys.objectID(path)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// encrypt seals a small value as the named object
+func encrypt(key []byte, id string, plain []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := newEncryptWriter(&buf, key, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decrypt opens a small value sealed as the named object
+func decrypt(key []byte, id string, data []byte) ([]byte, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, ErrWrongKey
+	}
+
+	r, err := newDecryptReader(bytes.NewReader(data), key, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// writeFileAtomic writes the data to a temporary file alongside the path, syncs it and renames it
+// over the path
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Entry is a backed up entry recorded in the manifest
+type Entry struct {
+	Type    string      `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	Digest  string      `json:"digest,omitempty"`
+}
+
+// Types of manifest entries
+const (
+	EntryFile    = "file"
+	EntryDir     = "dir"
+	EntrySymlink = "symlink"
+)
+
+// Manifest records every backed up entry by path, and the algorithm the digests of the source
+// files were calculated with
+type Manifest struct {
+	Hash    string            `json:"hash"`
+	Entries map[string]*Entry `json:"entries"`
+}
+
+// NewManifest returns an empty manifest
+func NewManifest() *Manifest {
+	return &Manifest{Entries: map[string]*Entry{}}
+}
+
+// Index returns file info for every entry in the form returned by ScanDirectory
+func (m *Manifest) Index() map[string]os.FileInfo {
+	index := map[string]os.FileInfo{}
+	for path, entry := range m.Entries {
+		index[path] = entryInfo{name: filepath.Base(path), entry: entry}
+	}
+
+	return index
+}
+
+// entryInfo presents a manifest entry as file info
+type entryInfo struct {
+	name  string
+	entry *Entry
+}
+
+func (e entryInfo) Name() string       { return e.name }
+func (e entryInfo) Size() int64        { return e.entry.Size }
+func (e entryInfo) Mode() os.FileMode  { return e.entry.Mode }
+func (e entryInfo) ModTime() time.Time { return e.entry.ModTime }
+func (e entryInfo) IsDir() bool        { return e.entry.Type == EntryDir }
+func (e entryInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,188 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// magic starts every encrypted object
+	magic = "BKUPENC1"
+	// chunkSize is the amount of plaintext sealed at a time, so large files can be encrypted and
+	// decrypted as a stream
+	chunkSize = 64 << 10
+	// prefixSize is the size of the random part of each chunk's nonce, the rest is the chunk number
+	prefixSize = chacha20poly1305.NonceSizeX - 8
+)
+
+// ErrCorrupt is returned when an encrypted object has been modified, truncated or swapped with
+// another object
+var ErrCorrupt = errors.New("encrypted data is corrupt or has been tampered with")
+
+// Objects are split into chunks that are each sealed with XChaCha20-Poly1305. Each chunk's nonce
+// is a random prefix chosen for the object followed by the chunk number, and its additional data
+// is the name of the object and whether it is the last chunk, so chunks cannot be reordered,
+// dropped or moved between objects without being detected.
+
+// additionalData returns the additional data authenticated with a chunk
+func additionalData(id string, last bool) []byte {
+	ad := []byte(id)
+	if last {
+		return append(ad, 1)
+	}
+
+	return append(ad, 0)
+}
+
+// chunkNonce returns the nonce of the numbered chunk
+func chunkNonce(prefix []byte, n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[prefixSize:], n)
+
+	return nonce
+}
+
+// encryptWriter encrypts everything written to it as the named object
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	id     string
+	prefix []byte
+	n      uint64
+	buf    []byte
+}
+
+// newEncryptWriter returns a writer that encrypts the contents of the named object to the writer.
+// Close must be called to seal the last chunk.
+func newEncryptWriter(w io.Writer, key []byte, id string) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append([]byte(magic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, id: id, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, as the last chunk is sealed differently
+		if len(e.buf) == chunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.n), e.buf, additionalData(e.id, last))
+	e.n++
+	e.buf = e.buf[:0]
+
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts the named object as it is read
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	id     string
+	prefix []byte
+	n      uint64
+	sealed []byte
+	plain  []byte
+	done   bool
+}
+
+// newDecryptReader returns a reader of the decrypted contents of the named object. Reads fail with
+// ErrCorrupt if the object does not authenticate.
+func newDecryptReader(r io.Reader, key []byte, id string) (io.Reader, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(magic)+prefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrCorrupt
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReaderSize(r, chunkSize+aead.Overhead()+1),
+		aead:   aead,
+		id:     id,
+		prefix: header[len(magic):],
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+
+	return n, nil
+}
+
+// open reads and decrypts the next chunk
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one if nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0], chunkNonce(d.prefix, d.n), d.sealed[:n], additionalData(d.id, d.done))
+	if err != nil {
+		return ErrCorrupt
+	}
+	d.n++
+	d.plain = plain
+
+	return nil
+}
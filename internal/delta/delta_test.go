@@ -0,0 +1,122 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DeltaTestSuite struct{}
+
+var _ = Suite(&DeltaTestSuite{})
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func patch(c *C, basis, src []byte) Stats {
+	sig, err := NewSignature(bytes.NewReader(basis), BlockSize(int64(len(basis))))
+	c.Assert(err, IsNil)
+
+	var dst bytes.Buffer
+	stats, err := Patch(&dst, bytes.NewReader(src), bytes.NewReader(basis), sig)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(dst.Bytes(), src), Equals, true)
+	c.Check(stats.Size(), Equals, int64(len(src)))
+
+	return stats
+}
+
+func (*DeltaTestSuite) TestBlockSizeGrowsWithFileSize(c *C) {
+	c.Check(BlockSize(0), Equals, MinBlockSize)
+	c.Check(BlockSize(1<<30), Equals, 32768)
+	c.Check(BlockSize(1<<50), Equals, MaxBlockSize)
+}
+
+func (*DeltaTestSuite) TestRollingSumMatchesNewSum(c *C) {
+	data := randomData(1, 100)
+	sum := newRollingSum(data[:16])
+
+	for i := 0; i+16 < len(data); i++ {
+		sum.roll(data[i], data[i+16])
+		c.Assert(sum.sum(), Equals, newRollingSum(data[i+1:i+17]).sum())
+	}
+}
+
+func (*DeltaTestSuite) TestPatchReusesUnchangedFile(c *C) {
+	basis := randomData(1, 5<<20)
+
+	stats := patch(c, basis, basis)
+	c.Check(stats.Literal, Equals, int64(0))
+}
+
+func (*DeltaTestSuite) TestPatchSendsOnlyChangedBlocks(c *C) {
+	basis := randomData(1, 5<<20)
+	src := append([]byte{}, basis...)
+	copy(src[1<<20:], randomData(2, 100))
+
+	stats := patch(c, basis, src)
+	c.Check(stats.Literal <= int64(BlockSize(int64(len(basis)))), Equals, true)
+}
+
+func (*DeltaTestSuite) TestPatchFindsShiftedBlocks(c *C) {
+	basis := randomData(1, 3<<20)
+	src := append(append(append([]byte{}, basis[:1<<20]...), randomData(2, 1000)...), basis[1<<20:]...)
+
+	stats := patch(c, basis, src)
+	c.Check(stats.Literal < 1000+int64(2*BlockSize(int64(len(basis)))), Equals, true)
+}
+
+func (*DeltaTestSuite) TestPatchSendsUnrelatedData(c *C) {
+	stats := patch(c, randomData(1, 1<<20), randomData(2, 3<<20+17))
+	c.Check(stats.Literal, Equals, int64(3<<20+17))
+
+	stats = patch(c, []byte{}, randomData(2, 100))
+	c.Check(stats.Literal, Equals, int64(100))
+
+	stats = patch(c, randomData(1, 100), []byte{})
+	c.Check(stats.Literal, Equals, int64(0))
+}
+
+func (*DeltaTestSuite) TestPatchMatchesShortLastBlock(c *C) {
+	basis := randomData(1, 3*MinBlockSize+100)
+	src := append(randomData(2, 10), basis...)
+
+	stats := patch(c, basis, src)
+	c.Check(stats.Literal, Equals, int64(10))
+}
+
+// blockCopier is a destination that copies blocks of the basis itself and counts them
+type blockCopier struct {
+	bytes.Buffer
+	basis  []byte
+	copied int64
+}
+
+func (b *blockCopier) CopyBlock(offset, length int64) (int64, error) {
+	b.copied += length
+	n, err := b.Write(b.basis[offset : offset+length])
+	return int64(n), err
+}
+
+func (*DeltaTestSuite) TestPatchLetsDestinationCopyBlocks(c *C) {
+	basis := randomData(1, 5<<20)
+	src := append([]byte{}, basis...)
+	copy(src[1<<20:], randomData(2, 100))
+
+	sig, err := NewSignature(bytes.NewReader(basis), BlockSize(int64(len(basis))))
+	c.Assert(err, IsNil)
+
+	dst := &blockCopier{basis: basis}
+	stats, err := Patch(dst, bytes.NewReader(src), bytes.NewReader(basis), sig)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(dst.Bytes(), src), Equals, true)
+	c.Check(dst.copied, Equals, stats.Matched)
+	c.Check(stats.Matched >= int64(len(src))-int64(BlockSize(int64(len(basis)))), Equals, true)
+}
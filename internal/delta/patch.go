@@ -0,0 +1,185 @@
+package delta
+
+import (
+	"io"
+)
+
+// maxLiteral is the most unmatched data held before it is written out
+const maxLiteral = 1 << 20
+
+// Stats records how much of a new file was written from new data and how much was reused from the
+// basis file
+type Stats struct {
+	// Literal is the number of bytes that were not found in the basis file and had to be sent
+	Literal int64
+	// Matched is the number of bytes copied from blocks of the basis file
+	Matched int64
+}
+
+// Size returns the logical size of the new file
+func (s Stats) Size() int64 {
+	return s.Literal + s.Matched
+}
+
+// BlockCopier is implemented by destinations that copy blocks of the basis file themselves, such as
+// files that can have the file system copy or share the blocks without them being read and written
+type BlockCopier interface {
+	// CopyBlock appends length bytes of the basis file at offset to the destination
+	CopyBlock(offset, length int64) (int64, error)
+}
+
+// Patch writes the new file read from src to dst, copying any block also found in the basis file
+// from the basis rather than from src. Blocks are found at any offset in src, so data inserted or
+// removed earlier in the file does not stop later blocks from matching. Blocks are copied by dst if
+// it is a BlockCopier.
+func Patch(dst io.Writer, src io.Reader, basis io.ReaderAt, sig *Signature) (Stats, error) {
+	p := patcher{
+		dst:       dst,
+		src:       src,
+		basis:     basis,
+		sig:       sig,
+		blockSize: sig.blockSize,
+		buf:       make([]byte, 0, 2*maxLiteral+2*sig.blockSize),
+	}
+
+	err := p.run()
+
+	return p.stats, err
+}
+
+// patcher holds the state of a patch. The data in buf from litStart to pos has not matched any
+// block and is waiting to be written, and the window being matched starts at pos.
+type patcher struct {
+	dst       io.Writer
+	src       io.Reader
+	basis     io.ReaderAt
+	sig       *Signature
+	blockSize int
+
+	buf      []byte
+	pos      int
+	litStart int
+	eof      bool
+	stats    Stats
+}
+
+func (p *patcher) run() error {
+	rolling := false
+	var sum rollingSum
+
+	for {
+		if err := p.fill(); err != nil {
+			return err
+		}
+
+		remaining := len(p.buf) - p.pos
+		if remaining == 0 {
+			return p.flushLiteral()
+		}
+
+		if remaining < p.blockSize {
+			// Only the last block of the basis can be shorter than the block size
+			rolling = false
+			sum = newRollingSum(p.buf[p.pos:])
+			if b, ok := p.sig.match(sum.sum(), p.buf[p.pos:]); ok {
+				return p.copyBlock(b)
+			}
+
+			p.pos = len(p.buf)
+			return p.flushLiteral()
+		}
+
+		window := p.buf[p.pos : p.pos+p.blockSize]
+		if !rolling {
+			sum = newRollingSum(window)
+			rolling = true
+		}
+
+		if b, ok := p.sig.match(sum.sum(), window); ok {
+			if err := p.copyBlock(b); err != nil {
+				return err
+			}
+			rolling = false
+			continue
+		}
+
+		if p.pos+p.blockSize == len(p.buf) {
+			// There is no next byte to roll in, so the window ends at the end of the file
+			p.pos++
+			rolling = false
+			continue
+		}
+
+		sum.roll(p.buf[p.pos], p.buf[p.pos+p.blockSize])
+		p.pos++
+	}
+}
+
+// fill reads from src until a whole window is buffered after pos or src is exhausted. Buffered
+// literal data is written out first when the buffer has no room left.
+func (p *patcher) fill() error {
+	for !p.eof && len(p.buf)-p.pos <= p.blockSize {
+		if len(p.buf) == cap(p.buf) {
+			if err := p.flushLiteral(); err != nil {
+				return err
+			}
+			p.buf = p.buf[:copy(p.buf, p.buf[p.pos:])]
+			p.pos, p.litStart = 0, 0
+		}
+
+		n, err := p.src.Read(p.buf[len(p.buf):cap(p.buf)])
+		p.buf = p.buf[:len(p.buf)+n]
+
+		if err == io.EOF {
+			p.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if p.pos-p.litStart >= maxLiteral {
+		return p.flushLiteral()
+	}
+
+	return nil
+}
+
+// flushLiteral writes the unmatched data before pos
+func (p *patcher) flushLiteral() error {
+	if p.pos == p.litStart {
+		return nil
+	}
+
+	n, err := p.dst.Write(p.buf[p.litStart:p.pos])
+	p.stats.Literal += int64(n)
+	p.litStart = p.pos
+
+	return err
+}
+
+// copyBlock writes the unmatched data before pos followed by the matching block from the basis,
+// and moves pos past the block
+func (p *patcher) copyBlock(b block) error {
+	if err := p.flushLiteral(); err != nil {
+		return err
+	}
+
+	offset := b.index * int64(p.blockSize)
+
+	var n int64
+	var err error
+	if copier, ok := p.dst.(BlockCopier); ok {
+		n, err = copier.CopyBlock(offset, int64(b.length))
+	} else {
+		n, err = io.Copy(p.dst, io.NewSectionReader(p.basis, offset, int64(b.length)))
+	}
+	p.stats.Matched += n
+	if err != nil {
+		return err
+	}
+
+	p.pos += b.length
+	p.litStart = p.pos
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package delta
+
+import (
+	"io"
+	"math"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// MinBlockSize is the smallest block size chosen for a file
+	MinBlockSize = 2 << 10
+	// MaxBlockSize is the largest block size chosen for a file
+	MaxBlockSize = 128 << 10
+)
+
+// block is the weak and strong checksums of a block of the basis file
+type block struct {
+	index  int64
+	length int
+	strong [blake2b.Size256]byte
+}
+
+// Signature holds the checksums of each block of a basis file, so blocks of a new version of the
+// file that are already in the basis can be found without comparing the files byte by byte
+type Signature struct {
+	blockSize int
+	blocks    map[uint32][]block
+}
+
+// BlockSize returns the block size used for a basis file of the given size. Like rsync, it grows
+// with the square root of the size so large files are not split into too many blocks.
+func BlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 7) &^ 7
+
+	if blockSize < MinBlockSize {
+		return MinBlockSize
+	}
+	if blockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+
+	return blockSize
+}
+
+// NewSignature reads the basis file and calculates the checksums of each block of it
+func NewSignature(basis io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{blockSize: blockSize, blocks: map[uint32][]block{}}
+	buf := make([]byte, blockSize)
+
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(basis, buf)
+		if n > 0 {
+			weak := newRollingSum(buf[:n]).sum()
+			sig.blocks[weak] = append(sig.blocks[weak], block{index: index, length: n, strong: blake2b.Sum256(buf[:n])})
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// BlockSize returns the size of the blocks the basis file was split into
+func (s *Signature) BlockSize() int {
+	return s.blockSize
+}
+
+// match returns the basis block with the same contents as the data, if there is one. The strong
+// checksum is only calculated when the weak checksum matches.
+func (s *Signature) match(weak uint32, data []byte) (block, bool) {
+	candidates, ok := s.blocks[weak]
+	if !ok {
+		return block{}, false
+	}
+
+	strong := blake2b.Sum256(data)
+	for _, b := range candidates {
+		if b.length == len(data) && b.strong == strong {
+			return b, true
+		}
+	}
+
+	return block{}, false
+}
+
+// rollingSum is the rsync weak checksum of a window of data, which can be moved along by a byte at
+// a time without summing the whole window again
+type rollingSum struct {
+	a, b   uint32
+	length uint32
+}
+
+// newRollingSum calculates the weak checksum of the data
+func newRollingSum(data []byte) rollingSum {
+	r := rollingSum{length: uint32(len(data))}
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+
+	return r
+}
+
+// roll moves the window along by a byte, removing the byte leaving the window and adding the byte
+// entering it
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.length*uint32(out)
+}
+
+// sum returns the checksum of the window
+func (r rollingSum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
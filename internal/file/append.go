@@ -0,0 +1,115 @@
+package file
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+// appendedTo reports whether the source file has grown since it was backed up, by comparing the
+// hashsum of the backed up file with the hashsum of the same number of bytes from the start of the
+// source file. Only files in a source directory are appended.
+func appendedTo(srcDir, dstDir, path string, srcFile, dstFile os.FileInfo, hasher Hasher, opts Options) bool {
+	if opts.Source != nil || !dstFile.Mode().IsRegular() || dstFile.Size() == 0 || srcFile.Size() <= dstFile.Size() {
+		return false
+	}
+
+	dstSum, ok := "", false
+	if opts.DigestXattrs {
+		dstSum, ok = readDigest(filepath.Join(dstDir, path), dstFile.ModTime(), hasher)
+	}
+
+	if !ok {
+		var err error
+		if dstSum, err = cachedHash(opts.Cache, sideDestination, dstDir, path, dstFile, hasher); err != nil {
+			logging.Warn("Could not calculate %s hashsum of file: %s", hasher.Name(), path)
+			return false
+		}
+	}
+
+	srcSum, err := hashFilePrefix(filepath.Join(srcDir, path), dstFile.Size(), hasher)
+	if err != nil {
+		logging.Warn("Could not calculate %s hashsum of file: %s", hasher.Name(), path)
+		return false
+	}
+
+	return srcSum == dstSum
+}
+
+// hashFilePrefix generates the hash string of the first n bytes of a file using the hasher
+func hashFilePrefix(filePath string, n int64, hasher Hasher) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	sum := hasher.New()
+
+	if _, err := io.CopyN(sum, file, n); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// appendFile copies the part of the source file beyond the end of the destination file onto the
+// end of the destination file, returning the number of bytes appended. The destination file is
+// written in place, so an interrupted append leaves it holding a shorter start of the source file.
+// The whole contents of the destination file are written to the hash, if any.
+func appendFile(srcPath, dstPath string, limiter *throttle.Limiter, sum hash.Hash) (int64, error) {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dstPath, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	appended, err := appendData(dstFile, srcFile, limiter, sum)
+	if err != nil {
+		dstFile.Close()
+		return appended, err
+	}
+
+	if err := dstFile.Sync(); err != nil {
+		dstFile.Close()
+		return appended, err
+	}
+
+	return appended, dstFile.Close()
+}
+
+// appendData copies the source file from the current size of the destination file onwards to the
+// end of the destination file
+func appendData(dstFile, srcFile *os.File, limiter *throttle.Limiter, sum hash.Hash) (int64, error) {
+	info, err := dstFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset := info.Size()
+
+	if sum != nil {
+		if _, err := io.Copy(sum, io.NewSectionReader(dstFile, 0, offset)); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := srcFile.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return io.Copy(teeHash(limiter.Writer(dstFile), sum), srcFile)
+}
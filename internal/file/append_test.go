@@ -0,0 +1,72 @@
+package file
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type AppendTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&AppendTestSuite{})
+
+func (a *AppendTestSuite) SetUpTest(c *C) {
+	a.srcDir = c.MkDir() + "/"
+	a.dstDir = c.MkDir() + "/"
+}
+
+func (a *AppendTestSuite) TestGenerateBackupDetailsDetectsAppendedFiles(c *C) {
+	c.Assert(createFile(filepath.Join(a.srcDir, "grown"), []byte("line 1\nline 2\n")), IsNil)
+	c.Assert(createFile(filepath.Join(a.dstDir, "grown"), []byte("line 1\n")), IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "rewritten"), []byte("line 3\nline 4\n")), IsNil)
+	c.Assert(createFile(filepath.Join(a.dstDir, "rewritten"), []byte("line 1\n")), IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "shrunk"), []byte("line 1\n")), IsNil)
+	c.Assert(createFile(filepath.Join(a.dstDir, "shrunk"), []byte("line 1\nline 2\n")), IsNil)
+
+	srcIndex := ScanDirectory(a.srcDir)
+	dstIndex := ScanDirectory(a.dstDir)
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, a.srcDir, a.dstDir, Options{Append: true})
+	c.Check(plan.Files, DeepEquals, []Operation{
+		{Path: "grown", Reason: ReasonAppended},
+		{Path: "rewritten", Reason: ReasonSizeDiffers},
+		{Path: "shrunk", Reason: ReasonSizeDiffers},
+	})
+
+	plan = GenerateBackupDetails(srcIndex, dstIndex, a.srcDir, a.dstDir, Options{})
+	c.Check(plan.Files[0], Equals, Operation{Path: "grown", Reason: ReasonSizeDiffers})
+}
+
+func (a *AppendTestSuite) TestApplyAppendsOnlyTheEnd(c *C) {
+	srcFile := filepath.Join(a.srcDir, "log")
+	dstFile := filepath.Join(a.dstDir, "log")
+
+	c.Assert(createFile(srcFile, []byte("line 1\nline 2\n")), IsNil)
+	c.Assert(createFile(dstFile, []byte("line 1\n")), IsNil)
+
+	before, err := os.Stat(dstFile)
+	c.Assert(err, IsNil)
+
+	sum := hashers[DefaultHash].New()
+	appended, err := appendFile(srcFile, dstFile, nil, sum)
+	c.Assert(err, IsNil)
+	c.Check(appended, Equals, int64(7))
+
+	data, err := ioutil.ReadFile(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "line 1\nline 2\n")
+
+	after, err := os.Stat(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(os.SameFile(before, after), Equals, true)
+
+	expected, err := hashFile(srcFile, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+	c.Check(hex.EncodeToString(sum.Sum(nil)), Equals, expected)
+}
@@ -0,0 +1,415 @@
+package file
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cheggaaa/pb"
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/progress"
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+// ApplyOptions controls how a plan is applied to the backup location
+type ApplyOptions struct {
+	// Jobs is the number of operations performed concurrently, at least one
+	Jobs int
+	// Limiter throttles the total rate files are written at across every job, if set
+	Limiter *throttle.Limiter
+	// Manifest records every entry of the backup location in its manifest once the plan is applied
+	Manifest bool
+}
+
+// Apply performs every operation in the plan against the backup location. Failed operations are
+// logged and the remaining operations are still attempted.
+func (p *Plan) Apply(opts ApplyOptions) error {
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+
+	failed := 0
+
+	logging.Info("Creating new directories")
+	bar := progress.Start(len(p.Directories) + 1)
+	// Parent directories are created before their children by creating one level at a time
+	for _, level := range byDepth(p.Directories, false) {
+		failed += runParallel(level, opts.Jobs, bar, p.createDirectory)
+	}
+	bar.Increment()
+	bar.Finish()
+
+	var digests *digestRecorder
+	if opts.Manifest {
+		digests = newDigestRecorder()
+	}
+
+	logging.Info("Copying files")
+	stats := &transferStats{}
+	bar = progress.Start(len(p.Files) + 1)
+	failed += runParallel(p.Files, opts.Jobs, bar, func(op Operation) int {
+		return p.backupFile(op, opts.Limiter, stats, digests)
+	})
+	bar.Increment()
+	bar.Finish()
+
+	if len(p.Files) > 0 {
+		logging.Info("Transferred %d of %d bytes", stats.sent, stats.size)
+	}
+
+	if len(p.Reuse) > 0 {
+		logging.Info("Linking unchanged files from %s", p.BaseDir)
+		bar = progress.Start(len(p.Reuse) + 1)
+		failed += runParallel(p.Reuse, opts.Jobs, bar, func(op Operation) int {
+			return p.reuseFile(op, opts.Limiter, stats, digests)
+		})
+		bar.Increment()
+		bar.Finish()
+	}
+
+	if len(p.Links) > 0 {
+		logging.Info("Creating hard links")
+		bar = progress.Start(len(p.Links) + 1)
+		failed += runParallel(p.Links, opts.Jobs, bar, p.createLink)
+		bar.Increment()
+		bar.Finish()
+	}
+
+	if len(p.Symlinks) > 0 {
+		logging.Info("Copying symlinks")
+		bar = progress.Start(len(p.Symlinks) + 1)
+		failed += runParallel(p.Symlinks, opts.Jobs, bar, p.createSymlink)
+		bar.Increment()
+		bar.Finish()
+	}
+
+	if len(p.Removals) > 0 {
+		logging.Info("Removing excess files in backup directory")
+		bar = progress.Start(len(p.Removals) + 1)
+		failed += runParallel(p.Removals, opts.Jobs, bar, p.remove)
+		bar.Increment()
+		bar.Finish()
+	}
+
+	if p.Options.preservesMetadata() {
+		failed += p.applyMetadata(opts.Jobs)
+	}
+
+	if opts.Manifest {
+		logging.Info("Writing manifest")
+		if err := p.saveManifest(digests); err != nil {
+			logging.Error("Failed to write manifest %s: %s", ManifestPath(p.DstDir), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d operations failed", failed)
+	}
+
+	return nil
+}
+
+// runParallel performs the operations using up to the given number of concurrent jobs,
+// incrementing the progress bar as each one starts, and returns the number that failed
+func runParallel(ops []Operation, jobs int, bar *pb.ProgressBar, fn func(op Operation) int) int {
+	queue := make(chan Operation)
+	failures := make(chan int, jobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failed := 0
+			for op := range queue {
+				bar.Increment()
+				failed += fn(op)
+			}
+			failures <- failed
+		}()
+	}
+
+	for _, op := range ops {
+		queue <- op
+	}
+	close(queue)
+	wg.Wait()
+	close(failures)
+
+	failed := 0
+	for f := range failures {
+		failed += f
+	}
+
+	return failed
+}
+
+// byDepth groups the operations by the depth of their path, ordered shallowest first or deepest
+// first when reversed
+func byDepth(ops []Operation, deepestFirst bool) [][]Operation {
+	levels := map[int][]Operation{}
+	depths := []int{}
+
+	for _, op := range ops {
+		depth := strings.Count(filepath.Clean(op.Path), "/")
+		if _, ok := levels[depth]; !ok {
+			depths = append(depths, depth)
+		}
+		levels[depth] = append(levels[depth], op)
+	}
+
+	sort.Ints(depths)
+	if deepestFirst {
+		sort.Sort(sort.Reverse(sort.IntSlice(depths)))
+	}
+
+	grouped := make([][]Operation, 0, len(depths))
+	for _, depth := range depths {
+		grouped = append(grouped, levels[depth])
+	}
+
+	return grouped
+}
+
+// createDirectory creates a directory in the backup location, returning the number of failures
+func (p *Plan) createDirectory(op Operation) int {
+	logging.Debug("Create directory %s", filepath.Join(p.DstDir, op.Path))
+	if err := os.MkdirAll(filepath.Join(p.DstDir, op.Path), os.ModePerm); err != nil {
+		logging.Error("Failed to create directory %s: %s", filepath.Join(p.DstDir, op.Path), err)
+		return 1
+	}
+
+	return 0
+}
+
+// transferStats counts the bytes sent to the backup location and the logical size of the files
+// copied, across every job
+type transferStats struct {
+	sent int64
+	size int64
+}
+
+// add records a copied file
+func (t *transferStats) add(sent, size int64) {
+	atomic.AddInt64(&t.sent, sent)
+	atomic.AddInt64(&t.size, size)
+}
+
+// backupFile copies a file to the backup location, recording the digest of its contents with the
+// digest recorder, if any, and returning the number of failures
+func (p *Plan) backupFile(op Operation, limiter *throttle.Limiter, stats *transferStats, digests *digestRecorder) int {
+	srcPath := filepath.Join(p.SrcDir, op.Path)
+	dstPath := filepath.Join(p.DstDir, op.Path)
+
+	// The source modification time is taken before copying, so a digest recorded for a file that
+	// changes during the copy is never trusted
+	srcFile, err := statSource(p.SrcDir, op.Path, p.Options)
+	if err != nil {
+		logging.Error("Failed to stat file %s: %s", srcPath, err)
+		return 1
+	}
+
+	var sum hash.Hash
+	if p.Options.DigestXattrs || digests != nil {
+		sum = p.Options.hasher().New()
+	}
+
+	if op.Reason == ReasonAppended {
+		logging.Debug("Appending the end of %s to backup location %s", srcPath, dstPath)
+		appended, err := appendFile(srcPath, dstPath, limiter, sum)
+		if err != nil {
+			logging.Error("Failed to append to file %s: %s", dstPath, err)
+			return 1
+		}
+		stats.add(appended, srcFile.Size())
+	} else if p.Options.Delta && p.Options.Source == nil && op.Reason != ReasonMissing && useDelta(dstPath) {
+		logging.Debug("Transferring changes to %s to backup location %s", srcPath, dstPath)
+		transfer, err := deltaCopyFile(srcPath, dstPath, limiter, sum)
+		if err != nil {
+			logging.Error("Failed to copy file %s: %s", srcPath, err)
+			return 1
+		}
+		logging.Debug("Sent %d of %d bytes of %s", transfer.Literal, transfer.Size(), srcPath)
+		stats.add(transfer.Literal, transfer.Size())
+	} else if p.Options.Compression != "" && worthCompressing(p.SrcDir, op.Path, p.Options) {
+		logging.Debug("Compressing %s to backup location %s", srcPath, dstPath)
+		written, err := compressFile(p.SrcDir, op.Path, srcFile.Size(), dstPath, p.Options, limiter, sum)
+		if err != nil {
+			logging.Error("Failed to compress file %s: %s", srcPath, err)
+			return 1
+		}
+		stats.add(written, srcFile.Size())
+	} else if p.Options.Source != nil {
+		logging.Debug("Copying %s to backup location %s", srcPath, dstPath)
+		if err := copySourceFile(p.Options.Source, op.Path, dstPath, limiter, sum); err != nil {
+			logging.Error("Failed to copy file %s: %s", srcPath, err)
+			return 1
+		}
+		stats.add(srcFile.Size(), srcFile.Size())
+	} else {
+		logging.Debug("Copying %s to backup location %s", srcPath, dstPath)
+		if err := copyFile(srcPath, dstPath, limiter, sum); err != nil {
+			logging.Error("Failed to copy file %s: %s", srcPath, err)
+			return 1
+		}
+		stats.add(srcFile.Size(), srcFile.Size())
+	}
+
+	if sum != nil {
+		digests.record(op.Path, p.Options.hasher().Name(), hex.EncodeToString(sum.Sum(nil)))
+	}
+
+	if p.Options.DigestXattrs {
+		if err := writeDigest(dstPath, p.Options.hasher().Name(), hex.EncodeToString(sum.Sum(nil)), srcFile.ModTime()); err != nil {
+			logging.Error("Failed to record digest of %s: %s", dstPath, err)
+			return 1
+		}
+	}
+
+	if p.Options.preservesMetadata() {
+		return p.copyMetadata(op)
+	}
+
+	return 0
+}
+
+// reuseFile hard links an unchanged file from the base directory into the backup location, copying
+// it from the source instead if it cannot be linked, and returns the number of failures
+func (p *Plan) reuseFile(op Operation, limiter *throttle.Limiter, stats *transferStats, digests *digestRecorder) int {
+	basePath := filepath.Join(p.BaseDir, op.Path)
+	dstPath := filepath.Join(p.DstDir, op.Path)
+
+	logging.Debug("Linking %s to %s", dstPath, basePath)
+	err := os.Link(basePath, dstPath)
+	if err == nil {
+		return 0
+	}
+
+	// The base may be on another filesystem or its file may have reached the maximum number of links
+	logging.Warn("Failed to link %s, copying it instead: %s", basePath, err)
+	return p.backupFile(Operation{Path: op.Path, Reason: ReasonMissing}, limiter, stats, digests)
+}
+
+// createLink creates a hard link in the backup location, returning the number of failures
+func (p *Plan) createLink(op Operation) int {
+	logging.Debug("Linking %s to %s", filepath.Join(p.DstDir, op.Path), filepath.Join(p.DstDir, op.Target))
+	if _, err := os.Lstat(filepath.Join(p.DstDir, op.Path)); err == nil {
+		if err := os.Remove(filepath.Join(p.DstDir, op.Path)); err != nil {
+			logging.Error("Failed to unlink: %+v", err)
+		}
+	}
+
+	err := os.Link(filepath.Join(p.DstDir, op.Target), filepath.Join(p.DstDir, op.Path))
+	if err != nil {
+		logging.Error("Failed to create hard link %s: %s", filepath.Join(p.DstDir, op.Path), err)
+		return 1
+	}
+
+	return 0
+}
+
+// createSymlink creates a symlink in the backup location, returning the number of failures
+func (p *Plan) createSymlink(op Operation) int {
+	logging.Debug("Creating symlink to %s at %s", op.Target, filepath.Join(p.DstDir, op.Path))
+	if _, err := os.Lstat(filepath.Join(p.DstDir, op.Path)); err == nil {
+		if err := os.Remove(filepath.Join(p.DstDir, op.Path)); err != nil {
+			logging.Error("Failed to unlink: %+v", err)
+		}
+	}
+
+	err := os.Symlink(op.Target, filepath.Join(p.DstDir, op.Path))
+	if err != nil {
+		logging.Error("Failed to create symlink %s: %s", filepath.Join(p.DstDir, op.Path), err)
+		return 1
+	}
+
+	if p.Options.preservesMetadata() {
+		return p.copyMetadata(op)
+	}
+
+	return 0
+}
+
+// remove removes a path from the backup location, returning the number of failures
+func (p *Plan) remove(op Operation) int {
+	logging.Debug("Removing file %s", filepath.Join(p.DstDir, op.Path))
+	err := os.RemoveAll(filepath.Join(p.DstDir, op.Path))
+	if err != nil {
+		logging.Error("Failed to remove file %s: %s", filepath.Join(p.DstDir, op.Path), err)
+		return 1
+	}
+
+	return 0
+}
+
+// applyMetadata copies the metadata of unchanged entries, then restores the metadata of every
+// directory touched by the plan. Directories are updated deepest first, after their contents have
+// been written, so that writing their contents cannot change their timestamps again.
+func (p *Plan) applyMetadata(jobs int) int {
+	failed := 0
+	directories := map[string]bool{}
+
+	for _, op := range p.Directories {
+		directories[op.Path] = true
+	}
+	for _, ops := range [][]Operation{p.Directories, p.Files, p.Reuse, p.Links, p.Symlinks, p.Metadata, p.Removals} {
+		for _, op := range ops {
+			for parent := filepath.Dir(op.Path); parent != "." && parent != "/"; parent = filepath.Dir(parent) {
+				directories[parent] = true
+			}
+		}
+	}
+
+	entries := []Operation{}
+	for _, op := range p.Metadata {
+		if info, err := statSource(p.SrcDir, op.Path, p.Options); err == nil && info.IsDir() {
+			directories[op.Path] = true
+			continue
+		}
+		entries = append(entries, op)
+	}
+
+	dirs := []Operation{}
+	for path := range directories {
+		if _, err := statSource(p.SrcDir, path, p.Options); os.IsNotExist(err) {
+			continue
+		}
+		dirs = append(dirs, Operation{Path: path})
+	}
+
+	logging.Info("Copying metadata")
+	bar := progress.Start(len(entries) + len(dirs) + 1)
+	failed += runParallel(entries, jobs, bar, p.copyMetadata)
+	for _, level := range byDepth(dirs, true) {
+		failed += runParallel(level, jobs, bar, p.copyMetadata)
+	}
+	bar.Increment()
+	bar.Finish()
+
+	return failed
+}
+
+// copyMetadata copies the metadata of the source entry to the backup location, returning the
+// number of failures
+func (p *Plan) copyMetadata(op Operation) int {
+	logging.Debug("Copying metadata of %s to %s", filepath.Join(p.SrcDir, op.Path), filepath.Join(p.DstDir, op.Path))
+	var err error
+	if p.Options.Source != nil {
+		err = copySourceMetadata(p.Options.Source, op.Path, filepath.Join(p.DstDir, op.Path), p.Options)
+	} else {
+		err = CopyMetadata(filepath.Join(p.SrcDir, op.Path), filepath.Join(p.DstDir, op.Path), p.Options)
+	}
+	if err != nil {
+		logging.Error("Failed to copy metadata of %s: %s", filepath.Join(p.SrcDir, op.Path), err)
+		return 1
+	}
+
+	return 0
+}
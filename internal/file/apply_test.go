@@ -0,0 +1,78 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ApplyTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&ApplyTestSuite{})
+
+func (a *ApplyTestSuite) SetUpTest(c *C) {
+	a.srcDir = c.MkDir() + "/"
+	a.dstDir = c.MkDir() + "/"
+}
+
+func (a *ApplyTestSuite) TestApplyWithJobsCreatesNestedDirectoriesAndFiles(c *C) {
+	dir := a.srcDir
+	for depth := 0; depth < 5; depth++ {
+		dir = filepath.Join(dir, fmt.Sprintf("dir%d", depth))
+		c.Assert(os.Mkdir(dir, 0755), IsNil)
+		for i := 0; i < 10; i++ {
+			c.Assert(createFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), []byte(dir)), IsNil)
+		}
+	}
+
+	srcIndex := ScanDirectory(a.srcDir)
+	plan := GenerateBackupDetails(srcIndex, ScanDirectory(a.dstDir), a.srcDir, a.dstDir, Options{})
+	c.Check(plan.Directories, HasLen, 5)
+	c.Check(plan.Files, HasLen, 50)
+
+	err := plan.Apply(ApplyOptions{Jobs: 8})
+	c.Assert(err, IsNil)
+
+	dstIndex := ScanDirectory(a.dstDir)
+	c.Check(dstIndex, HasLen, len(srcIndex))
+	for path, info := range srcIndex {
+		if info.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(a.dstDir, path))
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, filepath.Dir(filepath.Join(a.srcDir, path)))
+	}
+}
+
+func (a *ApplyTestSuite) TestApplyReturnsErrorWhenOperationsFail(c *C) {
+	plan := &Plan{
+		SrcDir: a.srcDir,
+		DstDir: a.dstDir,
+		Files:  []Operation{{Path: "missing1", Reason: ReasonMissing}, {Path: "missing2", Reason: ReasonMissing}},
+	}
+
+	err := plan.Apply(ApplyOptions{Jobs: 2})
+	c.Check(err, ErrorMatches, "2 operations failed")
+}
+
+func (*ApplyTestSuite) TestByDepthGroupsOperationsByLevel(c *C) {
+	ops := []Operation{{Path: "a/b/c"}, {Path: "a"}, {Path: "d/e"}, {Path: "f"}}
+
+	c.Check(byDepth(ops, false), DeepEquals, [][]Operation{
+		{{Path: "a"}, {Path: "f"}},
+		{{Path: "d/e"}},
+		{{Path: "a/b/c"}},
+	})
+	c.Check(byDepth(ops, true), DeepEquals, [][]Operation{
+		{{Path: "a/b/c"}},
+		{{Path: "d/e"}},
+		{{Path: "a"}, {Path: "f"}},
+	})
+}
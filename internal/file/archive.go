@@ -0,0 +1,364 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/progress"
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+const (
+	// ArchiveTar is an uncompressed tar archive
+	ArchiveTar = "tar"
+	// ArchiveTarGzip is a gzip compressed tar archive
+	ArchiveTarGzip = "tar.gz"
+	// ArchiveTarZstd is a zstd compressed tar archive
+	ArchiveTarZstd = "tar.zst"
+	// ArchiveZip is a zip archive, which cannot hold hard links or extended attributes
+	ArchiveZip = "zip"
+
+	// ArchiveStdout is the archive path that writes a tar stream to standard output
+	ArchiveStdout = "-"
+
+	// paxXattrPrefix starts the PAX records holding extended attributes, as written by GNU tar and
+	// bsdtar
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// archiveExts maps the extensions of archive paths to their formats
+var archiveExts = []struct {
+	ext    string
+	format string
+}{
+	{".tar", ArchiveTar},
+	{".tar.gz", ArchiveTarGzip},
+	{".tgz", ArchiveTarGzip},
+	{".tar.zst", ArchiveTarZstd},
+	{".tzst", ArchiveTarZstd},
+	{".zip", ArchiveZip},
+}
+
+// ArchiveFormat returns the format of the archive at the path, chosen by its extension, and false
+// if the path is not an archive
+func ArchiveFormat(path string) (string, bool) {
+	if path == ArchiveStdout {
+		return ArchiveTar, true
+	}
+
+	lower := strings.ToLower(path)
+	for _, a := range archiveExts {
+		if strings.HasSuffix(lower, a.ext) {
+			return a.format, true
+		}
+	}
+
+	return "", false
+}
+
+// ArchiveOptions controls which entries are written to an archive and how
+type ArchiveOptions struct {
+	// Metadata selects the extended attributes and ACLs recorded in tar archives
+	Metadata Options
+	// IncludeSymlinks writes symlinks to the archive, which are otherwise left out
+	IncludeSymlinks bool
+	// Limiter throttles writing the archive, if set
+	Limiter *throttle.Limiter
+}
+
+// ArchiveStats counts what was written to an archive
+type ArchiveStats struct {
+	Entries int
+	Bytes   int64
+	Failed  int
+}
+
+// archiveWriter writes entries in one archive format
+type archiveWriter interface {
+	// add writes an entry, reading the contents of regular files from the file. Hard links name
+	// the path they are linked to, which has already been written, and have no file.
+	add(path string, info os.FileInfo, f *os.File, target, hardLink string, xattrs map[string][]byte) (int64, error)
+	// Close finishes the archive, without closing the writer it was written to
+	Close() error
+}
+
+// WriteArchive writes every entry in the source index to an archive at the path, in the format
+// given by its extension, or as a tar stream to standard output. The archive is streamed as the
+// source is read, to a temporary file alongside the path that is renamed over it once complete.
+// Entries that cannot be read are logged and left out, and counted as failed.
+func WriteArchive(srcIndex map[string]os.FileInfo, srcDir, archivePath string, opts ArchiveOptions) (ArchiveStats, error) {
+	srcDir = withTrailingSlash(srcDir)
+
+	format, ok := ArchiveFormat(archivePath)
+	if !ok {
+		return ArchiveStats{}, fmt.Errorf("%s is not a tar or zip archive", archivePath)
+	}
+
+	if archivePath == ArchiveStdout {
+		return writeArchive(os.Stdout, format, srcIndex, srcDir, opts)
+	}
+
+	tmpFile, err := createTempFile(archivePath)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+
+	var stats ArchiveStats
+	err = writeTempFile(tmpFile, func(tmpFile *os.File) error {
+		stats, err = writeArchive(tmpFile, format, srcIndex, srcDir, opts)
+		return err
+	})
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), archivePath)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// writeArchive writes the entries of the source index to the writer in the format
+func writeArchive(out io.Writer, format string, srcIndex map[string]os.FileInfo, srcDir string, opts ArchiveOptions) (ArchiveStats, error) {
+	stats := ArchiveStats{}
+	w := opts.Limiter.Writer(out)
+
+	var compressor io.WriteCloser
+	switch format {
+	case ArchiveTarGzip:
+		compressor = gzip.NewWriter(w)
+	case ArchiveTarZstd:
+		z, err := zstd.NewWriter(w)
+		if err != nil {
+			return stats, err
+		}
+		compressor = z
+	}
+	if compressor != nil {
+		w = compressor
+	}
+
+	var aw archiveWriter
+	if format == ArchiveZip {
+		aw = &zipArchive{w: zip.NewWriter(w)}
+		if opts.Metadata.Xattrs || opts.Metadata.ACLs {
+			logging.Warn("Zip archives cannot hold extended attributes or ACLs, they will not be preserved")
+		}
+	} else {
+		aw = &tarArchive{w: tar.NewWriter(w)}
+	}
+
+	paths := make([]string, 0, len(srcIndex))
+	for path, info := range srcIndex {
+		if info.Mode()&os.ModeSymlink != 0 && !opts.IncludeSymlinks {
+			continue
+		}
+		paths = append(paths, path)
+	}
+
+	// Parents sort before their children, so directories are created before their contents when
+	// the archive is extracted
+	sort.Strings(paths)
+
+	links := linkGroups(srcIndex)
+
+	bar := progress.Start(len(paths) + 1)
+	for _, path := range paths {
+		bar.Increment()
+		info := srcIndex[path]
+		srcPath := filepath.Join(srcDir, path)
+
+		var target, hardLink string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(srcPath)
+			if err != nil {
+				logging.Error("Failed to read symlink %s: %s", srcPath, err)
+				stats.Failed++
+				continue
+			}
+			target = link
+		}
+		// Zip archives cannot hold hard links, so each path is written as a separate file
+		if group, ok := links[path]; ok && group[0] != path && format != ArchiveZip {
+			hardLink = group[0]
+		}
+
+		var xattrs map[string][]byte
+		if format != ArchiveZip && (opts.Metadata.Xattrs || opts.Metadata.ACLs) {
+			var err error
+			if xattrs, err = readXattrs(srcPath, opts.Metadata); err != nil {
+				logging.Warn("Failed to read extended attributes of %s: %s", srcPath, err)
+			}
+		}
+
+		var f *os.File
+		if info.Mode().IsRegular() && hardLink == "" {
+			var err error
+			if f, err = os.Open(srcPath); err != nil {
+				logging.Error("Failed to open file %s: %s", srcPath, err)
+				stats.Failed++
+				continue
+			}
+		}
+
+		logging.Debug("Adding %s to archive", path)
+		n, err := aw.add(path, info, f, target, hardLink, xattrs)
+		if f != nil {
+			f.Close()
+		}
+		stats.Bytes += n
+		if err == errFileShrank {
+			logging.Error("File %s shrank while it was archived, it was padded with zeros", srcPath)
+			stats.Failed++
+			err = nil
+		}
+		if err != nil {
+			bar.Finish()
+			return stats, fmt.Errorf("failed to add %s to archive: %s", path, err)
+		}
+		stats.Entries++
+	}
+	bar.Increment()
+	bar.Finish()
+
+	if err := aw.Close(); err != nil {
+		return stats, err
+	}
+	if compressor != nil {
+		return stats, compressor.Close()
+	}
+
+	return stats, nil
+}
+
+// errFileShrank is returned when a file is shorter than the size written in its entry header
+var errFileShrank = errors.New("file shrank while it was archived")
+
+// tarArchive writes PAX format tar archives
+type tarArchive struct {
+	w *tar.Writer
+}
+
+func (t *tarArchive) add(path string, info os.FileInfo, f *os.File, target, hardLink string, xattrs map[string][]byte) (int64, error) {
+	header, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return 0, err
+	}
+
+	// PAX headers hold long and non-ASCII names, large sizes and sub-second modification times.
+	// Access and change times are left out so archives of unchanged trees are identical.
+	header.Format = tar.FormatPAX
+	header.Name = filepath.ToSlash(path)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+
+	if hardLink != "" {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = filepath.ToSlash(hardLink)
+		header.Size = 0
+	}
+
+	if len(xattrs) > 0 {
+		header.PAXRecords = map[string]string{}
+		for name, value := range xattrs {
+			header.PAXRecords[paxXattrPrefix+name] = string(value)
+		}
+	}
+
+	if err := t.w.WriteHeader(header); err != nil {
+		return 0, err
+	}
+
+	if f == nil {
+		return 0, nil
+	}
+
+	return copyEntry(t.w, f, header.Size)
+}
+
+func (t *tarArchive) Close() error {
+	return t.w.Close()
+}
+
+// zipArchive writes zip archives. Hard linked files are written once for each path, and symlinks
+// are stored as entries holding their target, as written by Info-ZIP.
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (z *zipArchive) add(path string, info os.FileInfo, f *os.File, target, hardLink string, xattrs map[string][]byte) (int64, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return 0, err
+	}
+
+	header.Name = filepath.ToSlash(path)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if f != nil {
+		header.Method = zip.Deflate
+	}
+
+	w, err := z.w.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+
+	if target != "" {
+		_, err := io.WriteString(w, target)
+		return 0, err
+	}
+
+	if f == nil {
+		return 0, nil
+	}
+
+	return copyEntry(w, f, info.Size())
+}
+
+func (z *zipArchive) Close() error {
+	return z.w.Close()
+}
+
+// copyEntry copies the size recorded in the entry header from the file. A file that has shrunk
+// since it was scanned is padded with zeros so the rest of the archive stays readable, and
+// errFileShrank is returned.
+func copyEntry(w io.Writer, f *os.File, size int64) (int64, error) {
+	n, err := io.CopyN(w, f, size)
+	if err == io.EOF {
+		padded, err := io.CopyN(w, zeroReader{}, size-n)
+		if err != nil {
+			return n + padded, err
+		}
+		return n + padded, errFileShrank
+	}
+
+	return n, err
+}
+
+// zeroReader reads an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,405 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/samphillips/backup/internal/logging"
+)
+
+// ArchiveStdin is the source path that reads a tar stream from standard input
+const ArchiveStdin = "-"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ArchiveFS is an archive opened as a source file system. Close releases the archive and any
+// temporary copy of it.
+type ArchiveFS interface {
+	ReadLinkFS
+	Close() error
+}
+
+// OpenArchive opens the tar or zip archive at the path, or the tar stream on standard input, as a
+// file system that can be backed up like a source directory. Compressed tar archives are detected
+// by their contents, and are decompressed to an unnamed temporary file so their entries can be
+// read in any order, as is a tar stream on standard input.
+func OpenArchive(archivePath string) (ArchiveFS, error) {
+	if archivePath == ArchiveStdin {
+		return openTar(os.Stdin, false)
+	}
+
+	format, ok := ArchiveFormat(archivePath)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a tar or zip archive", archivePath)
+	}
+
+	if format == ArchiveZip {
+		r, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		return zipFS{r}, nil
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, err := openTar(f, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// openTar indexes the tar archive read from the file. Seekable archives that are not compressed
+// are read in place, anything else is first copied to an unnamed temporary file.
+func openTar(f *os.File, seekable bool) (ArchiveFS, error) {
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(len(zstdMagic))
+
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r, seekable = gz, false
+	case bytes.HasPrefix(head, zstdMagic):
+		z, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r, seekable = z, false
+	}
+
+	if seekable {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return indexTar(f)
+	}
+
+	tmpFile, err := os.CreateTemp("", "backup-source-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	// The copy is removed as soon as it is created, so it is never left behind
+	os.Remove(tmpFile.Name())
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		return nil, fmt.Errorf("failed to read archive: %s", err)
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		tmpFile.Close()
+		return nil, err
+	}
+
+	fsys, err := indexTar(tmpFile)
+	if err != nil {
+		tmpFile.Close()
+		return nil, err
+	}
+	if f != os.Stdin {
+		f.Close()
+	}
+
+	return fsys, nil
+}
+
+// tarFS is a file system of the entries of an uncompressed tar archive, whose contents are read
+// directly from the archive file
+type tarFS struct {
+	f       *os.File
+	entries map[string]*tarEntry
+}
+
+// tarEntry is an entry in a tar archive and where its contents start in the archive file
+type tarEntry struct {
+	header   *tar.Header
+	offset   int64
+	children []string
+}
+
+func (e *tarEntry) info() fs.FileInfo {
+	return e.header.FileInfo()
+}
+
+// indexTar reads the headers of every entry of the tar archive in the file. Later entries replace
+// earlier ones with the same name as they do when the archive is extracted, hard links share the
+// contents of the file they link to and missing parent directories are added. Device files, FIFOs
+// and entries outside the root of the archive are left out.
+func indexTar(f *os.File) (*tarFS, error) {
+	t := &tarFS{f: f, entries: map[string]*tarEntry{}}
+	hardLinks := []string{}
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %s", err)
+		}
+
+		name, ok := cleanArchiveName(header.Name)
+		if !ok {
+			if name != "." {
+				logging.Warn("Skipping archive entry %s outside the archive root", header.Name)
+			}
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		case tar.TypeLink:
+			hardLinks = append(hardLinks, name)
+		case tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeGNUSparse:
+			return nil, fmt.Errorf("archive entry %s is a sparse file, which cannot be read", header.Name)
+		default:
+			logging.Warn("Skipping archive entry %s as it is not a file, directory or link", header.Name)
+			continue
+		}
+		if header.PAXRecords["GNU.sparse.major"] != "" || header.PAXRecords["GNU.sparse.name"] != "" {
+			return nil, fmt.Errorf("archive entry %s is a sparse file, which cannot be read", header.Name)
+		}
+
+		// Headers are read whole and contents are skipped by seeking, so the file is positioned at
+		// the start of the contents of the entry
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		header.Name = name
+		t.entries[name] = &tarEntry{header: header, offset: offset}
+	}
+
+	for _, name := range hardLinks {
+		entry := t.entries[name]
+		if entry.header.Typeflag != tar.TypeLink {
+			continue
+		}
+		target, ok := cleanArchiveName(entry.header.Linkname)
+		linked := t.entries[target]
+		if !ok || linked == nil || linked.header.Typeflag != tar.TypeReg {
+			logging.Warn("Skipping archive entry %s as the file it links to is not in the archive", name)
+			delete(t.entries, name)
+			continue
+		}
+
+		header := *entry.header
+		header.Typeflag = tar.TypeReg
+		header.Linkname = ""
+		header.Size = linked.header.Size
+		t.entries[name] = &tarEntry{header: &header, offset: linked.offset}
+	}
+
+	t.addParents()
+
+	return t, nil
+}
+
+// addParents adds every directory that holds entries but has no entry of its own, with the latest
+// modification time of its entries, and records the entries of each directory
+func (t *tarFS) addParents() {
+	names := make([]string, 0, len(t.entries))
+	for name := range t.entries {
+		names = append(names, name)
+	}
+
+	t.entries["."] = &tarEntry{header: &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0755}}
+	added := []string{}
+
+	for _, name := range names {
+		for child, dir := name, path.Dir(name); ; child, dir = dir, path.Dir(dir) {
+			parent, exists := t.entries[dir]
+			if !exists || parent.header.Typeflag != tar.TypeDir {
+				if exists {
+					logging.Warn("Replacing archive entry %s with a directory as it holds other entries", dir)
+				}
+				parent = &tarEntry{header: &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}}
+				t.entries[dir] = parent
+				added = append(added, dir)
+			}
+			parent.children = append(parent.children, child)
+
+			// Entries in the archive are recorded in their own parent when they are reached in turn
+			if exists {
+				break
+			}
+		}
+	}
+
+	// Deeper directories are dated first so their times carry up to the directories holding them
+	sort.Slice(added, func(i, j int) bool {
+		return strings.Count(added[i], "/") > strings.Count(added[j], "/")
+	})
+	for _, dir := range added {
+		parent := t.entries[dir]
+		for _, child := range parent.children {
+			if modTime := t.entries[child].header.ModTime; modTime.After(parent.header.ModTime) {
+				parent.header.ModTime = modTime
+			}
+		}
+	}
+}
+
+// cleanArchiveName returns the path of an entry relative to the root of the archive, and false if
+// it is the root itself or outside it
+func cleanArchiveName(name string) (string, bool) {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return name, false
+	}
+
+	return name, true
+}
+
+func (t *tarFS) entry(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	entry, ok := t.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return entry, nil
+}
+
+// Open opens a file or directory in the archive. Symlinks are not followed, use ReadLink.
+func (t *tarFS) Open(name string) (fs.File, error) {
+	entry, err := t.entry("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch entry.header.Typeflag {
+	case tar.TypeDir:
+		return &tarDir{info: entry.info()}, nil
+	case tar.TypeReg:
+		return &tarFile{info: entry.info(), SectionReader: io.NewSectionReader(t.f, entry.offset, entry.header.Size)}, nil
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("symlinks cannot be opened")}
+}
+
+// Stat returns the details of an entry without following symlinks
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := t.entry("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.info(), nil
+}
+
+// ReadDir returns the entries of a directory sorted by name
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := t.entry("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	dirEntries := make([]fs.DirEntry, 0, len(entry.children))
+	for _, child := range entry.children {
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(t.entries[child].info()))
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+
+	return dirEntries, nil
+}
+
+// ReadLink returns the target of a symlink
+func (t *tarFS) ReadLink(name string) (string, error) {
+	entry, err := t.entry("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if entry.header.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return entry.header.Linkname, nil
+}
+
+// Close closes the archive file
+func (t *tarFS) Close() error {
+	return t.f.Close()
+}
+
+// tarFile is an open file in a tar archive
+type tarFile struct {
+	info fs.FileInfo
+	*io.SectionReader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+// tarDir is an open directory in a tar archive, whose entries are read with tarFS.ReadDir
+type tarDir struct {
+	info fs.FileInfo
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *tarDir) Close() error               { return nil }
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// zipFS is a file system of the entries of a zip archive. Symlinks are entries holding their
+// target, as written by Info-ZIP.
+type zipFS struct {
+	*zip.ReadCloser
+}
+
+// ReadLink returns the target of a symlink
+func (z zipFS) ReadLink(name string) (string, error) {
+	info, err := fs.Stat(z, name)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := fs.ReadFile(z, name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
@@ -0,0 +1,160 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing/fstest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ArchiveSourceTestSuite struct {
+	srcDir     string
+	dstDir     string
+	archiveDir string
+}
+
+var _ = Suite(&ArchiveSourceTestSuite{})
+
+func (a *ArchiveSourceTestSuite) SetUpTest(c *C) {
+	a.srcDir = c.MkDir() + "/"
+	a.dstDir = c.MkDir() + "/"
+	a.archiveDir = c.MkDir()
+
+	c.Assert(os.Mkdir(filepath.Join(a.srcDir, "docs"), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "docs", "a.txt"), []byte("a")), IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "b.txt"), []byte("bb")), IsNil)
+	c.Assert(os.Chmod(filepath.Join(a.srcDir, "b.txt"), 0640), IsNil)
+	c.Assert(os.Link(filepath.Join(a.srcDir, "docs", "a.txt"), filepath.Join(a.srcDir, "hard")), IsNil)
+	c.Assert(os.Symlink("docs/a.txt", filepath.Join(a.srcDir, "link")), IsNil)
+}
+
+// writeSource archives the source directory to an archive with the extension and opens it
+func (a *ArchiveSourceTestSuite) writeSource(c *C, ext string) ArchiveFS {
+	archivePath := filepath.Join(a.archiveDir, "source"+ext)
+	_, err := WriteArchive(ScanDirectory(a.srcDir), a.srcDir, archivePath, ArchiveOptions{IncludeSymlinks: true})
+	c.Assert(err, IsNil)
+
+	fsys, err := OpenArchive(archivePath)
+	c.Assert(err, IsNil)
+
+	return fsys
+}
+
+// plan plans the backup of the file system to the destination directory
+func (a *ArchiveSourceTestSuite) plan(c *C, fsys ReadLinkFS) *Plan {
+	srcIndex, err := ScanFS(fsys)
+	c.Assert(err, IsNil)
+
+	return GenerateBackupDetails(srcIndex, ScanDirectory(a.dstDir), a.srcDir, a.dstDir, Options{Archive: true, Source: fsys})
+}
+
+func (a *ArchiveSourceTestSuite) TestBackUpArchive(c *C) {
+	for _, ext := range []string{".tar", ".tar.gz", ".tar.zst", ".zip"} {
+		a.dstDir = c.MkDir() + "/"
+
+		fsys := a.writeSource(c, ext)
+		plan := a.plan(c, fsys)
+		c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+
+		for path, contents := range map[string]string{"docs/a.txt": "a", "b.txt": "bb", "hard": "a"} {
+			data, err := ioutil.ReadFile(filepath.Join(a.dstDir, path))
+			c.Assert(err, IsNil, Commentf(ext))
+			c.Check(string(data), Equals, contents, Commentf(ext))
+		}
+		target, err := os.Readlink(filepath.Join(a.dstDir, "link"))
+		c.Assert(err, IsNil, Commentf(ext))
+		c.Check(target, Equals, "docs/a.txt", Commentf(ext))
+
+		info, err := os.Stat(filepath.Join(a.dstDir, "b.txt"))
+		c.Assert(err, IsNil)
+		c.Check(info.Mode().Perm(), Equals, os.FileMode(0640), Commentf(ext))
+
+		// Nothing has changed when the same archive is backed up again
+		c.Check(a.plan(c, fsys).Empty(), Equals, true, Commentf(ext))
+		c.Assert(fsys.Close(), IsNil)
+	}
+}
+
+func (a *ArchiveSourceTestSuite) TestDetectsChangesInArchive(c *C) {
+	fsys := a.writeSource(c, ".tar.gz")
+	c.Assert(a.plan(c, fsys).Apply(ApplyOptions{}), IsNil)
+	c.Assert(fsys.Close(), IsNil)
+
+	// The same size and modification time, but different contents
+	info, err := os.Stat(filepath.Join(a.srcDir, "b.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "b.txt"), []byte("cc")), IsNil)
+	c.Assert(os.Chtimes(filepath.Join(a.srcDir, "b.txt"), info.ModTime(), info.ModTime()), IsNil)
+	c.Assert(os.Chmod(filepath.Join(a.srcDir, "docs", "a.txt"), 0600), IsNil)
+
+	fsys = a.writeSource(c, ".tar.gz")
+	defer fsys.Close()
+	plan := a.plan(c, fsys)
+
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "b.txt", Reason: ReasonHashDiffers}})
+	c.Check(plan.Metadata, HasLen, 2)
+}
+
+func (a *ArchiveSourceTestSuite) TestTarAddsParentsAndResolvesHardLinks(c *C) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "./deep/dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, ModTime: modTime}), IsNil)
+	_, err := w.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "./deep/dir/file", Mode: 0644, ModTime: modTime}), IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}), IsNil)
+	c.Assert(w.WriteHeader(&tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	archivePath := filepath.Join(a.archiveDir, "handmade.tar")
+	c.Assert(ioutil.WriteFile(archivePath, buf.Bytes(), 0644), IsNil)
+
+	fsys, err := OpenArchive(archivePath)
+	c.Assert(err, IsNil)
+	defer fsys.Close()
+
+	index, err := ScanFS(fsys)
+	c.Assert(err, IsNil)
+	c.Check(index, HasLen, 4)
+	c.Check(index["deep"].IsDir(), Equals, true)
+	c.Check(index["deep/dir"].ModTime().Equal(modTime), Equals, true)
+	c.Check(index["hard"].Size(), Equals, int64(4))
+
+	data, err := fsys.Open("hard")
+	c.Assert(err, IsNil)
+	contents, err := ioutil.ReadAll(data)
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, "data")
+}
+
+func (a *ArchiveSourceTestSuite) TestBackUpFS(c *C) {
+	modTime := time.Now().Add(-time.Hour)
+	fsys := fstest.MapFS{
+		"dir":      {Mode: os.ModeDir | 0755, ModTime: modTime},
+		"dir/file": {Data: []byte("contents"), Mode: 0644, ModTime: modTime},
+	}
+
+	srcIndex, err := ScanFS(fsys)
+	c.Assert(err, IsNil)
+	c.Assert(GenerateBackupDetails(srcIndex, ScanDirectory(a.dstDir), a.srcDir, a.dstDir, Options{QuickCheck: true, Source: fsys}).Apply(ApplyOptions{}), IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(a.dstDir, "dir", "file"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "contents")
+
+	c.Check(GenerateBackupDetails(srcIndex, ScanDirectory(a.dstDir), a.srcDir, a.dstDir, Options{QuickCheck: true, Source: fsys}).Empty(), Equals, true)
+
+	fsys["dir/file"].Data = []byte("CONTENTS")
+	fsys["dir/file"].ModTime = time.Now()
+	srcIndex, err = ScanFS(fsys)
+	c.Assert(err, IsNil)
+	plan := GenerateBackupDetails(srcIndex, ScanDirectory(a.dstDir), a.srcDir, a.dstDir, Options{QuickCheck: true, Source: fsys})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "dir/file", Reason: ReasonMtimeDiffers}})
+}
@@ -0,0 +1,159 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	. "gopkg.in/check.v1"
+)
+
+type ArchiveTestSuite struct {
+	srcDir  string
+	dstDir  string
+	xattrs  bool
+	longDir string
+}
+
+var _ = Suite(&ArchiveTestSuite{})
+
+func (a *ArchiveTestSuite) SetUpTest(c *C) {
+	a.srcDir = c.MkDir() + "/"
+	a.dstDir = c.MkDir() + "/"
+	a.longDir = strings.Repeat("d", 120)
+
+	c.Assert(os.MkdirAll(filepath.Join(a.srcDir, "docs", a.longDir), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "docs", "a.txt"), []byte("a")), IsNil)
+	c.Assert(createFile(filepath.Join(a.srcDir, "docs", a.longDir, "b.txt"), []byte("bb")), IsNil)
+	c.Assert(os.Link(filepath.Join(a.srcDir, "docs", "a.txt"), filepath.Join(a.srcDir, "hard")), IsNil)
+	c.Assert(os.Symlink("docs/a.txt", filepath.Join(a.srcDir, "link")), IsNil)
+
+	a.xattrs = setXattr(filepath.Join(a.srcDir, "docs", "a.txt"), "user.colour", []byte("blue")) == nil
+}
+
+// readTar returns the headers and contents of the entries in the tar stream
+func readTar(c *C, r io.Reader) (map[string]*tar.Header, map[string]string) {
+	headers, contents := map[string]*tar.Header{}, map[string]string{}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		headers[header.Name] = header
+		contents[header.Name] = string(data)
+	}
+
+	return headers, contents
+}
+
+func (a *ArchiveTestSuite) TestWriteTarPreservesMetadata(c *C) {
+	archivePath := filepath.Join(a.dstDir, "backup.tar")
+	stats, err := WriteArchive(ScanDirectory(a.srcDir), a.srcDir, archivePath, ArchiveOptions{Metadata: Options{Xattrs: true}, IncludeSymlinks: true})
+	c.Assert(err, IsNil)
+	c.Check(stats, Equals, ArchiveStats{Entries: 6, Bytes: 3})
+
+	f, err := os.Open(archivePath)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	headers, contents := readTar(c, f)
+
+	c.Check(headers["docs/"].Typeflag, Equals, byte(tar.TypeDir))
+	c.Check(contents["docs/a.txt"], Equals, "a")
+	c.Check(contents["docs/"+a.longDir+"/b.txt"], Equals, "bb")
+	c.Check(headers["hard"].Typeflag, Equals, byte(tar.TypeLink))
+	c.Check(headers["hard"].Linkname, Equals, "docs/a.txt")
+	c.Check(headers["link"].Typeflag, Equals, byte(tar.TypeSymlink))
+	c.Check(headers["link"].Linkname, Equals, "docs/a.txt")
+
+	if a.xattrs {
+		c.Check(headers["docs/a.txt"].PAXRecords[paxXattrPrefix+"user.colour"], Equals, "blue")
+	}
+
+	// No temporary file is left behind
+	entries, err := ioutil.ReadDir(a.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 1)
+}
+
+func (a *ArchiveTestSuite) TestWriteCompressedTar(c *C) {
+	for _, name := range []string{"backup.tar.gz", "backup.tar.zst"} {
+		archivePath := filepath.Join(a.dstDir, name)
+		_, err := WriteArchive(ScanDirectory(a.srcDir), a.srcDir, archivePath, ArchiveOptions{})
+		c.Assert(err, IsNil)
+
+		f, err := os.Open(archivePath)
+		c.Assert(err, IsNil)
+
+		var r io.Reader
+		if strings.HasSuffix(name, ".gz") {
+			r, err = gzip.NewReader(f)
+		} else {
+			r, err = zstd.NewReader(f)
+		}
+		c.Assert(err, IsNil)
+
+		headers, contents := readTar(c, r)
+		f.Close()
+
+		c.Check(contents["docs/a.txt"], Equals, "a", Commentf(name))
+		_, ok := headers["link"]
+		c.Check(ok, Equals, false, Commentf("symlinks are only archived when included"))
+	}
+}
+
+func (a *ArchiveTestSuite) TestWriteZip(c *C) {
+	archivePath := filepath.Join(a.dstDir, "backup.zip")
+	_, err := WriteArchive(ScanDirectory(a.srcDir), a.srcDir, archivePath, ArchiveOptions{IncludeSymlinks: true})
+	c.Assert(err, IsNil)
+
+	r, err := zip.OpenReader(archivePath)
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	contents := map[string]string{}
+	modes := map[string]os.FileMode{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(rc)
+		c.Assert(err, IsNil)
+		rc.Close()
+		contents[f.Name] = string(data)
+		modes[f.Name] = f.Mode()
+	}
+
+	c.Check(contents["docs/a.txt"], Equals, "a")
+	c.Check(contents["hard"], Equals, "a")
+	c.Check(contents["link"], Equals, "docs/a.txt")
+	c.Check(modes["link"]&os.ModeSymlink, Equals, os.ModeSymlink)
+	c.Check(modes["docs/"].IsDir(), Equals, true)
+}
+
+func (a *ArchiveTestSuite) TestArchiveFormat(c *C) {
+	for path, expected := range map[string]string{
+		"-":              ArchiveTar,
+		"/b/backup.tar":  ArchiveTar,
+		"backup.TGZ":     ArchiveTarGzip,
+		"backup.tar.zst": ArchiveTarZstd,
+		"backup.zip":     ArchiveZip,
+	} {
+		format, ok := ArchiveFormat(path)
+		c.Check(ok, Equals, true, Commentf(path))
+		c.Check(format, Equals, expected, Commentf(path))
+	}
+
+	_, ok := ArchiveFormat("/backups/photos")
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,243 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/samphillips/backup/internal/logging"
+)
+
+const (
+	// StateDir is the directory at the backup location holding the state kept between runs. It is
+	// never copied to or removed from the backup location, and is named so it does not clash with
+	// the directories users commonly name .backup.
+	StateDir = ".backup-state"
+	// hashCacheFile is the name of the hash cache file in the state directory
+	hashCacheFile = "hash-cache.json"
+)
+
+// Sides of a backup that the hash cache keeps digests for
+const (
+	sideSource      = "source"
+	sideDestination = "destination"
+)
+
+// cacheEntry is a digest along with the stat data of the file it was calculated from
+type cacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode"`
+	Ctime   int64  `json:"ctime"`
+	Digest  string `json:"digest"`
+}
+
+// HashCache stores the digests of files between runs so unchanged files are not hashed again. An
+// entry is only used while the size, modification time, inode and change time of the file match
+// the time it was hashed. A nil cache caches nothing.
+type HashCache struct {
+	Algorithm   string                `json:"algorithm"`
+	Source      map[string]cacheEntry `json:"source"`
+	Destination map[string]cacheEntry `json:"destination"`
+
+	path string
+	lock sync.Mutex
+}
+
+// HashCachePath returns the path of the hash cache for a backup. The cache is kept in the state
+// directory at the backup location, or in the state directory given, named after the source and
+// backup locations so several backups can share it.
+func HashCachePath(stateDir, srcDir, dstDir string) string {
+	if stateDir == "" {
+		return filepath.Join(dstDir, StateDir, hashCacheFile)
+	}
+
+	sum := sha256.Sum256([]byte(withTrailingSlash(srcDir) + "\x00" + withTrailingSlash(dstDir)))
+
+	return filepath.Join(stateDir, "hash-cache-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// NewHashCache creates an empty hash cache for digests of the algorithm, saved to the path
+func NewHashCache(path, algorithm string) *HashCache {
+	return &HashCache{
+		Algorithm:   algorithm,
+		Source:      map[string]cacheEntry{},
+		Destination: map[string]cacheEntry{},
+		path:        path,
+	}
+}
+
+// LoadHashCache reads the hash cache at the path. A missing cache, or one written with a different
+// hash algorithm, gives an empty cache.
+func LoadHashCache(path, algorithm string) (*HashCache, error) {
+	cache := NewHashCache(path, algorithm)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored := HashCache{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	if stored.Algorithm != algorithm {
+		logging.Info("Hash cache %s was written with %s hashes, ignoring it", path, stored.Algorithm)
+		return cache, nil
+	}
+
+	if stored.Source != nil {
+		cache.Source = stored.Source
+	}
+	if stored.Destination != nil {
+		cache.Destination = stored.Destination
+	}
+
+	return cache, nil
+}
+
+// Save atomically writes the hash cache back to the path it was loaded from, syncing it to disk
+// before it replaces the previous cache
+func (c *HashCache) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	data, err := json.Marshal(c)
+	c.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpFile, err := createTempFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	err = writeTempFile(tmpFile, func(tmpFile *os.File) error {
+		_, err := tmpFile.Write(data)
+		return err
+	})
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// entries returns the cache entries for a side of the backup
+func (c *HashCache) entries(side string) map[string]cacheEntry {
+	if side == sideSource {
+		return c.Source
+	}
+
+	return c.Destination
+}
+
+// lookup returns the cached digest of the file, if its stat data has not changed since it was hashed
+func (c *HashCache) lookup(side, path string, info os.FileInfo) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries(side)[path]
+	if !ok || entry != newCacheEntry(info, entry.Digest) {
+		return "", false
+	}
+
+	return entry.Digest, true
+}
+
+// store records the digest of the file along with its current stat data
+func (c *HashCache) store(side, path string, info os.FileInfo, digest string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries(side)[path] = newCacheEntry(info, digest)
+}
+
+// prune removes the entries for files that no longer exist
+func (c *HashCache) prune(srcIndex, dstIndex map[string]os.FileInfo) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for path := range c.Source {
+		if _, ok := srcIndex[path]; !ok {
+			delete(c.Source, path)
+		}
+	}
+
+	for path := range c.Destination {
+		if _, ok := dstIndex[path]; !ok {
+			delete(c.Destination, path)
+		}
+	}
+}
+
+// newCacheEntry creates the cache entry for a digest of the file
+func newCacheEntry(info os.FileInfo, digest string) cacheEntry {
+	ino, ctime := changeStamp(info)
+
+	return cacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   ino,
+		Ctime:   ctime,
+		Digest:  digest,
+	}
+}
+
+// isStatePath reports whether the path is inside the state directory at the backup location
+func isStatePath(path string) bool {
+	return path == StateDir || strings.HasPrefix(path, StateDir+string(filepath.Separator))
+}
+
+// ExcludeStateDir returns the source index without the state directory at its root, which is only
+// found when the source is itself a backup location. Its entries would overwrite the state of the
+// backup location, so they are left out with a warning.
+func ExcludeStateDir(srcIndex map[string]os.FileInfo) map[string]os.FileInfo {
+	if _, ok := srcIndex[StateDir]; !ok {
+		return srcIndex
+	}
+
+	logging.Warn("Not backing up %s in the source as it holds the state of a backup location", StateDir)
+
+	index := make(map[string]os.FileInfo, len(srcIndex))
+	for path, info := range srcIndex {
+		if !isStatePath(path) {
+			index[path] = info
+		}
+	}
+
+	return index
+}
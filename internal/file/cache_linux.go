@@ -0,0 +1,17 @@
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// changeStamp returns the inode number and change time of the file, which change whenever the file
+// is replaced or modified without its modification time being updated
+func changeStamp(info os.FileInfo) (uint64, int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	return uint64(stat.Ino), stat.Ctim.Sec*1e9 + stat.Ctim.Nsec
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"os"
+)
+
+// changeStamp is not available on this platform, so cache entries are checked by size and
+// modification time only
+func changeStamp(info os.FileInfo) (uint64, int64) {
+	return 0, 0
+}
@@ -0,0 +1,149 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CacheTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&CacheTestSuite{})
+
+func (s *CacheTestSuite) SetUpTest(c *C) {
+	s.srcDir = c.MkDir()
+	s.dstDir = c.MkDir()
+}
+
+func (s *CacheTestSuite) TestLookupInvalidatesChangedFiles(c *C) {
+	cache := NewHashCache(filepath.Join(s.dstDir, "cache.json"), DefaultHash)
+	info := &MockFileInfo{name: "file1", size: 1, modTime: time.Unix(1, 0)}
+
+	cache.store(sideSource, "file1", info, "digest")
+
+	sum, ok := cache.lookup(sideSource, "file1", info)
+	c.Check(ok, Equals, true)
+	c.Check(sum, Equals, "digest")
+
+	_, ok = cache.lookup(sideDestination, "file1", info)
+	c.Check(ok, Equals, false)
+
+	_, ok = cache.lookup(sideSource, "file1", &MockFileInfo{name: "file1", size: 1, modTime: time.Unix(2, 0)})
+	c.Check(ok, Equals, false)
+
+	_, ok = cache.lookup(sideSource, "file1", &MockFileInfo{name: "file1", size: 2, modTime: time.Unix(1, 0)})
+	c.Check(ok, Equals, false)
+}
+
+func (s *CacheTestSuite) TestLookupInvalidatesReplacedFiles(c *C) {
+	path := filepath.Join(s.srcDir, "file1")
+	c.Assert(createFile(path, []byte{'a'}), IsNil)
+
+	before, err := os.Lstat(path)
+	c.Assert(err, IsNil)
+
+	cache := NewHashCache(filepath.Join(s.dstDir, "cache.json"), DefaultHash)
+	cache.store(sideSource, "file1", before, "digest")
+
+	// Replacing the file keeps its size and modification time but changes its inode or change time
+	c.Assert(os.Remove(path), IsNil)
+	c.Assert(createFile(path, []byte{'b'}), IsNil)
+	c.Assert(os.Chtimes(path, before.ModTime(), before.ModTime()), IsNil)
+
+	after, err := os.Lstat(path)
+	c.Assert(err, IsNil)
+
+	_, ok := cache.lookup(sideSource, "file1", after)
+	c.Check(ok, Equals, false)
+}
+
+func (s *CacheTestSuite) TestSaveAndLoadHashCache(c *C) {
+	path := filepath.Join(s.dstDir, StateDir, hashCacheFile)
+	info := &MockFileInfo{name: "file1", size: 1, modTime: time.Unix(1, 0)}
+
+	cache, err := LoadHashCache(path, HashXXH3)
+	c.Assert(err, IsNil)
+	cache.store(sideDestination, "file1", info, "digest")
+	c.Assert(cache.Save(), IsNil)
+
+	loaded, err := LoadHashCache(path, HashXXH3)
+	c.Assert(err, IsNil)
+	sum, ok := loaded.lookup(sideDestination, "file1", info)
+	c.Check(ok, Equals, true)
+	c.Check(sum, Equals, "digest")
+
+	loaded, err = LoadHashCache(path, HashSHA256)
+	c.Assert(err, IsNil)
+	c.Check(loaded.Algorithm, Equals, HashSHA256)
+	_, ok = loaded.lookup(sideDestination, "file1", info)
+	c.Check(ok, Equals, false)
+}
+
+func (s *CacheTestSuite) TestGenerateBackupDetailsUsesCachedDigests(c *C) {
+	c.Assert(createFile(filepath.Join(s.srcDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(s.dstDir, "file1"), []byte{'b'}), IsNil)
+
+	srcIndex := map[string]os.FileInfo{"file1": &MockFileInfo{name: "file1", size: 1, modTime: time.Unix(1, 0)}}
+	dstIndex := map[string]os.FileInfo{
+		"file1":  &MockFileInfo{name: "file1", size: 1, modTime: time.Unix(2, 0)},
+		"gone":   &MockFileInfo{name: "gone", size: 1, modTime: time.Unix(2, 0)},
+		StateDir: &MockFileInfo{name: StateDir, mode: os.ModeDir, isDir: true},
+	}
+
+	cache := NewHashCache(filepath.Join(s.dstDir, StateDir, hashCacheFile), DefaultHash)
+	cache.store(sideSource, "file1", srcIndex["file1"], "same")
+	cache.store(sideDestination, "file1", dstIndex["file1"], "same")
+	cache.store(sideDestination, "removed", dstIndex["file1"], "same")
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, s.srcDir, s.dstDir, Options{Cache: cache})
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(cache.Destination, HasLen, 1)
+
+	cache = NewHashCache(filepath.Join(s.dstDir, StateDir, hashCacheFile), DefaultHash)
+	plan = GenerateBackupDetails(srcIndex, dstIndex, s.srcDir, s.dstDir, Options{Cache: cache})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "file1", Reason: ReasonHashDiffers}})
+	c.Check(cache.Source, HasLen, 1)
+	c.Check(cache.Destination, HasLen, 1)
+
+	c.Check(GenerateRemovals(srcIndex, dstIndex), DeepEquals, []Operation{{Path: "gone", Reason: ReasonNotInSource}})
+}
+
+func (s *CacheTestSuite) TestHashCachePath(c *C) {
+	c.Check(HashCachePath("", "/src/", "/dst/"), Equals, "/dst/.backup-state/hash-cache.json")
+
+	path := HashCachePath("/state", "/src/", "/dst/")
+	c.Check(filepath.Dir(path), Equals, "/state")
+	c.Check(path, Equals, HashCachePath("/state", "/src", "/dst"))
+	c.Check(path, Not(Equals), HashCachePath("/state", "/src/", "/other/"))
+}
+
+func (s *CacheTestSuite) TestBacksUpSourceDirectoriesNamedBackup(c *C) {
+	srcDir, dstDir := s.srcDir+"/", s.dstDir+"/"
+	c.Assert(os.MkdirAll(filepath.Join(srcDir, ".backup"), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(srcDir, ".backup", "manifest.jsonl"), []byte("user file")), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(srcDir, StateDir), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(srcDir, StateDir, manifestFile), []byte("state of another backup")), IsNil)
+
+	srcIndex := ExcludeStateDir(ScanDirectory(srcDir))
+	c.Check(srcIndex, HasLen, 2)
+
+	plan := GenerateBackupDetails(srcIndex, ScanDirectory(dstDir), srcDir, dstDir, Options{})
+	c.Assert(plan.Apply(ApplyOptions{Manifest: true}), IsNil)
+
+	manifest, err := LoadManifest(dstDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest[".backup/manifest.jsonl"].Size, Equals, int64(len("user file")))
+	c.Check(manifest[StateDir], Equals, ManifestEntry{})
+
+	c.Check(GenerateBackupDetails(ExcludeStateDir(ScanDirectory(srcDir)), ScanDirectory(dstDir), srcDir, dstDir, Options{}).Empty(), Equals, true)
+
+	report, err := Verify(dstDir, VerifyOptions{})
+	c.Assert(err, IsNil)
+	c.Check(report.Problems, HasLen, 0)
+	c.Check(report.Files, Equals, 1)
+}
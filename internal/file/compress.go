@@ -0,0 +1,316 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+const (
+	// CompressionZstd compresses files at the backup location with zstd
+	CompressionZstd = "zstd"
+	// CompressionGzip compresses files at the backup location with gzip, for restoring without
+	// this tool
+	CompressionGzip = "gzip"
+
+	// compressedMagic starts every compressed file at the backup location. It is followed by the
+	// compression algorithm and the logical size of the file, then the compressed contents. Any file
+	// may start with the same bytes, so only files recorded as compressed in their xattrCompression
+	// extended attribute are read as compressed files.
+	compressedMagic = "BKUPCMP1"
+	// compressedHeaderSize is the size of the header before the compressed contents
+	compressedHeaderSize = len(compressedMagic) + 1 + 8
+	// compressionSample is the amount of a file trial compressed to decide whether to compress it
+	compressionSample = 64 * 1024
+	// minCompressionRatio is the largest compressed size of the sample, as a fraction of its size,
+	// for the file to be compressed
+	minCompressionRatio = 0.9
+
+	// xattrCompression holds the algorithm a file at the backup location was compressed with. It is
+	// set on the temporary file before it is renamed into place, so a compressed file is never in
+	// place without it.
+	xattrCompression = digestXattrPrefix + "compression"
+)
+
+// compressionIDs are the values recorded in the header for each algorithm
+var compressionIDs = map[string]byte{CompressionZstd: 1, CompressionGzip: 2}
+
+// incompressibleExts are the extensions of formats that are already compressed, which are stored
+// as is without trying to compress them
+var incompressibleExts = map[string]bool{
+	".7z": true, ".aac": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true, ".flac": true,
+	".gif": true, ".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true,
+	".m4a": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".png": true,
+	".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true, ".xz": true,
+	".zip": true, ".zst": true,
+}
+
+// ValidateCompression returns an error if the compression algorithm is not known. An empty name
+// disables compression.
+func ValidateCompression(name string) error {
+	if _, ok := compressionIDs[name]; !ok && name != "" {
+		return fmt.Errorf("unknown compression algorithm %q, expected %s or %s", name, CompressionZstd, CompressionGzip)
+	}
+
+	return nil
+}
+
+// compressedInfo presents a compressed file at the backup location with the size of its
+// uncompressed contents, so it compares with the source file by its logical size
+type compressedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (c compressedInfo) Size() int64 {
+	return c.size
+}
+
+// readCompressionHeader returns the algorithm and logical size recorded in the header of the
+// file, and false if the file is not compressed
+func readCompressionHeader(r io.Reader) (string, int64, bool) {
+	header := make([]byte, compressedHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(compressedMagic)]) != compressedMagic {
+		return "", 0, false
+	}
+
+	for name, id := range compressionIDs {
+		if header[len(compressedMagic)] == id {
+			return name, int64(binary.BigEndian.Uint64(header[len(compressedMagic)+1:])), true
+		}
+	}
+
+	return "", 0, false
+}
+
+// fileCompression returns the algorithm the file at the backup location was compressed with, as
+// recorded in its extended attributes, or an empty string if it is stored as is
+func fileCompression(path string) string {
+	algorithm, err := getXattr(path, xattrCompression)
+	if err != nil {
+		return ""
+	}
+	if _, ok := compressionIDs[string(algorithm)]; !ok {
+		return ""
+	}
+
+	return string(algorithm)
+}
+
+// logicalSizes returns a copy of the index of the backup location in which compressed files have
+// the size of their uncompressed contents. A file recorded as compressed that does not have the
+// header of a file compressed with the recorded algorithm is taken as is.
+func logicalSizes(dir string, index map[string]os.FileInfo) map[string]os.FileInfo {
+	logical := make(map[string]os.FileInfo, len(index))
+	for path, info := range index {
+		logical[path] = info
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		algorithm := fileCompression(filepath.Join(dir, path))
+		if algorithm == "" {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, path))
+		if err != nil {
+			continue
+		}
+		if headerAlgorithm, size, ok := readCompressionHeader(f); ok && headerAlgorithm == algorithm {
+			logical[path] = compressedInfo{FileInfo: info, size: size}
+		}
+		f.Close()
+	}
+
+	return logical
+}
+
+// openLogical opens a file at the backup location for reading its uncompressed contents. Files
+// recorded as compressed are decompressed and other files are read as is.
+func openLogical(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := fileCompression(path)
+	if algorithm == "" {
+		return f, nil
+	}
+
+	r := bufio.NewReader(f)
+	header, _ := r.Peek(compressedHeaderSize)
+	if headerAlgorithm, _, ok := readCompressionHeader(bytes.NewReader(header)); !ok || headerAlgorithm != algorithm {
+		f.Close()
+		return nil, fmt.Errorf("%s is recorded as compressed with %s but does not start with its header", path, algorithm)
+	}
+
+	r.Discard(compressedHeaderSize)
+
+	var dec io.ReadCloser
+	switch algorithm {
+	case CompressionZstd:
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(r); err == nil {
+			dec = d.IOReadCloser()
+		}
+	case CompressionGzip:
+		dec, err = gzip.NewReader(r)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{dec, closers{dec, f}}, nil
+}
+
+// closers closes each of its closers in order, returning the first error
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var first error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// hashLogicalFile generates the hash string of the uncompressed contents of a file at the backup
+// location using the hasher
+func hashLogicalFile(filePath string, hasher Hasher) (string, error) {
+	r, err := openLogical(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	sum := hasher.New()
+	if _, err := io.Copy(sum, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// newCompressor returns a writer that compresses to the writer with the algorithm
+func newCompressor(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	if algorithm == CompressionGzip {
+		return gzip.NewWriter(w), nil
+	}
+
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+// worthCompressing reports whether the source file should be compressed. Files with the extension
+// of an already compressed format are not, and nor are files whose first block does not shrink by
+// at least a tenth when trial compressed.
+func worthCompressing(srcDir, path string, opts Options) bool {
+	if incompressibleExts[strings.ToLower(filepath.Ext(path))] {
+		return false
+	}
+
+	f, err := openSource(srcDir, path, opts)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	sample, err := io.ReadAll(io.LimitReader(f, compressionSample))
+	if err != nil || len(sample) == 0 {
+		return false
+	}
+
+	var compressed countingWriter
+	c, err := newCompressor(&compressed, opts.Compression)
+	if err != nil {
+		return false
+	}
+	c.Write(sample)
+	if err := c.Close(); err != nil {
+		return false
+	}
+
+	return float64(compressed)+float64(compressedHeaderSize) <= float64(len(sample))*minCompressionRatio
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// compressFile copies the source file of the size scanned to the destination file like copyFile,
+// compressing it with the algorithm selected by the options behind a header recording the
+// algorithm and logical size of the file, and returns the number of bytes written. The algorithm is
+// recorded in the extended attributes of the file.
+func compressFile(srcDir, path string, size int64, dstPath string, opts Options, limiter *throttle.Limiter, sum hash.Hash) (int64, error) {
+	srcFile, err := openSource(srcDir, path, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	algorithm := opts.Compression
+	var written countingWriter
+	err = replaceFile(dstPath, func(tmpFile *os.File) error {
+		w := io.MultiWriter(limiter.Writer(tmpFile), &written)
+
+		header := make([]byte, compressedHeaderSize)
+		copy(header, compressedMagic)
+		header[len(compressedMagic)] = compressionIDs[algorithm]
+		binary.BigEndian.PutUint64(header[len(compressedMagic)+1:], uint64(size))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+
+		c, err := newCompressor(w, algorithm)
+		if err != nil {
+			return err
+		}
+
+		var r io.Reader = srcFile
+		if sum != nil {
+			r = io.TeeReader(srcFile, sum)
+		}
+
+		// Only as much as the header records is copied, so a file that changes size while it is
+		// compressed is copied again on the next run
+		if _, err := io.Copy(c, io.LimitReader(r, size)); err != nil {
+			c.Close()
+			return err
+		}
+
+		if err := c.Close(); err != nil {
+			return err
+		}
+
+		if err := setXattr(tmpFile.Name(), xattrCompression, []byte(algorithm)); err != nil {
+			return fmt.Errorf("could not record compression in extended attributes: %s", err)
+		}
+
+		return nil
+	})
+
+	return int64(written), err
+}
@@ -0,0 +1,120 @@
+package file
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type CompressTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&CompressTestSuite{})
+
+func (s *CompressTestSuite) SetUpTest(c *C) {
+	s.srcDir = c.MkDir() + "/"
+	s.dstDir = c.MkDir() + "/"
+
+	probe := filepath.Join(s.dstDir, "probe")
+	c.Assert(createFile(probe, []byte{}), IsNil)
+	if err := setXattr(probe, "user.backup.probe", []byte{'1'}); err != nil {
+		c.Skip("extended attributes are not supported: " + err.Error())
+	}
+	c.Assert(os.Remove(probe), IsNil)
+
+	random := make([]byte, 32*1024)
+	_, err := rand.Read(random)
+	c.Assert(err, IsNil)
+
+	c.Assert(createFile(filepath.Join(s.srcDir, "export.csv"), bytes.Repeat([]byte("id,name,total\n1,widget,10\n"), 1000)), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "photo.jpg"), bytes.Repeat([]byte("not really a jpeg"), 1000)), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "random"), random), IsNil)
+}
+
+// backup plans and applies a backup with the compression algorithm, returning the plan
+func (s *CompressTestSuite) backup(c *C, algorithm string) *Plan {
+	plan := GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(s.dstDir), s.srcDir, s.dstDir, Options{Compression: algorithm})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+
+	return plan
+}
+
+func (s *CompressTestSuite) TestCompressesOnlyCompressibleFiles(c *C) {
+	for _, algorithm := range []string{CompressionZstd, CompressionGzip} {
+		s.SetUpTest(c)
+		s.backup(c, algorithm)
+
+		c.Check(fileCompression(filepath.Join(s.dstDir, "export.csv")), Equals, algorithm)
+		c.Check(fileCompression(filepath.Join(s.dstDir, "photo.jpg")), Equals, "", Commentf(algorithm))
+		c.Check(fileCompression(filepath.Join(s.dstDir, "random")), Equals, "", Commentf(algorithm))
+
+		// The backed up file is restored with its original contents
+		source := NewDirSource(s.dstDir)
+		r, err := source.Open("export.csv")
+		c.Assert(err, IsNil)
+		restored, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		c.Assert(r.Close(), IsNil)
+		original, err := ioutil.ReadFile(filepath.Join(s.srcDir, "export.csv"))
+		c.Assert(err, IsNil)
+		c.Check(bytes.Equal(restored, original), Equals, true, Commentf(algorithm))
+	}
+}
+
+func (s *CompressTestSuite) TestComparesUncompressedContents(c *C) {
+	s.backup(c, CompressionZstd)
+
+	plan := GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(s.dstDir), s.srcDir, s.dstDir, Options{Compression: CompressionZstd})
+	c.Check(plan.Empty(), Equals, true)
+
+	plan = GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(s.dstDir), s.srcDir, s.dstDir, Options{Compression: CompressionZstd, SkipHashsum: true})
+	c.Check(plan.Empty(), Equals, true)
+
+	// A change that keeps the size is found by comparing the uncompressed contents
+	c.Assert(createFile(filepath.Join(s.srcDir, "export.csv"), bytes.Repeat([]byte("id,name,total\n2,gadget,20\n"), 1000)), IsNil)
+	plan = GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(s.dstDir), s.srcDir, s.dstDir, Options{Compression: CompressionZstd})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "export.csv", Reason: ReasonHashDiffers}})
+
+	// Without compression the compressed file differs from the source, so it is copied as is
+	plan = GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(s.dstDir), s.srcDir, s.dstDir, Options{})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "export.csv", Reason: ReasonSizeDiffers}})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+	c.Check(fileCompression(filepath.Join(s.dstDir, "export.csv")), Equals, "")
+}
+
+func (s *CompressTestSuite) TestOnlyDecompressesFilesRecordedAsCompressed(c *C) {
+	// A source file that starts with the header of a compressed file, such as a file of another
+	// compressed backup, is stored as is and is not read as compressed
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	header[len(compressedMagic)] = compressionIDs[CompressionZstd]
+	binary.BigEndian.PutUint64(header[len(compressedMagic)+1:], 5)
+	contents := append(header, "not zstd"...)
+	c.Assert(createFile(filepath.Join(s.srcDir, "backup.jpg"), contents), IsNil)
+
+	s.backup(c, CompressionZstd)
+	c.Check(fileCompression(filepath.Join(s.dstDir, "backup.jpg")), Equals, "")
+
+	plan := GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(s.dstDir), s.srcDir, s.dstDir, Options{Compression: CompressionZstd})
+	c.Check(plan.Empty(), Equals, true)
+
+	r, err := NewDirSource(s.dstDir).Open("backup.jpg")
+	c.Assert(err, IsNil)
+	restored, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+	c.Check(restored, DeepEquals, contents)
+}
+
+func (s *CompressTestSuite) TestValidateCompression(c *C) {
+	c.Check(ValidateCompression(""), IsNil)
+	c.Check(ValidateCompression(CompressionGzip), IsNil)
+	c.Check(ValidateCompression("lzma"), ErrorMatches, `unknown compression algorithm "lzma".*`)
+}
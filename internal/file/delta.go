@@ -0,0 +1,108 @@
+package file
+
+import (
+	"bufio"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/samphillips/backup/internal/delta"
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+// deltaMinSize is the smallest backed up file that is worth transferring as a delta
+const deltaMinSize = 64 << 10
+
+// deltaCopyFile replaces the destination file with the source file, sending only the parts of the
+// source that are not already in the destination file. Unchanged blocks are copied from the old
+// destination file into the temporary file that replaces it by the kernel, which shares rather than
+// writes them on file systems with reflinks, so the destination is never left partially written.
+// Other file systems still write the whole file. Holes in a sparse source file are written out in
+// full.
+func deltaCopyFile(srcPath, dstPath string, limiter *throttle.Limiter, sum hash.Hash) (delta.Stats, error) {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return delta.Stats{}, err
+	}
+	defer srcFile.Close()
+
+	basis, err := os.Open(dstPath)
+	if err != nil {
+		return delta.Stats{}, err
+	}
+	defer basis.Close()
+
+	basisInfo, err := basis.Stat()
+	if err != nil {
+		return delta.Stats{}, err
+	}
+
+	sig, err := delta.NewSignature(bufio.NewReader(basis), delta.BlockSize(basisInfo.Size()))
+	if err != nil {
+		return delta.Stats{}, err
+	}
+
+	var stats delta.Stats
+	err = replaceFile(dstPath, func(tmpFile *os.File) error {
+		w := &deltaWriter{
+			Writer:  bufio.NewWriter(teeHash(limiter.Writer(tmpFile), sum)),
+			tmpFile: tmpFile,
+			basis:   basis,
+			sum:     sum,
+		}
+
+		stats, err = delta.Patch(w, bufio.NewReader(srcFile), basis, sig)
+		if err != nil {
+			return err
+		}
+
+		return w.Flush()
+	})
+
+	return stats, err
+}
+
+// deltaWriter writes the data sent by a delta to the temporary file through the buffer, and has
+// the kernel copy unchanged blocks from the old destination file straight into the temporary file
+type deltaWriter struct {
+	*bufio.Writer
+	tmpFile *os.File
+	basis   *os.File
+	sum     hash.Hash
+}
+
+// CopyBlock appends a block of the old destination file to the temporary file. Copying from one
+// file to another with a limited reader uses copy_file_range where it is available. Unchanged
+// blocks are already at the backup location, so they are not throttled, but they are still read
+// into the hash, if any.
+func (w *deltaWriter) CopyBlock(offset, length int64) (int64, error) {
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.basis.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := w.tmpFile.ReadFrom(io.LimitReader(w.basis, length))
+	if err != nil {
+		return n, err
+	}
+	if n != length {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	if w.sum != nil {
+		if _, err := io.Copy(w.sum, io.NewSectionReader(w.basis, offset, length)); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// useDelta reports whether the file being replaced at the backup location is worth transferring
+// as a delta. Compressed files share no blocks with the source file.
+func useDelta(dstPath string) bool {
+	info, err := os.Lstat(dstPath)
+	return err == nil && info.Mode().IsRegular() && info.Size() >= deltaMinSize && fileCompression(dstPath) == ""
+}
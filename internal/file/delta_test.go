@@ -0,0 +1,57 @@
+package file
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type DeltaTestSuite struct {
+	dir string
+}
+
+var _ = Suite(&DeltaTestSuite{})
+
+func (d *DeltaTestSuite) SetUpTest(c *C) {
+	d.dir = c.MkDir()
+}
+
+func (d *DeltaTestSuite) TestDeltaCopyFileSendsOnlyChanges(c *C) {
+	srcFile := filepath.Join(d.dir, "src")
+	dstFile := filepath.Join(d.dir, "dst")
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	c.Assert(createFile(dstFile, data), IsNil)
+
+	copy(data[1000:], "changed")
+	c.Assert(createFile(srcFile, data), IsNil)
+
+	sum := hashers[DefaultHash].New()
+	stats, err := deltaCopyFile(srcFile, dstFile, nil, sum)
+	c.Assert(err, IsNil)
+	c.Check(stats.Size(), Equals, int64(len(data)))
+	c.Check(stats.Literal < int64(len(data))/10, Equals, true)
+
+	copied, err := ioutil.ReadFile(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(copied, data), Equals, true)
+
+	expected, err := hashFile(srcFile, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+	c.Check(hex.EncodeToString(sum.Sum(nil)), Equals, expected)
+}
+
+func (d *DeltaTestSuite) TestUseDeltaOnlyForLargeBackedUpFiles(c *C) {
+	c.Assert(createFile(filepath.Join(d.dir, "small"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(d.dir, "large"), make([]byte, deltaMinSize)), IsNil)
+
+	c.Check(useDelta(filepath.Join(d.dir, "small")), Equals, false)
+	c.Check(useDelta(filepath.Join(d.dir, "large")), Equals, true)
+	c.Check(useDelta(filepath.Join(d.dir, "missing")), Equals, false)
+	c.Check(useDelta(d.dir), Equals, false)
+}
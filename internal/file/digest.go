@@ -0,0 +1,69 @@
+package file
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// digestXattrPrefix prefixes the extended attributes that record the digest of a backed up file,
+	// and whether it is compressed
+	digestXattrPrefix = "user.backup."
+	// xattrDigest holds the hex digest of the contents of a backed up file
+	xattrDigest = digestXattrPrefix + "digest"
+	// xattrAlgorithm holds the name of the hash algorithm that produced the digest
+	xattrAlgorithm = digestXattrPrefix + "algorithm"
+	// xattrMtime holds the modification time of the source file, in nanoseconds since the epoch,
+	// when it was copied
+	xattrMtime = digestXattrPrefix + "mtime"
+)
+
+// isDigestXattr reports whether the named extended attribute records the digest of a backed up
+// file. These attributes belong to the backup location and are never copied from the source.
+func isDigestXattr(name string) bool {
+	return strings.HasPrefix(name, digestXattrPrefix)
+}
+
+// writeDigest records the digest of a copied file, the algorithm that produced it and the
+// modification time of its source in the extended attributes of the path
+func writeDigest(path, algorithm, digest string, mtime time.Time) error {
+	xattrs := []struct {
+		name  string
+		value string
+	}{
+		{xattrDigest, digest},
+		{xattrAlgorithm, algorithm},
+		{xattrMtime, strconv.FormatInt(mtime.UnixNano(), 10)},
+	}
+
+	for _, x := range xattrs {
+		if err := setXattr(path, x.name, []byte(x.value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readDigest returns the digest recorded in the extended attributes of a backed up file. The digest
+// is only returned if it was produced by the hasher and the file still has the modification time it
+// was given when copied, otherwise the file must be hashed.
+func readDigest(path string, mtime time.Time, hasher Hasher) (string, bool) {
+	algorithm, err := getXattr(path, xattrAlgorithm)
+	if err != nil || string(algorithm) != hasher.Name() {
+		return "", false
+	}
+
+	recorded, err := getXattr(path, xattrMtime)
+	if err != nil || string(recorded) != strconv.FormatInt(mtime.UnixNano(), 10) {
+		return "", false
+	}
+
+	digest, err := getXattr(path, xattrDigest)
+	if err != nil || len(digest) == 0 {
+		return "", false
+	}
+
+	return string(digest), true
+}
@@ -0,0 +1,96 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type DigestTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&DigestTestSuite{})
+
+func (d *DigestTestSuite) SetUpTest(c *C) {
+	d.srcDir = c.MkDir() + "/"
+	d.dstDir = c.MkDir() + "/"
+
+	probe := filepath.Join(d.srcDir, "probe")
+	c.Assert(createFile(probe, []byte{}), IsNil)
+	if err := setXattr(probe, "user.backup.probe", []byte{'1'}); err != nil {
+		c.Skip("extended attributes are not supported: " + err.Error())
+	}
+	c.Assert(os.Remove(probe), IsNil)
+}
+
+func (d *DigestTestSuite) TestApplyRecordsDigests(c *C) {
+	modTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(createFile(filepath.Join(d.srcDir, "file1"), []byte("test")), IsNil)
+	c.Assert(os.Chtimes(filepath.Join(d.srcDir, "file1"), modTime, modTime), IsNil)
+
+	plan := GenerateBackupDetails(ScanDirectory(d.srcDir), ScanDirectory(d.dstDir), d.srcDir, d.dstDir, Options{DigestXattrs: true, Hash: HashXXH3})
+	c.Assert(plan.Apply(ApplyOptions{Jobs: 1}), IsNil)
+
+	dstFile := filepath.Join(d.dstDir, "file1")
+	info, err := os.Stat(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(info.ModTime().Equal(modTime), Equals, true)
+
+	digest, ok := readDigest(dstFile, info.ModTime(), hashers[HashXXH3])
+	c.Check(ok, Equals, true)
+	c.Check(digest, Equals, "9ec9f7918d7dfc40")
+
+	_, ok = readDigest(dstFile, info.ModTime(), hashers[HashSHA256])
+	c.Check(ok, Equals, false)
+
+	_, ok = readDigest(dstFile, time.Now(), hashers[HashXXH3])
+	c.Check(ok, Equals, false)
+}
+
+func (d *DigestTestSuite) TestGenerateBackupDetailsReadsRecordedDigests(c *C) {
+	modTime := time.Unix(1, 0)
+	srcFile := filepath.Join(d.srcDir, "file1")
+	dstFile := filepath.Join(d.dstDir, "file1")
+
+	c.Assert(createFile(srcFile, []byte("test")), IsNil)
+	c.Assert(createFile(dstFile, []byte("best")), IsNil)
+	c.Assert(os.Chtimes(dstFile, modTime, modTime), IsNil)
+
+	srcSum, err := hashFile(srcFile, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+
+	// The recorded digest is trusted over the contents of the backed up file
+	c.Assert(writeDigest(dstFile, DefaultHash, srcSum, modTime), IsNil)
+
+	plan := GenerateBackupDetails(ScanDirectory(d.srcDir), ScanDirectory(d.dstDir), d.srcDir, d.dstDir, Options{DigestXattrs: true})
+	c.Check(plan.Files, HasLen, 0)
+
+	// Until the backed up file is modified, when it is hashed again
+	c.Assert(os.Chtimes(dstFile, time.Unix(2, 0), time.Unix(2, 0)), IsNil)
+
+	plan = GenerateBackupDetails(ScanDirectory(d.srcDir), ScanDirectory(d.dstDir), d.srcDir, d.dstDir, Options{DigestXattrs: true})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "file1", Reason: ReasonHashDiffers}})
+}
+
+func (d *DigestTestSuite) TestCopyMetadataKeepsRecordedDigests(c *C) {
+	srcFile := filepath.Join(d.srcDir, "file1")
+	dstFile := filepath.Join(d.dstDir, "file1")
+
+	c.Assert(createFile(srcFile, []byte{'a'}), IsNil)
+	c.Assert(createFile(dstFile, []byte{'a'}), IsNil)
+	c.Assert(writeDigest(dstFile, DefaultHash, "digest", time.Unix(1, 0)), IsNil)
+
+	c.Assert(CopyMetadata(srcFile, dstFile, Options{Xattrs: true}), IsNil)
+
+	differ, err := xattrsDiffer(srcFile, dstFile, Options{Xattrs: true})
+	c.Check(err, IsNil)
+	c.Check(differ, Equals, false)
+
+	digest, err := getXattr(dstFile, xattrDigest)
+	c.Check(err, IsNil)
+	c.Check(string(digest), Equals, "digest")
+}
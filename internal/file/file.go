@@ -1,20 +1,24 @@
 package file
 
 import (
-	"crypto/md5"
 	"encoding/hex"
+	"hash"
 	"io"
+	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/samphillips/backup/internal/logging"
 	"github.com/samphillips/backup/internal/progress"
+	"github.com/samphillips/backup/internal/throttle"
 )
 
-// hashFile generates the md5 sum hash string of a file
-func hashFile(filePath string) (string, error) {
+// hashFile generates the hash string of the logical contents of a file using the hasher, so holes
+// in a sparse file hash the same as the zeros they read as
+func hashFile(filePath string, hasher Hasher) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -22,45 +26,196 @@ func hashFile(filePath string) (string, error) {
 
 	defer file.Close()
 
-	hash := md5.New()
+	hash := hasher.New()
 
 	if _, err := io.Copy(hash, file); err != nil {
 		return "", err
 	}
 
-	hashBytes := hash.Sum(nil)[:16]
-	hashString := hex.EncodeToString(hashBytes)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+const (
+	// ReasonMissing marks an entry that does not exist at the backup location
+	ReasonMissing = "missing"
+	// ReasonSizeDiffers marks a file whose size differs from the file at the backup location
+	ReasonSizeDiffers = "size differs"
+	// ReasonAppended marks a file that has grown since it was backed up, where the file at the backup
+	// location is still the start of the file
+	ReasonAppended = "appended"
+	// ReasonHashDiffers marks a file whose hashsum differs from the file at the backup location
+	ReasonHashDiffers = "hash differs"
+	// ReasonLinkDiffers marks a symlink whose target differs from the entry at the backup location
+	ReasonLinkDiffers = "link target differs"
+	// ReasonMtimeDiffers marks a file whose modification time differs from the file at the backup
+	// location
+	ReasonMtimeDiffers = "modification time differs"
+	// ReasonMetadataDiffers marks an entry whose permissions, ownership or timestamps differ from the
+	// entry at the backup location
+	ReasonMetadataDiffers = "metadata differs"
+	// ReasonXattrsDiffer marks an entry whose extended attributes or ACLs differ from the entry at
+	// the backup location
+	ReasonXattrsDiffer = "xattrs differ"
+	// ReasonLinkGroupChanged marks a file whose hard links differ from the file at the backup
+	// location
+	ReasonLinkGroupChanged = "hard links differ"
+	// ReasonLinkTargetCopied marks a hard link whose linked file is being replaced at the backup
+	// location
+	ReasonLinkTargetCopied = "linked file copied"
+	// ReasonStaleTempFile marks a temporary file left at the backup location by an interrupted copy
+	ReasonStaleTempFile = "stale temporary file"
+	// ReasonUnchanged marks a file that has not changed since the previous snapshot, which is
+	// linked into the new snapshot rather than copied
+	ReasonUnchanged = "unchanged"
+	// ReasonNotInSource marks an entry at the backup location that no longer exists at the source
+	ReasonNotInSource = "not in source"
+)
+
+// Options controls how the backup plan is determined and which metadata is preserved when it is
+// applied
+type Options struct {
+	// SkipHashsum assumes files of the same size are equal without comparing their hashsums
+	SkipHashsum bool `json:"skipHashsum"`
+	// Archive preserves permissions, ownership and timestamps at the backup location
+	Archive bool `json:"archive"`
+	// Xattrs preserves extended attributes at the backup location
+	Xattrs bool `json:"xattrs"`
+	// ACLs preserves POSIX access and default ACLs at the backup location
+	ACLs bool `json:"acls"`
+	// HardLinks copies each hard linked source file once and links its other paths to it
+	HardLinks bool `json:"hardLinks"`
+	// QuickCheck treats files as changed only when their size or modification time differ, and
+	// preserves the modification time of copied files
+	QuickCheck bool `json:"quickCheck"`
+	// ModifyWindow is the largest difference between modification times that are treated as equal
+	ModifyWindow time.Duration `json:"modifyWindow"`
+	// HashMtimeChanges compares the hashsums of files whose size matches but whose modification time
+	// differs in quick check mode, rather than copying them
+	HashMtimeChanges bool `json:"hashMtimeChanges"`
+	// Hash names the algorithm used to compare the contents of files
+	Hash string `json:"hash"`
+	// Append copies only the end of files that have grown since they were backed up, when the
+	// backed up file matches the start of the file
+	Append bool `json:"append"`
+	// Delta transfers changed files by reusing the blocks of the backed up file that are unchanged
+	Delta bool `json:"delta"`
+	// DigestXattrs records the digest of each copied file in extended attributes at the backup
+	// location, and reads it back instead of hashing the backed up file again
+	DigestXattrs bool `json:"digestXattrs"`
+	// Compression names the algorithm files are compressed with at the backup location, if any
+	Compression string `json:"compression,omitempty"`
+	// Cache holds the digests of files hashed by earlier runs, if set
+	Cache *HashCache `json:"-"`
+	// Source holds the entries to back up when they are read from an archive or another file
+	// system rather than the source directory
+	Source fs.FS `json:"-"`
+}
+
+// hasher returns the hasher for the configured algorithm, falling back to the default algorithm if
+// it is unknown
+func (o Options) hasher() Hasher {
+	h, err := NewHasher(o.Hash)
+	if err != nil {
+		logging.Warn("%s, using %s", err, DefaultHash)
+		h, _ = NewHasher(DefaultHash)
+	}
+
+	return h
+}
+
+// preservesMetadata reports whether any metadata is copied to the backup location
+func (o Options) preservesMetadata() bool {
+	return o.Archive || o.Xattrs || o.ACLs || o.preservesModTime()
+}
+
+// preservesModTime reports whether the modification times of copied files are needed to compare
+// them on later runs, even outside archive mode
+func (o Options) preservesModTime() bool {
+	return o.QuickCheck || o.DigestXattrs
+}
+
+// hashesDiffer reports whether the hashsums of the file in the source and backup locations differ.
+// Digests are taken from the cache when the files have not changed since they were last hashed, or
+// from the extended attributes of the backed up file when they are recorded there.
+func hashesDiffer(srcDir, dstDir, path string, srcFile, dstFile os.FileInfo, hasher Hasher, opts Options) bool {
+	srcSum, err := hashSource(srcDir, path, srcFile, hasher, opts)
+
+	if err != nil {
+		logging.Warn("Could not calculate %s hashsum of file: %s", hasher.Name(), path)
+	}
+
+	dstSum, ok := "", false
+	if opts.DigestXattrs {
+		dstSum, ok = readDigest(filepath.Join(dstDir, path), dstFile.ModTime(), hasher)
+	}
+
+	if !ok {
+		dstSum, err = cachedHash(opts.Cache, sideDestination, dstDir, path, dstFile, hasher)
+
+		if err != nil {
+			logging.Warn("Could not calculate %s hashsum of file: %s", hasher.Name(), path)
+		}
+	}
+
+	return srcSum != dstSum
+}
+
+// cachedHash returns the hashsum of the file, hashing it only if the cache has no current digest
+func cachedHash(cache *HashCache, side, dir, path string, info os.FileInfo, hasher Hasher) (string, error) {
+	if sum, ok := cache.lookup(side, path, info); ok {
+		return sum, nil
+	}
 
-	return hashString, nil
+	hashFn := hashFile
+	if side == sideDestination {
+		hashFn = hashLogicalFile
+	}
+
+	sum, err := hashFn(filepath.Join(dir, path), hasher)
+	if err != nil {
+		return "", err
+	}
+
+	cache.store(side, path, info, sum)
+
+	return sum, nil
 }
 
 type srcDetails struct {
 	srcPath string
 	srcFile os.FileInfo
+	relink  bool
 }
 
 type backupDetails struct {
-	files       []string
-	directories []string
-	symlinks    map[string]string
+	files       []Operation
+	directories []Operation
+	symlinks    []Operation
+	metadata    []Operation
 }
 
-func worker(dstIndex map[string]os.FileInfo, srcDir, dstDir string, skipHashsum bool, jobs <-chan srcDetails, results chan<- backupDetails) {
+func worker(dstIndex map[string]os.FileInfo, srcDir, dstDir string, opts Options, hasher Hasher, jobs <-chan srcDetails, results chan<- backupDetails) {
 	b := backupDetails{
-		files:       []string{},
-		directories: []string{},
-		symlinks:    map[string]string{},
+		files:       []Operation{},
+		directories: []Operation{},
+		symlinks:    []Operation{},
+		metadata:    []Operation{},
 	}
 
 	for j := range jobs {
 		if dstFile, ok := dstIndex[j.srcPath]; ok {
 			if j.srcFile.IsDir() {
+				if reason := metadataReason(filepath.Join(srcDir, j.srcPath), filepath.Join(dstDir, j.srcPath), j.srcFile, dstFile, opts); reason != "" {
+					logging.Debug("Marking %s for metadata update as %s at backup location", j.srcPath, reason)
+					b.metadata = append(b.metadata, Operation{Path: j.srcPath, Reason: reason})
+					continue
+				}
 				logging.Debug("Skipping %s as directory already exists at backup location", j.srcPath)
 				continue
 			}
 
 			if j.srcFile.Mode()&os.ModeSymlink != 0 {
-				srcLink, err := os.Readlink(filepath.Join(srcDir, j.srcPath))
+				srcLink, err := readSourceLink(srcDir, j.srcPath, opts)
 				if err != nil {
 					logging.Warn("Error reading file %s symlink: %s", j.srcPath, err)
 					continue
@@ -71,57 +226,99 @@ func worker(dstIndex map[string]os.FileInfo, srcDir, dstDir string, skipHashsum
 					if strings.HasPrefix(srcLink, srcDir) {
 						srcLink = filepath.Join(dstDir, strings.TrimPrefix(srcLink, srcDir))
 					}
-					b.symlinks[j.srcPath] = srcLink
+					b.symlinks = append(b.symlinks, Operation{Path: j.srcPath, Target: srcLink, Reason: ReasonLinkDiffers})
+					continue
+				}
+				if reason := metadataReason(filepath.Join(srcDir, j.srcPath), filepath.Join(dstDir, j.srcPath), j.srcFile, dstFile, opts); reason != "" {
+					logging.Debug("Marking %s for metadata update as %s at backup location", j.srcPath, reason)
+					b.metadata = append(b.metadata, Operation{Path: j.srcPath, Reason: reason})
 					continue
 				}
+				logging.Debug("Skipping %s as the symlink has not changed", j.srcPath)
+				continue
 			}
 
-			if j.srcFile.Size() == dstFile.Size() {
-				if skipHashsum {
-					logging.Debug("Skipping %s as the file size has not changed and hashsum skip is enabled", j.srcPath)
+			if j.relink {
+				logging.Debug("Marking %s for backup as its hard links are different to the file at backup location", j.srcPath)
+				b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonLinkGroupChanged})
+				continue
+			}
+
+			if opts.QuickCheck && j.srcFile.Size() == dstFile.Size() {
+				if !mtimeDiffers(j.srcFile, dstFile, opts.ModifyWindow) {
+					if reason := metadataReason(filepath.Join(srcDir, j.srcPath), filepath.Join(dstDir, j.srcPath), j.srcFile, dstFile, opts); reason != "" {
+						logging.Debug("Marking %s for metadata update as %s at backup location", j.srcPath, reason)
+						b.metadata = append(b.metadata, Operation{Path: j.srcPath, Reason: reason})
+						continue
+					}
+					logging.Debug("Skipping %s as the file size and modification time have not changed", j.srcPath)
 					continue
 				}
 
-				srcSum, err := hashFile(filepath.Join(srcDir, j.srcPath))
+				if !opts.HashMtimeChanges {
+					logging.Debug("Marking %s for backup as file modification time is different to file at backup location", j.srcPath)
+					b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonMtimeDiffers})
+					continue
+				}
 
-				if err != nil {
-					logging.Warn("Could not calculate md5 hashsum of file: %s", j.srcPath)
+				if hashesDiffer(srcDir, dstDir, j.srcPath, j.srcFile, dstFile, hasher, opts) {
+					logging.Debug("Marking %s for backup as file hashsum is different to file at backup location", j.srcPath)
+					b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonHashDiffers})
+					continue
 				}
 
-				dstSum, err := hashFile(filepath.Join(dstDir, j.srcPath))
+				// The contents are unchanged, so only the modification time needs updating to avoid
+				// hashing the file again on the next run
+				logging.Debug("Marking %s for metadata update as only the file modification time is different", j.srcPath)
+				b.metadata = append(b.metadata, Operation{Path: j.srcPath, Reason: ReasonMtimeDiffers})
+				continue
+			}
 
-				if err != nil {
-					logging.Warn("Could not calculate md5 hashsum of file: %s", j.srcPath)
+			if j.srcFile.Size() == dstFile.Size() {
+				if opts.SkipHashsum {
+					if reason := metadataReason(filepath.Join(srcDir, j.srcPath), filepath.Join(dstDir, j.srcPath), j.srcFile, dstFile, opts); reason != "" {
+						logging.Debug("Marking %s for metadata update as %s at backup location", j.srcPath, reason)
+						b.metadata = append(b.metadata, Operation{Path: j.srcPath, Reason: reason})
+						continue
+					}
+					logging.Debug("Skipping %s as the file size has not changed and hashsum skip is enabled", j.srcPath)
+					continue
 				}
 
-				if srcSum != dstSum {
+				if hashesDiffer(srcDir, dstDir, j.srcPath, j.srcFile, dstFile, hasher, opts) {
 					logging.Debug("Marking %s for backup as file hashsum is different to file at backup location", j.srcPath)
-					b.files = append(b.files, j.srcPath)
+					b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonHashDiffers})
+				} else if reason := metadataReason(filepath.Join(srcDir, j.srcPath), filepath.Join(dstDir, j.srcPath), j.srcFile, dstFile, opts); reason != "" {
+					logging.Debug("Marking %s for metadata update as %s at backup location", j.srcPath, reason)
+					b.metadata = append(b.metadata, Operation{Path: j.srcPath, Reason: reason})
 				} else {
 					logging.Debug("Skipping %s as the file has not changed", j.srcPath)
 				}
+			} else if opts.Append && appendedTo(srcDir, dstDir, j.srcPath, j.srcFile, dstFile, hasher, opts) {
+				logging.Debug("Marking %s for backup as data has been appended to the file at backup location", j.srcPath)
+				b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonAppended})
 			} else {
 				logging.Debug("Marking %s for backup as file size is different to file at backup location", j.srcPath)
-				b.files = append(b.files, j.srcPath)
+				b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonSizeDiffers})
 			}
 		} else {
 			if j.srcFile.IsDir() {
 				logging.Debug("Marking %s for creation as directory does not exist at backup location", j.srcPath)
-				b.directories = append(b.directories, j.srcPath)
+				b.directories = append(b.directories, Operation{Path: j.srcPath, Reason: ReasonMissing})
 			} else {
 				if j.srcFile.Mode()&os.ModeSymlink != 0 {
-					link, err := os.Readlink(filepath.Join(srcDir, j.srcPath))
+					link, err := readSourceLink(srcDir, j.srcPath, opts)
 					if err != nil {
 						logging.Warn("Error reading file %s symlink: %s", j.srcPath, err)
 						continue
 					}
 					logging.Debug("Marking symlink at %s for backup", j.srcPath)
-					b.symlinks[j.srcPath] = strings.TrimPrefix(link, srcDir)
+					b.symlinks = append(b.symlinks, Operation{Path: j.srcPath, Target: strings.TrimPrefix(link, srcDir), Reason: ReasonMissing})
 					continue
 				}
 
 				logging.Debug("Marking %s for backup as file does not exist at backup location", j.srcPath)
-				b.files = append(b.files, j.srcPath)
+				b.files = append(b.files, Operation{Path: j.srcPath, Reason: ReasonMissing})
 			}
 		}
 	}
@@ -129,26 +326,65 @@ func worker(dstIndex map[string]os.FileInfo, srcDir, dstDir string, skipHashsum
 	results <- b
 }
 
-// GenerateBackupDetails determines the list of directories, files and symlinks to create in the
-// backup location
-func GenerateBackupDetails(srcIndex, dstIndex map[string]os.FileInfo, srcDir, dstDir string, skipHashsum bool) ([]string, []string, map[string]string) {
-	var files, directories []string
-	symlinks := map[string]string{}
+// GenerateBackupDetails determines the plan of directories, files and symlinks to create in the
+// backup location, along with the reason each path was selected
+func GenerateBackupDetails(srcIndex, dstIndex map[string]os.FileInfo, srcDir, dstDir string, opts Options) *Plan {
+	srcDir = withTrailingSlash(srcDir)
+	dstDir = withTrailingSlash(dstDir)
+
+	// Record the algorithm actually used so the plan describes how files were compared
+	hasher := opts.hasher()
+	opts.Hash = hasher.Name()
+
+	if opts.Cache != nil && opts.Cache.Algorithm != hasher.Name() {
+		logging.Warn("Hash cache holds %s hashes, not using it", opts.Cache.Algorithm)
+		opts.Cache = nil
+	}
+
+	plan := &Plan{
+		SrcDir:      srcDir,
+		DstDir:      dstDir,
+		Created:     time.Now().UTC(),
+		Fingerprint: Fingerprint(srcIndex),
+		Options:     opts,
+		Directories: []Operation{},
+		Files:       []Operation{},
+		Reuse:       []Operation{},
+		Symlinks:    []Operation{},
+		Links:       []Operation{},
+		Metadata:    []Operation{},
+		Removals:    []Operation{},
+	}
+
+	// Compressed files at the backup location are compared by the size of their contents
+	if opts.Compression != "" {
+		dstIndex = logicalSizes(dstDir, dstIndex)
+	}
+
+	var srcLinks, dstLinks map[string][]string
+	if opts.HardLinks {
+		srcLinks = linkGroups(srcIndex)
+		dstLinks = linkGroups(dstIndex)
+	}
 
 	numWorkers := int(math.Ceil(float64(len(srcIndex)) / 100.0))
 	jobs := make(chan srcDetails, numWorkers)
 	results := make(chan backupDetails, numWorkers)
 
 	for w := 0; w < numWorkers; w++ {
-		go worker(dstIndex, srcDir, dstDir, skipHashsum, jobs, results)
+		go worker(dstIndex, srcDir, dstDir, opts, hasher, jobs, results)
 	}
 
 	bar := progress.Start(len(srcIndex) + 1 + numWorkers)
 	for srcPath, srcFile := range srcIndex {
 		bar.Increment()
+		if group, ok := srcLinks[srcPath]; ok && group[0] != srcPath {
+			continue
+		}
 		jobs <- srcDetails{
 			srcPath: srcPath,
 			srcFile: srcFile,
+			relink:  opts.HardLinks && linksChanged(srcPath, srcLinks, dstLinks),
 		}
 	}
 
@@ -157,36 +393,127 @@ func GenerateBackupDetails(srcIndex, dstIndex map[string]os.FileInfo, srcDir, ds
 	for w := 0; w < numWorkers; w++ {
 		bar.Increment()
 		r := <-results
-		files = append(files, r.files...)
-		directories = append(directories, r.directories...)
-		for k, v := range r.symlinks {
-			symlinks[k] = v
-		}
+		plan.Files = append(plan.Files, r.files...)
+		plan.Directories = append(plan.Directories, r.directories...)
+		plan.Symlinks = append(plan.Symlinks, r.symlinks...)
+		plan.Metadata = append(plan.Metadata, r.metadata...)
 	}
 	bar.Increment()
 	bar.Finish()
 
-	return files, directories, symlinks
+	sortOperations(plan.Files)
+	sortOperations(plan.Directories)
+	sortOperations(plan.Symlinks)
+	sortOperations(plan.Metadata)
+
+	opts.Cache.prune(srcIndex, dstIndex)
+
+	plan.Removals = generateTempRemovals(srcIndex, dstIndex)
+
+	if opts.HardLinks {
+		plan.Links = generateLinks(srcLinks, dstIndex, plan.Files)
+	}
+
+	return plan
 }
 
-// CopyFile copies the source file to the destination file
+// GenerateRemovals determines the list of paths in the backup location that do not exist in the
+// source location. Paths inside a directory that is itself being removed are omitted, as are stale
+// temporary files which are always removed by the plan and the state directory.
+func GenerateRemovals(srcIndex, dstIndex map[string]os.FileInfo) []Operation {
+	removed := map[string]bool{}
+
+	for dstPath := range dstIndex {
+		if _, ok := srcIndex[dstPath]; !ok && !isTempFile(dstPath) && !isStatePath(dstPath) {
+			removed[dstPath] = true
+		}
+	}
+
+	removals := []Operation{}
+	for dstPath := range removed {
+		if !hasRemovedParent(dstPath, removed) {
+			removals = append(removals, Operation{Path: dstPath, Reason: ReasonNotInSource})
+		}
+	}
+
+	sortOperations(removals)
+
+	return removals
+}
+
+// hasRemovedParent reports whether any parent directory of the path is in the removed set
+func hasRemovedParent(path string, removed map[string]bool) bool {
+	for parent := filepath.Dir(path); parent != "." && parent != "/"; parent = filepath.Dir(parent) {
+		if removed[parent] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withTrailingSlash ensures a directory path ends in a slash so it can be trimmed from child paths
+func withTrailingSlash(dir string) string {
+	if !strings.HasSuffix(dir, "/") {
+		return dir + "/"
+	}
+
+	return dir
+}
+
+// CopyFile copies the source file to the destination file, preserving any holes in a sparse
+// source file. The contents are written to a temporary file alongside the destination which is
+// then renamed over it, so the destination is never left partially written.
 func CopyFile(srcPath, dstPath string) error {
+	return copyFile(srcPath, dstPath, nil, nil)
+}
+
+// copyFile copies the source file to the destination file like CopyFile, throttling the writes
+// with the limiter, if any, and writing the contents to the hash, if any, as they are copied
+func copyFile(srcPath, dstPath string, limiter *throttle.Limiter, sum hash.Hash) error {
 	srcFile, err := os.Open(srcPath)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	destFile, err := os.Create(dstPath)
+	return replaceFile(dstPath, func(tmpFile *os.File) error {
+		return copyData(tmpFile, srcFile, limiter, sum)
+	})
+}
+
+// replaceFile writes the contents of the destination file to a temporary file alongside it, syncs
+// it to disk and renames it over the destination
+func replaceFile(dstPath string, write func(tmpFile *os.File) error) error {
+	tmpFile, err := createTempFile(dstPath)
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
 
-	_, err = io.Copy(destFile, srcFile)
-	if err != nil {
+	if err := writeTempFile(tmpFile, write); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), dstPath); err != nil {
+		os.Remove(tmpFile.Name())
 		return err
 	}
 
 	return nil
 }
+
+// writeTempFile writes the contents of the temporary file, syncs it to disk and closes it
+func writeTempFile(tmpFile *os.File, write func(tmpFile *os.File) error) error {
+	if err := write(tmpFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	return tmpFile.Close()
+}
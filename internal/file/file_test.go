@@ -1,7 +1,7 @@
 package file
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"os"
 	"path/filepath"
@@ -62,6 +62,16 @@ func createFile(path string, data []byte) error {
 	return nil
 }
 
+func operationPaths(ops []Operation) []string {
+	paths := []string{}
+
+	for _, op := range ops {
+		paths = append(paths, op.Path)
+	}
+
+	return paths
+}
+
 func Test(t *testing.T) { TestingT(t) }
 
 type FileTestSuite struct {
@@ -162,10 +172,10 @@ func (*FileTestSuite) TestHashFileCreatesCorrectHash(c *C) {
 	c.Check(err, IsNil)
 	defer os.Remove(srcFile)
 
-	hashBytes := md5.Sum(srcBytes)
+	hashBytes := sha256.Sum256(srcBytes)
 	hashString := hex.EncodeToString(hashBytes[:])
 
-	testHashString, err := hashFile(srcFile)
+	testHashString, err := hashFile(srcFile, hashers[HashSHA256])
 	c.Check(err, IsNil)
 
 	c.Check(hashString, Equals, testHashString)
@@ -175,7 +185,7 @@ func (*FileTestSuite) TestHashFileReturnsErrorIfFileDoesNotExist(c *C) {
 	baseDir := os.TempDir()
 	srcFile := filepath.Join(baseDir, "src")
 
-	_, err := hashFile(srcFile)
+	_, err := hashFile(srcFile, hashers[DefaultHash])
 	c.Check(err, Not(IsNil))
 }
 
@@ -202,12 +212,12 @@ func (*FileTestSuite) TestGenerateBackupDetailsAddsDirectoriesNotInBackupLocatio
 	srcDir := "/src/"
 	dstDir := "/dst/"
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 2)
-	c.Check(directories, DeepEquals, []string{
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 2)
+	c.Check(operationPaths(plan.Directories), DeepEquals, []string{
 		"dir1",
 		"dir2",
 	})
@@ -236,12 +246,12 @@ func (*FileTestSuite) TestGenerateBackupDetailsAddsFilesNotInBackupLocation(c *C
 	srcDir := "/src/"
 	dstDir := "/dst/"
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, Options{})
 
-	c.Check(files, HasLen, 2)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
-	c.Check(files, DeepEquals, []string{
+	c.Check(plan.Files, HasLen, 2)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{
 		"file1",
 		"file2",
 	})
@@ -287,14 +297,14 @@ func (*FileTestSuite) TestGenerateBackupDetailsAddsSymlinksNotInBackupLocation(c
 	srcDir := baseDir
 	dstDir := "/dst/"
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 2)
-	c.Check(directories, HasLen, 0)
-	c.Check(symlinks, DeepEquals, map[string]string{
-		"symlink1": "target",
-		"symlink2": "target",
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 2)
+	c.Check(plan.Directories, HasLen, 0)
+	c.Check(plan.Symlinks, DeepEquals, []Operation{
+		{Path: "symlink1", Target: "target", Reason: ReasonMissing},
+		{Path: "symlink2", Target: "target", Reason: ReasonMissing},
 	})
 }
 
@@ -336,11 +346,11 @@ func (*FileTestSuite) TestGenerateBackupDetailsDoesNotAddDirectoriesInBackupLoca
 	srcDir := "/src/"
 	dstDir := "/dst/"
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
 }
 
 func (*FileTestSuite) TestGenerateBackupDetailsDoesNotAddFilesInBackupLocation(c *C) {
@@ -381,11 +391,11 @@ func (*FileTestSuite) TestGenerateBackupDetailsDoesNotAddFilesInBackupLocation(c
 	srcDir := "/src/"
 	dstDir := "/dst/"
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
 }
 
 func (f *FileTestSuite) TestGenerateBackupDetailsDoesNotAddSymlinksInBackupLocation(c *C) {
@@ -469,11 +479,11 @@ func (f *FileTestSuite) TestGenerateBackupDetailsDoesNotAddSymlinksInBackupLocat
 		},
 	}
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
 }
 
 func (f *FileTestSuite) TestGenerateBackupDetailsAddsSymlinksThatAreFilesInBackupLocation(c *C) {
@@ -533,13 +543,13 @@ func (f *FileTestSuite) TestGenerateBackupDetailsAddsSymlinksThatAreFilesInBacku
 		},
 	}
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 1)
-	c.Check(directories, HasLen, 0)
-	c.Check(symlinks, DeepEquals, map[string]string{
-		"file1": filepath.Join(f.dstDir, "target"),
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 1)
+	c.Check(plan.Directories, HasLen, 0)
+	c.Check(plan.Symlinks, DeepEquals, []Operation{
+		{Path: "file1", Target: filepath.Join(f.dstDir, "target"), Reason: ReasonLinkDiffers},
 	})
 }
 
@@ -567,13 +577,13 @@ func (f *FileTestSuite) TestGenerateBackupDetailsSymlinksUseOriginalTargetIfTarg
 
 	dstIndex := map[string]os.FileInfo{}
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, Options{})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 1)
-	c.Check(directories, HasLen, 0)
-	c.Check(symlinks, DeepEquals, map[string]string{
-		"symlink1": srcTargetFile,
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 1)
+	c.Check(plan.Directories, HasLen, 0)
+	c.Check(plan.Symlinks, DeepEquals, []Operation{
+		{Path: "symlink1", Target: srcTargetFile, Reason: ReasonMissing},
 	})
 }
 
@@ -615,12 +625,12 @@ func (*FileTestSuite) TestGenerateBackupDetailsAddsFilesWithDifferentSizeInBacku
 	srcDir := "/src/"
 	dstDir := "/dst/"
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, srcDir, dstDir, Options{})
 
-	c.Check(files, HasLen, 2)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
-	c.Check(files, DeepEquals, []string{
+	c.Check(plan.Files, HasLen, 2)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{
 		"file1",
 		"file2",
 	})
@@ -677,12 +687,12 @@ func (f *FileTestSuite) TestGenerateBackupDetailsAddsFilesWithSameSizeDifferentH
 		},
 	}
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, false)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, Options{})
 
-	c.Check(files, HasLen, 2)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
-	c.Check(files, DeepEquals, []string{
+	c.Check(plan.Files, HasLen, 2)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{
 		"file1",
 		"file2",
 	})
@@ -739,9 +749,88 @@ func (f *FileTestSuite) TestGenerateBackupDetailsDoesNotAddFilesWithSameSizeDiff
 		},
 	}
 
-	files, directories, symlinks := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, true)
+	plan := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, Options{SkipHashsum: true})
 
-	c.Check(files, HasLen, 0)
-	c.Check(symlinks, HasLen, 0)
-	c.Check(directories, HasLen, 0)
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Symlinks, HasLen, 0)
+	c.Check(plan.Directories, HasLen, 0)
+}
+
+func (f *FileTestSuite) TestGenerateBackupDetailsRecordsReasons(c *C) {
+	err := createFile(filepath.Join(f.srcDir, "file1"), []byte{'a'})
+	c.Check(err, IsNil)
+
+	err = createFile(filepath.Join(f.dstDir, "file1"), []byte{'b'})
+	c.Check(err, IsNil)
+
+	srcIndex := map[string]os.FileInfo{
+		"dir1": &MockFileInfo{
+			name:    "dir1",
+			size:    1,
+			mode:    os.ModeDir,
+			modTime: time.Now(),
+			isDir:   true,
+		},
+		"file1": &MockFileInfo{
+			name:    "file1",
+			size:    1,
+			mode:    100644,
+			modTime: time.Now(),
+			isDir:   false,
+		},
+		"file2": &MockFileInfo{
+			name:    "file2",
+			size:    2,
+			mode:    100644,
+			modTime: time.Now(),
+			isDir:   false,
+		},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{
+			name:    "file1",
+			size:    1,
+			mode:    100644,
+			modTime: time.Now(),
+			isDir:   false,
+		},
+		"file2": &MockFileInfo{
+			name:    "file2",
+			size:    1,
+			mode:    100644,
+			modTime: time.Now(),
+			isDir:   false,
+		},
+	}
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, f.srcDir, f.dstDir, Options{})
+
+	c.Check(plan.Directories, DeepEquals, []Operation{
+		{Path: "dir1", Reason: ReasonMissing},
+	})
+	c.Check(plan.Files, DeepEquals, []Operation{
+		{Path: "file1", Reason: ReasonHashDiffers},
+		{Path: "file2", Reason: ReasonSizeDiffers},
+	})
+}
+
+func (*FileTestSuite) TestGenerateRemovalsOmitsChildrenOfRemovedDirectories(c *C) {
+	srcIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1"},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"file1":      &MockFileInfo{name: "file1"},
+		"file2":      &MockFileInfo{name: "file2"},
+		"dir1":       &MockFileInfo{name: "dir1", isDir: true},
+		"dir1/file3": &MockFileInfo{name: "file3"},
+	}
+
+	removals := GenerateRemovals(srcIndex, dstIndex)
+
+	c.Check(removals, DeepEquals, []Operation{
+		{Path: "dir1", Reason: ReasonNotInSource},
+		{Path: "file2", Reason: ReasonNotInSource},
+	})
 }
@@ -0,0 +1,100 @@
+package file
+
+import (
+	"os"
+	"sort"
+)
+
+// inode identifies a file by its device and inode numbers
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// linkGroups groups the paths of regular files in the index that share an inode, keyed by each
+// path in the group. Only inodes with more than one path in the index are included. Each group is
+// sorted so that its first path is the one that is copied and the rest are linked to it.
+func linkGroups(index map[string]os.FileInfo) map[string][]string {
+	inodes := map[inode][]string{}
+
+	for path, info := range index {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if id, ok := fileID(info); ok {
+			inodes[id] = append(inodes[id], path)
+		}
+	}
+
+	groups := map[string][]string{}
+	for _, paths := range inodes {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			groups[path] = paths
+		}
+	}
+
+	return groups
+}
+
+// linksChanged reports whether the path is hard linked at the backup location to any path it is
+// not hard linked to at the source
+func linksChanged(path string, srcLinks, dstLinks map[string][]string) bool {
+	members := map[string]bool{path: true}
+	for _, member := range srcLinks[path] {
+		members[member] = true
+	}
+
+	for _, member := range dstLinks[path] {
+		if !members[member] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameInode reports whether both entries are known to be the same file
+func sameInode(a, b os.FileInfo) bool {
+	aID, aOK := fileID(a)
+	bID, bOK := fileID(b)
+
+	return aOK && bOK && aID == bID
+}
+
+// generateLinks determines the hard links to create at the backup location for every group of
+// hard linked source files. The first file of each group is copied as normal, so the rest are
+// linked to it whenever they are missing, are not already linked to it or it is being replaced.
+func generateLinks(srcLinks map[string][]string, dstIndex map[string]os.FileInfo, files []Operation) []Operation {
+	copied := map[string]bool{}
+	for _, op := range files {
+		copied[op.Path] = true
+	}
+
+	links := []Operation{}
+	for path, group := range srcLinks {
+		if group[0] == path {
+			continue
+		}
+
+		leader := group[0]
+		dstFile, ok := dstIndex[path]
+		dstLeader, leaderOK := dstIndex[leader]
+
+		switch {
+		case !ok:
+			links = append(links, Operation{Path: path, Target: leader, Reason: ReasonMissing})
+		case copied[leader]:
+			links = append(links, Operation{Path: path, Target: leader, Reason: ReasonLinkTargetCopied})
+		case !leaderOK || !sameInode(dstFile, dstLeader):
+			links = append(links, Operation{Path: path, Target: leader, Reason: ReasonLinkGroupChanged})
+		}
+	}
+
+	sortOperations(links)
+
+	return links
+}
@@ -0,0 +1,25 @@
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode numbers of a file that has more than one hard link
+func fileID(info os.FileInfo) (inode, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return inode{}, false
+	}
+
+	return inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// linkCount returns the number of hard links to a file
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+
+	return 1
+}
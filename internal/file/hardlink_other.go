@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"os"
+)
+
+// fileID does not identify files on this platform, so hard links are copied as separate files
+func fileID(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+// linkCount does not count hard links on this platform, so every file is treated as having one
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
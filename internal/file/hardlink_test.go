@@ -0,0 +1,77 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type HardLinkTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&HardLinkTestSuite{})
+
+func (h *HardLinkTestSuite) SetUpTest(c *C) {
+	h.srcDir = c.MkDir() + "/"
+	h.dstDir = c.MkDir() + "/"
+}
+
+func (h *HardLinkTestSuite) TestGenerateBackupDetailsCopiesHardLinkedFilesOnce(c *C) {
+	c.Assert(createFile(filepath.Join(h.srcDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(os.Link(filepath.Join(h.srcDir, "file1"), filepath.Join(h.srcDir, "file2")), IsNil)
+	c.Assert(os.Link(filepath.Join(h.srcDir, "file1"), filepath.Join(h.srcDir, "file3")), IsNil)
+
+	plan := GenerateBackupDetails(ScanDirectory(h.srcDir), ScanDirectory(h.dstDir), h.srcDir, h.dstDir, Options{HardLinks: true})
+
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{"file1"})
+	c.Check(plan.Links, DeepEquals, []Operation{
+		{Path: "file2", Target: "file1", Reason: ReasonMissing},
+		{Path: "file3", Target: "file1", Reason: ReasonMissing},
+	})
+
+	plan = GenerateBackupDetails(ScanDirectory(h.srcDir), ScanDirectory(h.dstDir), h.srcDir, h.dstDir, Options{})
+
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{"file1", "file2", "file3"})
+	c.Check(plan.Links, HasLen, 0)
+}
+
+func (h *HardLinkTestSuite) TestApplyRecreatesHardLinks(c *C) {
+	c.Assert(createFile(filepath.Join(h.srcDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(os.Link(filepath.Join(h.srcDir, "file1"), filepath.Join(h.srcDir, "file2")), IsNil)
+
+	plan := GenerateBackupDetails(ScanDirectory(h.srcDir), ScanDirectory(h.dstDir), h.srcDir, h.dstDir, Options{HardLinks: true})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+
+	file1, err := os.Lstat(filepath.Join(h.dstDir, "file1"))
+	c.Assert(err, IsNil)
+	file2, err := os.Lstat(filepath.Join(h.dstDir, "file2"))
+	c.Assert(err, IsNil)
+	c.Check(os.SameFile(file1, file2), Equals, true)
+
+	plan = GenerateBackupDetails(ScanDirectory(h.srcDir), ScanDirectory(h.dstDir), h.srcDir, h.dstDir, Options{HardLinks: true})
+	c.Check(plan.Empty(), Equals, true)
+}
+
+func (h *HardLinkTestSuite) TestGenerateBackupDetailsSplitsFilesNoLongerHardLinked(c *C) {
+	c.Assert(createFile(filepath.Join(h.srcDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(h.srcDir, "file2"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(h.dstDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(os.Link(filepath.Join(h.dstDir, "file1"), filepath.Join(h.dstDir, "file2")), IsNil)
+
+	plan := GenerateBackupDetails(ScanDirectory(h.srcDir), ScanDirectory(h.dstDir), h.srcDir, h.dstDir, Options{HardLinks: true})
+
+	c.Check(plan.Files, DeepEquals, []Operation{
+		{Path: "file1", Reason: ReasonLinkGroupChanged},
+		{Path: "file2", Reason: ReasonLinkGroupChanged},
+	})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+
+	file1, err := os.Lstat(filepath.Join(h.dstDir, "file1"))
+	c.Assert(err, IsNil)
+	file2, err := os.Lstat(filepath.Join(h.dstDir, "file2"))
+	c.Assert(err, IsNil)
+	c.Check(os.SameFile(file1, file2), Equals, false)
+}
@@ -0,0 +1,123 @@
+package file
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// HashSHA256 names the SHA-256 hash algorithm
+	HashSHA256 = "sha256"
+	// HashBLAKE2b names the 256 bit BLAKE2b hash algorithm
+	HashBLAKE2b = "blake2b"
+	// HashXXH3 names the 64 bit xxHash3 algorithm, which is fast but not cryptographically secure
+	HashXXH3 = "xxh3"
+	// DefaultHash names the hash algorithm used when none is chosen
+	DefaultHash = HashSHA256
+)
+
+// Hasher creates the hashes used to compare the contents of files
+type Hasher interface {
+	// Name returns the name the algorithm is chosen and recorded by
+	Name() string
+	// New returns a new hash using the algorithm
+	New() hash.Hash
+}
+
+type hasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func (h hasher) Name() string {
+	return h.name
+}
+
+func (h hasher) New() hash.Hash {
+	return h.newHash()
+}
+
+var hashers = map[string]Hasher{
+	HashSHA256: hasher{name: HashSHA256, newHash: sha256.New},
+	HashBLAKE2b: hasher{name: HashBLAKE2b, newHash: func() hash.Hash {
+		// New256 only fails when given a key longer than 64 bytes
+		h, _ := blake2b.New256(nil)
+		return h
+	}},
+	HashXXH3: hasher{name: HashXXH3, newHash: func() hash.Hash {
+		return xxh3.New()
+	}},
+}
+
+// HashNames returns the names of the available hash algorithms
+func HashNames() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewHasher returns the hasher for the named algorithm, or the default algorithm if the name is
+// empty
+func NewHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DefaultHash
+	}
+
+	h, ok := hashers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q (expected one of %s)", name, strings.Join(HashNames(), ", "))
+	}
+
+	return h, nil
+}
+
+// HashFile returns the hex digest of the contents of the file calculated with the hasher
+func HashFile(path string, hasher Hasher) (string, error) {
+	return hashFile(path, hasher)
+}
+
+// zeros is written to hashes in place of the holes in sparse files
+var zeros = make([]byte, 32*1024)
+
+// teeHash returns a writer that writes to the writer and to the hash, or the writer itself if
+// there is no hash
+func teeHash(w io.Writer, sum hash.Hash) io.Writer {
+	if sum == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, sum)
+}
+
+// hashZeros writes n zero bytes to the hash, if any, so a skipped hole hashes like the zeros it
+// reads as
+func hashZeros(sum hash.Hash, n int64) error {
+	if sum == nil {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+
+		if _, err := sum.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package file
+
+import (
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type HashTestSuite struct{}
+
+var _ = Suite(&HashTestSuite{})
+
+func (*HashTestSuite) TestNewHasherReturnsNamedAlgorithm(c *C) {
+	for _, name := range []string{HashSHA256, HashBLAKE2b, HashXXH3} {
+		h, err := NewHasher(name)
+		c.Assert(err, IsNil)
+		c.Check(h.Name(), Equals, name)
+	}
+
+	h, err := NewHasher("")
+	c.Assert(err, IsNil)
+	c.Check(h.Name(), Equals, DefaultHash)
+
+	_, err = NewHasher("md5")
+	c.Check(err, NotNil)
+}
+
+func (*HashTestSuite) TestHashFileUsesAlgorithm(c *C) {
+	srcFile := filepath.Join(c.MkDir(), "file1")
+	c.Assert(createFile(srcFile, []byte("test")), IsNil)
+
+	expected := map[string]string{
+		HashSHA256:  "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		HashBLAKE2b: "928b20366943e2afd11ebc0eae2e53a93bf177a4fcf35bcc64d503704e65e202",
+		HashXXH3:    "9ec9f7918d7dfc40",
+	}
+
+	for name, sum := range expected {
+		actual, err := hashFile(srcFile, hashers[name])
+		c.Check(err, IsNil)
+		c.Check(actual, Equals, sum, Commentf("%s", name))
+	}
+}
+
+func (*HashTestSuite) TestGenerateBackupDetailsRecordsHashAlgorithm(c *C) {
+	plan := GenerateBackupDetails(nil, nil, c.MkDir(), c.MkDir(), Options{Hash: HashXXH3})
+	c.Check(plan.Options.Hash, Equals, HashXXH3)
+
+	plan = GenerateBackupDetails(nil, nil, c.MkDir(), c.MkDir(), Options{})
+	c.Check(plan.Options.Hash, Equals, DefaultHash)
+}
@@ -0,0 +1,344 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/progress"
+)
+
+// manifestFile is the name of the manifest in the state directory at the backup location
+const manifestFile = "manifest.jsonl"
+
+// Types of manifest entries
+const (
+	ManifestFile    = "file"
+	ManifestDir     = "dir"
+	ManifestSymlink = "symlink"
+)
+
+// ManifestEntry records an entry of the backup location. The digest of a file is the name of the
+// hash algorithm and the hex encoded hash of its contents separated by a colon, and is calculated
+// as the file is copied.
+type ManifestEntry struct {
+	Path    string
+	Type    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Target  string
+	Digest  string
+}
+
+// manifestLine is a manifest entry as written to the manifest. Paths and symlink targets that are
+// not valid UTF-8 cannot be held in JSON strings, so they are written base64 encoded instead.
+type manifestLine struct {
+	Path         string    `json:"path,omitempty"`
+	PathBase64   []byte    `json:"pathBase64,omitempty"`
+	Type         string    `json:"type"`
+	Size         int64     `json:"size"`
+	Mode         string    `json:"mode"`
+	ModTime      time.Time `json:"mtime"`
+	Target       string    `json:"target,omitempty"`
+	TargetBase64 []byte    `json:"targetBase64,omitempty"`
+	Digest       string    `json:"digest,omitempty"`
+}
+
+// MarshalJSON writes the entry as a manifest line
+func (e ManifestEntry) MarshalJSON() ([]byte, error) {
+	line := manifestLine{Type: e.Type, Size: e.Size, Mode: fmt.Sprintf("%04o", unixPermissions(e.Mode)), ModTime: e.ModTime, Digest: e.Digest}
+	if utf8.ValidString(e.Path) {
+		line.Path = e.Path
+	} else {
+		line.PathBase64 = []byte(e.Path)
+	}
+	if utf8.ValidString(e.Target) {
+		line.Target = e.Target
+	} else {
+		line.TargetBase64 = []byte(e.Target)
+	}
+
+	return json.Marshal(line)
+}
+
+// UnmarshalJSON reads the entry from a manifest line
+func (e *ManifestEntry) UnmarshalJSON(data []byte) error {
+	line := manifestLine{}
+	if err := json.Unmarshal(data, &line); err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(line.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %q", line.Mode)
+	}
+
+	*e = ManifestEntry{Path: line.Path, Type: line.Type, Size: line.Size, Mode: fileMode(uint32(mode)), ModTime: line.ModTime, Target: line.Target, Digest: line.Digest}
+	if line.PathBase64 != nil {
+		e.Path = string(line.PathBase64)
+	}
+	if line.TargetBase64 != nil {
+		e.Target = string(line.TargetBase64)
+	}
+	if e.Path == "" {
+		return fmt.Errorf("entry has no path")
+	}
+
+	return nil
+}
+
+// unixPermissions returns the permission bits of the mode as they are written by chmod
+func unixPermissions(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+
+	return bits
+}
+
+// fileMode returns the mode holding the permission bits written by chmod
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits) & os.ModePerm
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+// Manifest records every entry of a backup location by path
+type Manifest map[string]ManifestEntry
+
+// ManifestPath returns the path of the manifest at the backup location
+func ManifestPath(dstDir string) string {
+	return filepath.Join(dstDir, StateDir, manifestFile)
+}
+
+// LoadManifest reads the manifest at the backup location
+func LoadManifest(dstDir string) (Manifest, error) {
+	f, err := os.Open(ManifestPath(dstDir))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := Manifest{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := ManifestEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid manifest line %d: %s", n, err)
+		}
+		manifest[entry.Path] = entry
+	}
+
+	return manifest, scanner.Err()
+}
+
+// Save writes the manifest to the backup location, one entry per line sorted by path
+func (m Manifest) Save(dstDir string) error {
+	path := ManifestPath(dstDir)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	tmpFile, err := createTempFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = writeTempFile(tmpFile, func(tmpFile *os.File) error {
+		w := bufio.NewWriter(tmpFile)
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, p := range paths {
+			if err := enc.Encode(m[p]); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	})
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// digestRecorder collects the digests of the files copied by every job
+type digestRecorder struct {
+	lock    sync.Mutex
+	digests map[string]string
+}
+
+func newDigestRecorder() *digestRecorder {
+	return &digestRecorder{digests: map[string]string{}}
+}
+
+// record stores the hex encoded digest of a copied file, calculated with the algorithm
+func (d *digestRecorder) record(path, algorithm, digest string) {
+	d.set(path, algorithm+":"+digest)
+}
+
+func (d *digestRecorder) set(path, digest string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.digests[path] = digest
+}
+
+func (d *digestRecorder) get(path string) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	digest, ok := d.digests[path]
+
+	return digest, ok
+}
+
+// WriteManifest records every entry of the backup location in its manifest without applying the
+// plan, for a backup location that is already up to date but has no manifest
+func (p *Plan) WriteManifest() error {
+	return p.saveManifest(newDigestRecorder())
+}
+
+// saveManifest records every entry of the backup location in its manifest once the plan has been
+// applied. Copied files take the digest calculated as they were copied, and other files keep the
+// digest recorded in the previous manifest, or in the manifest of the base snapshot for linked
+// files, while their size and modification time are unchanged. Files without a known digest are
+// hashed at the backup location.
+func (p *Plan) saveManifest(digests *digestRecorder) error {
+	previous := []Manifest{}
+	for _, dir := range []string{p.DstDir, p.BaseDir} {
+		if dir == "" {
+			continue
+		}
+		manifest, err := LoadManifest(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logging.Warn("Failed to read manifest of %s, its digests will be recalculated: %s", dir, err)
+			}
+			continue
+		}
+		previous = append(previous, manifest)
+	}
+
+	// Hard links share the digest of the file they link to
+	for _, op := range p.Links {
+		if digest, ok := digests.get(op.Target); ok {
+			digests.set(op.Path, digest)
+		}
+	}
+
+	// Compressed files are recorded with the size of their uncompressed contents
+	index := logicalSizes(p.DstDir, ScanDirectory(p.DstDir))
+
+	hasher := p.Options.hasher()
+	manifest := Manifest{}
+	unknown := []string{}
+
+	for path, info := range index {
+		if isStatePath(path) || isTempFile(path) {
+			continue
+		}
+
+		entry := ManifestEntry{Path: path, Mode: info.Mode() & permissionBits, ModTime: info.ModTime()}
+		switch {
+		case info.IsDir():
+			entry.Type = ManifestDir
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Type = ManifestSymlink
+			target, err := os.Readlink(filepath.Join(p.DstDir, path))
+			if err != nil {
+				return err
+			}
+			entry.Target = target
+		case info.Mode().IsRegular():
+			entry.Type = ManifestFile
+			entry.Size = info.Size()
+			if digest, ok := digests.get(path); ok {
+				entry.Digest = digest
+			} else if digest, ok := recordedDigest(previous, entry); ok {
+				entry.Digest = digest
+			} else {
+				unknown = append(unknown, path)
+			}
+		default:
+			continue
+		}
+
+		manifest[path] = entry
+	}
+
+	if len(unknown) > 0 {
+		logging.Info("Hashing %d files with no recorded digest", len(unknown))
+		bar := progress.Start(len(unknown) + 1)
+		for _, path := range unknown {
+			bar.Increment()
+			digest, err := hashLogicalFile(filepath.Join(p.DstDir, path), hasher)
+			if err != nil {
+				logging.Warn("Failed to hash %s: %s", filepath.Join(p.DstDir, path), err)
+				continue
+			}
+			entry := manifest[path]
+			entry.Digest = hasher.Name() + ":" + digest
+			manifest[path] = entry
+		}
+		bar.Increment()
+		bar.Finish()
+	}
+
+	return manifest.Save(p.DstDir)
+}
+
+// recordedDigest returns the digest of the file recorded in the first manifest that holds it with
+// the same size and modification time
+func recordedDigest(manifests []Manifest, entry ManifestEntry) (string, bool) {
+	for _, manifest := range manifests {
+		previous, ok := manifest[entry.Path]
+		if ok && previous.Type == ManifestFile && previous.Digest != "" && previous.Size == entry.Size && previous.ModTime.Equal(entry.ModTime) {
+			return previous.Digest, true
+		}
+	}
+
+	return "", false
+}
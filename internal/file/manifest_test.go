@@ -0,0 +1,120 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type ManifestTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&ManifestTestSuite{})
+
+func (m *ManifestTestSuite) SetUpTest(c *C) {
+	m.srcDir = c.MkDir() + "/"
+	m.dstDir = c.MkDir() + "/"
+
+	c.Assert(os.Mkdir(filepath.Join(m.srcDir, "docs"), 0750), IsNil)
+	c.Assert(createFile(filepath.Join(m.srcDir, "docs", "a.txt"), []byte("a")), IsNil)
+	c.Assert(createFile(filepath.Join(m.srcDir, "caf\xe9"), []byte("latin-1")), IsNil)
+	c.Assert(os.Symlink("docs/\xff", filepath.Join(m.srcDir, "link")), IsNil)
+}
+
+// backup backs up the source directory, writing the manifest, and returns the manifest
+func (m *ManifestTestSuite) backup(c *C, opts Options) Manifest {
+	plan := GenerateBackupDetails(ScanDirectory(m.srcDir), ScanDirectory(m.dstDir), m.srcDir, m.dstDir, opts)
+	c.Assert(plan.Apply(ApplyOptions{Manifest: true}), IsNil)
+
+	manifest, err := LoadManifest(m.dstDir)
+	c.Assert(err, IsNil)
+
+	return manifest
+}
+
+// digest returns the manifest digest of the contents with the default hash
+func digest(c *C, contents string) string {
+	path := filepath.Join(c.MkDir(), "file")
+	c.Assert(createFile(path, []byte(contents)), IsNil)
+	sum, err := HashFile(path, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+
+	return DefaultHash + ":" + sum
+}
+
+func (m *ManifestTestSuite) TestRecordsEveryEntry(c *C) {
+	manifest := m.backup(c, Options{Archive: true})
+
+	c.Check(manifest, HasLen, 4)
+	c.Check(manifest["docs"].Type, Equals, ManifestDir)
+	c.Check(manifest["docs"].Mode, Equals, os.FileMode(0750))
+
+	info, err := os.Stat(filepath.Join(m.dstDir, "docs", "a.txt"))
+	c.Assert(err, IsNil)
+	c.Check(manifest["docs/a.txt"], DeepEquals, ManifestEntry{
+		Path:    "docs/a.txt",
+		Type:    ManifestFile,
+		Size:    1,
+		Mode:    info.Mode().Perm(),
+		ModTime: manifest["docs/a.txt"].ModTime,
+		Digest:  digest(c, "a"),
+	})
+	c.Check(manifest["docs/a.txt"].ModTime.Equal(info.ModTime()), Equals, true)
+
+	// Names that are not valid UTF-8 are kept exactly
+	c.Check(manifest["caf\xe9"].Digest, Equals, digest(c, "latin-1"))
+	c.Check(manifest["link"].Type, Equals, ManifestSymlink)
+	c.Check(manifest["link"].Target, Equals, "docs/\xff")
+
+	data, err := ioutil.ReadFile(ManifestPath(m.dstDir))
+	c.Assert(err, IsNil)
+	c.Check(strings.Count(string(data), "\n"), Equals, 4)
+	c.Check(strings.Contains(string(data), `"pathBase64":"Y2Fm6Q=="`), Equals, true)
+}
+
+func (m *ManifestTestSuite) TestKeepsDigestsOfUnchangedFiles(c *C) {
+	manifest := m.backup(c, Options{})
+
+	// A recorded digest is trusted while the backed up file keeps its size and modification time
+	entry := manifest["docs/a.txt"]
+	entry.Digest = "sha256:recorded"
+	manifest["docs/a.txt"] = entry
+	c.Assert(manifest.Save(m.dstDir), IsNil)
+
+	c.Assert(createFile(filepath.Join(m.srcDir, "caf\xe9"), []byte("changed")), IsNil)
+	manifest = m.backup(c, Options{})
+
+	c.Check(manifest["docs/a.txt"].Digest, Equals, "sha256:recorded")
+	c.Check(manifest["caf\xe9"].Digest, Equals, digest(c, "changed"))
+}
+
+func (m *ManifestTestSuite) TestHashesFilesWithoutDigest(c *C) {
+	plan := GenerateBackupDetails(ScanDirectory(m.srcDir), ScanDirectory(m.dstDir), m.srcDir, m.dstDir, Options{})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+	_, err := LoadManifest(m.dstDir)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	manifest := m.backup(c, Options{Hash: HashXXH3})
+	sum, err := HashFile(filepath.Join(m.dstDir, "docs", "a.txt"), hashers[HashXXH3])
+	c.Assert(err, IsNil)
+	c.Check(manifest["docs/a.txt"].Digest, Equals, HashXXH3+":"+sum)
+}
+
+func (m *ManifestTestSuite) TestWritesManifestOfUpToDateLocation(c *C) {
+	plan := GenerateBackupDetails(ScanDirectory(m.srcDir), ScanDirectory(m.dstDir), m.srcDir, m.dstDir, Options{})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+
+	plan = GenerateBackupDetails(ScanDirectory(m.srcDir), ScanDirectory(m.dstDir), m.srcDir, m.dstDir, Options{})
+	c.Assert(plan.Empty(), Equals, true)
+	c.Assert(plan.WriteManifest(), IsNil)
+
+	manifest, err := LoadManifest(m.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest, HasLen, 4)
+	c.Check(manifest["docs/a.txt"].Digest, Equals, digest(c, "a"))
+}
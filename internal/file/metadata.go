@@ -0,0 +1,110 @@
+package file
+
+import (
+	"os"
+	"time"
+
+	"github.com/samphillips/backup/internal/logging"
+)
+
+// permissionBits are the mode bits preserved in archive mode
+const permissionBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// mtimeDiffers reports whether the modification times of the entries differ by more than the
+// window
+func mtimeDiffers(srcFile, dstFile os.FileInfo, window time.Duration) bool {
+	diff := srcFile.ModTime().Sub(dstFile.ModTime())
+	if diff < 0 {
+		diff = -diff
+	}
+
+	return diff > window
+}
+
+// metadataDiffers reports whether the permissions, ownership or modification time of the
+// destination entry differ from the source entry
+func metadataDiffers(srcFile, dstFile os.FileInfo, window time.Duration) bool {
+	if srcFile.Mode()&os.ModeSymlink == 0 && srcFile.Mode()&permissionBits != dstFile.Mode()&permissionBits {
+		return true
+	}
+
+	if mtimeDiffers(srcFile, dstFile, window) {
+		return true
+	}
+
+	if os.Geteuid() == 0 {
+		srcUID, srcGID, srcOK := ownership(srcFile)
+		dstUID, dstGID, dstOK := ownership(dstFile)
+		if srcOK && dstOK && (srcUID != dstUID || srcGID != dstGID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// metadataReason returns the reason the metadata of the destination entry needs updating, or an
+// empty string if the metadata preserved by the options is unchanged
+func metadataReason(srcPath, dstPath string, srcFile, dstFile os.FileInfo, opts Options) string {
+	if opts.Archive && metadataDiffers(srcFile, dstFile, opts.ModifyWindow) {
+		return ReasonMetadataDiffers
+	}
+
+	// Extended attributes are only read from source directories
+	if (opts.Xattrs || opts.ACLs) && opts.Source == nil {
+		differ, err := xattrsDiffer(srcPath, dstPath, opts)
+		if err != nil {
+			logging.Warn("Could not compare extended attributes of %s: %s", srcPath, err)
+			return ""
+		}
+		if differ {
+			return ReasonXattrsDiffer
+		}
+	}
+
+	return ""
+}
+
+// CopyMetadata applies the metadata of the source entry selected by the options to the
+// destination entry. Archive mode copies permissions, ownership (when running as root) and access
+// and modification times, and quick check and digest modes copy the times of regular files.
+// Symlinks are not followed.
+func CopyMetadata(srcPath, dstPath string, opts Options) error {
+	srcFile, err := os.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	if opts.Archive && os.Geteuid() == 0 {
+		if uid, gid, ok := ownership(srcFile); ok {
+			if err := os.Lchown(dstPath, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Extended attributes are copied before the permissions as setting an access ACL also changes
+	// the group permission bits
+	if opts.Xattrs || opts.ACLs {
+		if err := copyXattrs(srcPath, dstPath, opts); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Archive {
+		// Quick checks and recorded digests compare modification times, so copied files must keep them
+		if opts.preservesModTime() && srcFile.Mode().IsRegular() {
+			return setTimes(dstPath, accessTime(srcFile), srcFile.ModTime())
+		}
+		return nil
+	}
+
+	// Symlink permissions cannot be changed on most platforms and chmod would follow the link
+	if srcFile.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(dstPath, srcFile.Mode()&permissionBits); err != nil {
+			return err
+		}
+	}
+
+	return setTimes(dstPath, accessTime(srcFile), srcFile.ModTime())
+}
@@ -0,0 +1,43 @@
+package file
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ownership returns the uid and gid of the file, if available, including for entries of tar
+// archives
+func ownership(info os.FileInfo) (int, int, bool) {
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return int(sys.Uid), int(sys.Gid), true
+	case *tar.Header:
+		return sys.Uid, sys.Gid, true
+	}
+
+	return 0, 0, false
+}
+
+// accessTime returns the last access time of the file, falling back to the modification time
+func accessTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+
+	return time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+}
+
+// setTimes sets the access and modification times of the path without following symlinks
+func setTimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"os"
+	"time"
+)
+
+// ownership returns the uid and gid of the file, which are not available on this platform
+func ownership(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// accessTime returns the modification time of the file as access times are not available on
+// this platform
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// setTimes sets the access and modification times of the path. Symlinks are left untouched as
+// they cannot be updated without following them on this platform.
+func setTimes(path string, atime, mtime time.Time) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	return os.Chtimes(path, atime, mtime)
+}
@@ -0,0 +1,156 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetadataTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&MetadataTestSuite{})
+
+func (m *MetadataTestSuite) SetUpTest(c *C) {
+	m.srcDir = c.MkDir()
+	m.dstDir = c.MkDir()
+}
+
+func (m *MetadataTestSuite) TestCopyMetadataCopiesModeAndTimes(c *C) {
+	srcFile := filepath.Join(m.srcDir, "file1")
+	dstFile := filepath.Join(m.dstDir, "file1")
+	modTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c.Assert(createFile(srcFile, []byte{'a'}), IsNil)
+	c.Assert(createFile(dstFile, []byte{'a'}), IsNil)
+	c.Assert(os.Chmod(srcFile, 0750), IsNil)
+	c.Assert(os.Chtimes(srcFile, modTime, modTime), IsNil)
+
+	err := CopyMetadata(srcFile, dstFile, Options{Archive: true})
+	c.Check(err, IsNil)
+
+	info, err := os.Stat(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0750))
+	c.Check(info.ModTime().Equal(modTime), Equals, true)
+}
+
+func (m *MetadataTestSuite) TestCopyMetadataDoesNotFollowSymlinks(c *C) {
+	target := filepath.Join(m.dstDir, "target")
+	srcLink := filepath.Join(m.srcDir, "link")
+	dstLink := filepath.Join(m.dstDir, "link")
+	modTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c.Assert(createFile(target, []byte{'a'}), IsNil)
+	c.Assert(os.Symlink("target", srcLink), IsNil)
+	c.Assert(os.Symlink("target", dstLink), IsNil)
+	c.Assert(setTimes(srcLink, modTime, modTime), IsNil)
+
+	before, err := os.Stat(target)
+	c.Assert(err, IsNil)
+
+	err = CopyMetadata(srcLink, dstLink, Options{Archive: true})
+	c.Check(err, IsNil)
+
+	after, err := os.Stat(target)
+	c.Assert(err, IsNil)
+	c.Check(after.ModTime(), Equals, before.ModTime())
+}
+
+func (m *MetadataTestSuite) TestGenerateBackupDetailsAddsMetadataDifferencesInArchiveMode(c *C) {
+	c.Assert(createFile(filepath.Join(m.srcDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(m.dstDir, "file1"), []byte{'a'}), IsNil)
+
+	srcIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0755, modTime: time.Unix(1, 0)},
+		"dir1":  &MockFileInfo{name: "dir1", mode: os.ModeDir | 0755, modTime: time.Unix(1, 0), isDir: true},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: time.Unix(1, 0)},
+		"dir1":  &MockFileInfo{name: "dir1", mode: os.ModeDir | 0755, modTime: time.Unix(2, 0), isDir: true},
+	}
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, m.srcDir, m.dstDir, Options{})
+	c.Check(plan.Metadata, HasLen, 0)
+
+	plan = GenerateBackupDetails(srcIndex, dstIndex, m.srcDir, m.dstDir, Options{Archive: true})
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Metadata, DeepEquals, []Operation{
+		{Path: "dir1", Reason: ReasonMetadataDiffers},
+		{Path: "file1", Reason: ReasonMetadataDiffers},
+	})
+}
+
+func (m *MetadataTestSuite) TestGenerateBackupDetailsQuickCheckComparesSizeAndModTime(c *C) {
+	for _, name := range []string{"same", "touched", "changed"} {
+		c.Assert(createFile(filepath.Join(m.srcDir, name), []byte{'a'}), IsNil)
+		c.Assert(createFile(filepath.Join(m.dstDir, name), []byte{'b'}), IsNil)
+	}
+
+	srcIndex := map[string]os.FileInfo{
+		"same":    &MockFileInfo{name: "same", size: 1, mode: 0644, modTime: time.Unix(10, 0)},
+		"touched": &MockFileInfo{name: "touched", size: 1, mode: 0644, modTime: time.Unix(10, 0)},
+		"changed": &MockFileInfo{name: "changed", size: 2, mode: 0644, modTime: time.Unix(10, 0)},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"same":    &MockFileInfo{name: "same", size: 1, mode: 0644, modTime: time.Unix(11, 0)},
+		"touched": &MockFileInfo{name: "touched", size: 1, mode: 0644, modTime: time.Unix(20, 0)},
+		"changed": &MockFileInfo{name: "changed", size: 1, mode: 0644, modTime: time.Unix(10, 0)},
+	}
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, m.srcDir, m.dstDir, Options{QuickCheck: true, ModifyWindow: 2 * time.Second})
+	c.Check(plan.Files, DeepEquals, []Operation{
+		{Path: "changed", Reason: ReasonSizeDiffers},
+		{Path: "touched", Reason: ReasonMtimeDiffers},
+	})
+	c.Check(plan.Metadata, HasLen, 0)
+
+	plan = GenerateBackupDetails(srcIndex, dstIndex, m.srcDir, m.dstDir, Options{QuickCheck: true})
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{"changed", "same", "touched"})
+}
+
+func (m *MetadataTestSuite) TestGenerateBackupDetailsQuickCheckHashesModTimeChanges(c *C) {
+	c.Assert(createFile(filepath.Join(m.srcDir, "equal"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(m.dstDir, "equal"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(m.srcDir, "differs"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(m.dstDir, "differs"), []byte{'b'}), IsNil)
+
+	srcIndex := map[string]os.FileInfo{
+		"equal":   &MockFileInfo{name: "equal", size: 1, mode: 0644, modTime: time.Unix(10, 0)},
+		"differs": &MockFileInfo{name: "differs", size: 1, mode: 0644, modTime: time.Unix(10, 0)},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"equal":   &MockFileInfo{name: "equal", size: 1, mode: 0644, modTime: time.Unix(20, 0)},
+		"differs": &MockFileInfo{name: "differs", size: 1, mode: 0644, modTime: time.Unix(20, 0)},
+	}
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, m.srcDir, m.dstDir, Options{QuickCheck: true, HashMtimeChanges: true})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "differs", Reason: ReasonHashDiffers}})
+	c.Check(plan.Metadata, DeepEquals, []Operation{{Path: "equal", Reason: ReasonMtimeDiffers}})
+}
+
+func (m *MetadataTestSuite) TestCopyMetadataPreservesModTimeInQuickCheckMode(c *C) {
+	srcFile := filepath.Join(m.srcDir, "file1")
+	dstFile := filepath.Join(m.dstDir, "file1")
+	modTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c.Assert(createFile(srcFile, []byte{'a'}), IsNil)
+	c.Assert(createFile(dstFile, []byte{'a'}), IsNil)
+	c.Assert(os.Chmod(srcFile, 0750), IsNil)
+	c.Assert(os.Chtimes(srcFile, modTime, modTime), IsNil)
+
+	err := CopyMetadata(srcFile, dstFile, Options{QuickCheck: true})
+	c.Check(err, IsNil)
+
+	info, err := os.Stat(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(info.ModTime().Equal(modTime), Equals, true)
+	c.Check(info.Mode().Perm(), Not(Equals), os.FileMode(0750))
+}
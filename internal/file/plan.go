@@ -0,0 +1,129 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Operation is a single pending change to the backup location
+type Operation struct {
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Plan holds every pending operation needed to bring the backup location up to date with the
+// source location
+type Plan struct {
+	SrcDir      string      `json:"srcDir"`
+	DstDir      string      `json:"dstDir"`
+	BaseDir     string      `json:"baseDir,omitempty"`
+	Created     time.Time   `json:"created"`
+	Fingerprint string      `json:"fingerprint"`
+	Options     Options     `json:"options"`
+	Directories []Operation `json:"directories"`
+	Files       []Operation `json:"files"`
+	Reuse       []Operation `json:"reuse"`
+	Symlinks    []Operation `json:"symlinks"`
+	Links       []Operation `json:"links"`
+	Metadata    []Operation `json:"metadata"`
+	Removals    []Operation `json:"removals"`
+}
+
+// LoadPlan reads a plan previously written by Save
+func LoadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %s", path, err)
+	}
+
+	return p, nil
+}
+
+// Save writes the plan to the given path as JSON
+func (p *Plan) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// AddRemovals adds removal operations to the plan, keeping the removals sorted by path
+func (p *Plan) AddRemovals(ops []Operation) {
+	p.Removals = append(p.Removals, ops...)
+	sortOperations(p.Removals)
+}
+
+// Empty reports whether the plan contains no operations
+func (p *Plan) Empty() bool {
+	return len(p.Directories) == 0 && len(p.Files) == 0 && len(p.Reuse) == 0 && len(p.Symlinks) == 0 &&
+		len(p.Links) == 0 && len(p.Metadata) == 0 && len(p.Removals) == 0
+}
+
+// Report writes a human readable summary of every operation in the plan and the reason for it
+func (p *Plan) Report(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, op := range p.Directories {
+		fmt.Fprintf(w, "mkdir\t%s\t(%s)\n", op.Path, op.Reason)
+	}
+	for _, op := range p.Files {
+		fmt.Fprintf(w, "copy\t%s\t(%s)\n", op.Path, op.Reason)
+	}
+	for _, op := range p.Reuse {
+		fmt.Fprintf(w, "reuse\t%s\t(%s)\n", op.Path, op.Reason)
+	}
+	for _, op := range p.Symlinks {
+		fmt.Fprintf(w, "symlink\t%s -> %s\t(%s)\n", op.Path, op.Target, op.Reason)
+	}
+	for _, op := range p.Links {
+		fmt.Fprintf(w, "link\t%s => %s\t(%s)\n", op.Path, op.Target, op.Reason)
+	}
+	for _, op := range p.Metadata {
+		fmt.Fprintf(w, "metadata\t%s\t(%s)\n", op.Path, op.Reason)
+	}
+	for _, op := range p.Removals {
+		fmt.Fprintf(w, "delete\t%s\t(%s)\n", op.Path, op.Reason)
+	}
+
+	return w.Flush()
+}
+
+// Fingerprint generates a digest of the path, mode, size and modification time of every entry in
+// the index, so that a plan can detect whether its source has changed since it was generated
+func Fingerprint(index map[string]os.FileInfo) string {
+	paths := make([]string, 0, len(index))
+	for path := range index {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	for _, path := range paths {
+		info := index[path]
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%d\n", path, info.Mode(), info.Size(), info.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// sortOperations sorts the operations by path
+func sortOperations(ops []Operation) {
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Path < ops[j].Path
+	})
+}
@@ -0,0 +1,69 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type PlanTestSuite struct{}
+
+var _ = Suite(&PlanTestSuite{})
+
+func (*PlanTestSuite) TestSaveAndLoadPlanRoundTrips(c *C) {
+	planFile := filepath.Join(c.MkDir(), "plan.json")
+
+	plan := &Plan{
+		SrcDir:      "/src/",
+		DstDir:      "/dst/",
+		Created:     time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+		Fingerprint: "abc",
+		Options:     Options{Archive: true},
+		Directories: []Operation{{Path: "dir1", Reason: ReasonMissing}},
+		Files:       []Operation{{Path: "dir1/file1", Reason: ReasonSizeDiffers}},
+		Symlinks:    []Operation{{Path: "link", Target: "dir1/file1", Reason: ReasonMissing}},
+		Metadata:    []Operation{{Path: "dir1", Reason: ReasonMetadataDiffers}},
+		Removals:    []Operation{{Path: "old", Reason: ReasonNotInSource}},
+	}
+
+	err := plan.Save(planFile)
+	c.Check(err, IsNil)
+
+	loaded, err := LoadPlan(planFile)
+	c.Check(err, IsNil)
+	c.Check(loaded, DeepEquals, plan)
+}
+
+func (*PlanTestSuite) TestLoadPlanErrorsOnInvalidFile(c *C) {
+	planFile := filepath.Join(c.MkDir(), "plan.json")
+
+	err := createFile(planFile, []byte("not json"))
+	c.Check(err, IsNil)
+
+	_, err = LoadPlan(planFile)
+	c.Check(err, Not(IsNil))
+}
+
+func (*PlanTestSuite) TestFingerprintChangesWhenSourceChanges(c *C) {
+	modTime := time.Now()
+
+	index := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: modTime},
+	}
+	same := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: modTime},
+	}
+	resized := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 2, mode: 0644, modTime: modTime},
+	}
+	added := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: modTime},
+		"file2": &MockFileInfo{name: "file2", size: 1, mode: 0644, modTime: modTime},
+	}
+
+	c.Check(Fingerprint(index), Equals, Fingerprint(same))
+	c.Check(Fingerprint(index), Not(Equals), Fingerprint(resized))
+	c.Check(Fingerprint(index), Not(Equals), Fingerprint(added))
+}
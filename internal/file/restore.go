@@ -0,0 +1,449 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/progress"
+)
+
+// Policies for restoring an entry over a path that already exists in the restore target
+const (
+	// ConflictSkip leaves the existing path alone and does not restore the entry
+	ConflictSkip = "skip"
+	// ConflictOverwrite replaces the existing path with the restored entry
+	ConflictOverwrite = "overwrite"
+	// ConflictRename restores the entry alongside the existing path under a new name
+	ConflictRename = "rename"
+)
+
+// Reasons an entry is or is not restored
+const (
+	// ReasonExistsSkipped marks an entry not restored because the path already exists
+	ReasonExistsSkipped = "exists, skipped"
+	// ReasonExistsOverwritten marks an entry restored over a path that already exists
+	ReasonExistsOverwritten = "exists, overwritten"
+	// ReasonExistsRenamed marks an entry restored under a new name as the path already exists
+	ReasonExistsRenamed = "exists, renamed"
+)
+
+// renamedSuffix is added to the name of an entry restored alongside an existing path
+const renamedSuffix = ".restored"
+
+// RestoreSource is a backup that entries can be restored from
+type RestoreSource interface {
+	// Index returns every entry in the backup by path, in the form returned by ScanDirectory
+	Index() (map[string]os.FileInfo, error)
+	// Open opens a regular file in the backup for reading
+	Open(path string) (io.ReadCloser, error)
+	// Readlink returns the target of a symlink in the backup
+	Readlink(path string) (string, error)
+	// RestoreMetadata applies the metadata of the entry selected by the options to the restored
+	// path
+	RestoreMetadata(path, dstPath string, opts Options) error
+}
+
+// dirSource restores from a backup location or snapshot directory
+type dirSource struct {
+	dir string
+}
+
+// NewDirSource returns a source that restores from the backup location or snapshot directory
+func NewDirSource(dir string) RestoreSource {
+	return dirSource{dir: withTrailingSlash(dir)}
+}
+
+func (d dirSource) Index() (map[string]os.FileInfo, error) {
+	index := ScanDirectory(d.dir)
+	for path := range index {
+		if isStatePath(path) || isTempFile(path) {
+			delete(index, path)
+		}
+	}
+
+	return index, nil
+}
+
+// Open opens the file for reading its contents, decompressing it if it was compressed when it was
+// backed up
+func (d dirSource) Open(path string) (io.ReadCloser, error) {
+	return openLogical(filepath.Join(d.dir, path))
+}
+
+func (d dirSource) Readlink(path string) (string, error) {
+	return os.Readlink(filepath.Join(d.dir, path))
+}
+
+func (d dirSource) RestoreMetadata(path, dstPath string, opts Options) error {
+	return CopyMetadata(filepath.Join(d.dir, path), dstPath, opts)
+}
+
+// RestoreOptions controls which entries are restored and how
+type RestoreOptions struct {
+	// Paths are the paths or glob patterns of the entries to restore, along with everything below
+	// them. Every entry is restored when there are none.
+	Paths []string
+	// Conflict is the policy for entries whose path already exists in the target
+	Conflict string
+	// Metadata selects the metadata restored with each entry
+	Metadata Options
+	// Jobs is the number of entries restored concurrently, at least one
+	Jobs int
+}
+
+// RestorePlan holds the entries to restore from a backup to a target directory. Each operation's
+// path is the path of the entry in the backup, and its target is the path it is restored to when
+// that differs.
+type RestorePlan struct {
+	TargetDir   string
+	Options     RestoreOptions
+	Directories []Operation
+	Files       []Operation
+	Symlinks    []Operation
+	Skipped     []Operation
+
+	source RestoreSource
+}
+
+// PlanRestore determines the entries to restore from the source to the target directory, and
+// what to do with those whose path already exists in the target. Directories that already exist
+// are restored into, so only files and symlinks are renamed.
+func PlanRestore(source RestoreSource, targetDir string, opts RestoreOptions) (*RestorePlan, error) {
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictSkip
+	}
+	if opts.Conflict != ConflictSkip && opts.Conflict != ConflictOverwrite && opts.Conflict != ConflictRename {
+		return nil, fmt.Errorf("unknown conflict policy %q (expected one of %s, %s, %s)", opts.Conflict, ConflictSkip, ConflictOverwrite, ConflictRename)
+	}
+
+	index, err := source.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := selectPaths(index, opts.Paths)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &RestorePlan{
+		TargetDir:   withTrailingSlash(targetDir),
+		Options:     opts,
+		Directories: []Operation{},
+		Files:       []Operation{},
+		Symlinks:    []Operation{},
+		Skipped:     []Operation{},
+		source:      source,
+	}
+
+	// Parents sort before their children, so a renamed or skipped directory is always seen first
+	targets := map[string]string{}
+	claimed := map[string]bool{}
+	skipped := map[string]bool{}
+	for _, path := range paths {
+		parent := filepath.Dir(path)
+		if skipped[parent] {
+			skipped[path] = true
+			continue
+		}
+
+		target := path
+		if parentTarget, ok := targets[parent]; ok {
+			target = filepath.Join(parentTarget, filepath.Base(path))
+		}
+		targets[path] = target
+
+		info := index[path]
+		existing, err := os.Lstat(filepath.Join(p.TargetDir, target))
+		exists := err == nil
+
+		op := Operation{Path: path, Reason: ReasonMissing}
+		switch {
+		case !exists:
+		case info.IsDir() && existing.IsDir():
+			if opts.Conflict != ConflictOverwrite {
+				continue
+			}
+			op.Reason = ReasonExistsOverwritten
+		case opts.Conflict == ConflictSkip:
+			logging.Debug("Skipping %s as %s already exists", path, target)
+			p.Skipped = append(p.Skipped, Operation{Path: path, Reason: ReasonExistsSkipped})
+			skipped[path] = true
+			continue
+		case opts.Conflict == ConflictOverwrite:
+			op.Reason = ReasonExistsOverwritten
+		case opts.Conflict == ConflictRename:
+			target = p.freeName(target, claimed)
+			targets[path] = target
+			op.Reason = ReasonExistsRenamed
+		}
+
+		claimed[target] = true
+		if target != path {
+			op.Target = target
+		}
+
+		switch {
+		case info.IsDir():
+			p.Directories = append(p.Directories, op)
+		case info.Mode()&os.ModeSymlink != 0:
+			p.Symlinks = append(p.Symlinks, op)
+		case info.Mode().IsRegular():
+			p.Files = append(p.Files, op)
+		default:
+			logging.Warn("Not restoring %s as it is not a regular file, directory or symlink", path)
+		}
+	}
+
+	return p, nil
+}
+
+// selectPaths returns the sorted paths in the index that match any of the patterns, or are below a
+// path that does. Every path is selected when there are no patterns.
+func selectPaths(index map[string]os.FileInfo, patterns []string) ([]string, error) {
+	cleaned := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		cleaned[i] = strings.Trim(filepath.Clean("/"+pattern), "/")
+		if _, err := filepath.Match(cleaned[i], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+	}
+
+	matched := make([]bool, len(patterns))
+	paths := []string{}
+	for path := range index {
+		if len(patterns) == 0 {
+			paths = append(paths, path)
+			continue
+		}
+
+		selected := false
+		for i, pattern := range cleaned {
+			for p := path; p != "." && p != "/"; p = filepath.Dir(p) {
+				if ok, _ := filepath.Match(pattern, p); ok || pattern == "" {
+					matched[i] = true
+					selected = true
+					break
+				}
+			}
+		}
+		if selected {
+			paths = append(paths, path)
+		}
+	}
+
+	for i, pattern := range patterns {
+		if !matched[i] {
+			return nil, fmt.Errorf("nothing in the backup matches %s", pattern)
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// freeName returns the first name alongside the path, made by adding a suffix to it, that neither
+// exists in the target directory nor has been claimed by another restored entry
+func (p *RestorePlan) freeName(path string, claimed map[string]bool) string {
+	for n := 1; ; n++ {
+		name := path + renamedSuffix
+		if n > 1 {
+			name = fmt.Sprintf("%s%s-%d", path, renamedSuffix, n)
+		}
+
+		if _, err := os.Lstat(filepath.Join(p.TargetDir, name)); os.IsNotExist(err) && !claimed[name] {
+			return name
+		}
+	}
+}
+
+// Empty reports whether the plan restores nothing
+func (p *RestorePlan) Empty() bool {
+	return len(p.Directories) == 0 && len(p.Files) == 0 && len(p.Symlinks) == 0
+}
+
+// Report writes a human readable summary of every entry to restore, or skip, and why
+func (p *RestorePlan) Report(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, ops := range []struct {
+		action string
+		ops    []Operation
+	}{{"mkdir", p.Directories}, {"restore", p.Files}, {"symlink", p.Symlinks}, {"skip", p.Skipped}} {
+		for _, op := range ops.ops {
+			if op.Target != "" {
+				fmt.Fprintf(w, "%s\t%s => %s\t(%s)\n", ops.action, op.Path, op.Target, op.Reason)
+			} else {
+				fmt.Fprintf(w, "%s\t%s\t(%s)\n", ops.action, op.Path, op.Reason)
+			}
+		}
+	}
+
+	return w.Flush()
+}
+
+// Apply restores every entry in the plan. Failed entries are logged and the remaining entries are
+// still restored. The metadata of directories is restored last, deepest first, so that restoring
+// their contents cannot change it again.
+func (p *RestorePlan) Apply() error {
+	jobs := p.Options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	failed := 0
+
+	logging.Info("Creating directories")
+	bar := progress.Start(len(p.Directories) + 1)
+	for _, level := range byDepth(p.Directories, false) {
+		failed += runParallel(level, jobs, bar, p.restoreDirectory)
+	}
+	bar.Increment()
+	bar.Finish()
+
+	logging.Info("Restoring files")
+	stats := &transferStats{}
+	bar = progress.Start(len(p.Files) + 1)
+	failed += runParallel(p.Files, jobs, bar, func(op Operation) int {
+		return p.restoreFile(op, stats)
+	})
+	bar.Increment()
+	bar.Finish()
+
+	if len(p.Files) > 0 {
+		logging.Info("Restored %d bytes", stats.size)
+	}
+
+	if len(p.Symlinks) > 0 {
+		logging.Info("Restoring symlinks")
+		bar = progress.Start(len(p.Symlinks) + 1)
+		failed += runParallel(p.Symlinks, jobs, bar, p.restoreSymlink)
+		bar.Increment()
+		bar.Finish()
+	}
+
+	if len(p.Directories) > 0 {
+		logging.Info("Restoring directory metadata")
+		bar = progress.Start(len(p.Directories) + 1)
+		for _, level := range byDepth(p.Directories, true) {
+			failed += runParallel(level, jobs, bar, p.restoreMetadata)
+		}
+		bar.Increment()
+		bar.Finish()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be restored", failed)
+	}
+
+	return nil
+}
+
+// targetPath returns the path the entry is restored to
+func (p *RestorePlan) targetPath(op Operation) string {
+	if op.Target != "" {
+		return filepath.Join(p.TargetDir, op.Target)
+	}
+
+	return filepath.Join(p.TargetDir, op.Path)
+}
+
+// restoreDirectory creates a directory in the target, replacing any file in its way when
+// overwriting, and returns the number of failures
+func (p *RestorePlan) restoreDirectory(op Operation) int {
+	dstPath := p.targetPath(op)
+	logging.Debug("Creating directory %s", dstPath)
+
+	if info, err := os.Lstat(dstPath); err == nil && !info.IsDir() {
+		if err := os.Remove(dstPath); err != nil {
+			logging.Error("Failed to replace %s with a directory: %s", dstPath, err)
+			return 1
+		}
+	}
+
+	if err := os.MkdirAll(dstPath, os.ModePerm); err != nil {
+		logging.Error("Failed to create directory %s: %s", dstPath, err)
+		return 1
+	}
+
+	return 0
+}
+
+// restoreFile restores a file to the target, replacing any existing file at its path without
+// leaving it partially written, and returns the number of failures
+func (p *RestorePlan) restoreFile(op Operation, stats *transferStats) int {
+	dstPath := p.targetPath(op)
+	logging.Debug("Restoring %s to %s", op.Path, dstPath)
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		logging.Error("Failed to create directory %s: %s", filepath.Dir(dstPath), err)
+		return 1
+	}
+
+	r, err := p.source.Open(op.Path)
+	if err != nil {
+		logging.Error("Failed to read %s from the backup: %s", op.Path, err)
+		return 1
+	}
+	defer r.Close()
+
+	var n int64
+	err = replaceFile(dstPath, func(tmpFile *os.File) error {
+		n, err = io.Copy(tmpFile, r)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to restore %s: %s", dstPath, err)
+		return 1
+	}
+	stats.add(n, n)
+
+	return p.restoreMetadata(op)
+}
+
+// restoreSymlink restores a symlink to the target, replacing any existing entry at its path, and
+// returns the number of failures
+func (p *RestorePlan) restoreSymlink(op Operation) int {
+	dstPath := p.targetPath(op)
+
+	target, err := p.source.Readlink(op.Path)
+	if err != nil {
+		logging.Error("Failed to read symlink %s from the backup: %s", op.Path, err)
+		return 1
+	}
+
+	logging.Debug("Restoring symlink to %s at %s", target, dstPath)
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		logging.Error("Failed to create directory %s: %s", filepath.Dir(dstPath), err)
+		return 1
+	}
+	if _, err := os.Lstat(dstPath); err == nil {
+		if err := os.Remove(dstPath); err != nil {
+			logging.Error("Failed to replace %s: %s", dstPath, err)
+			return 1
+		}
+	}
+
+	if err := os.Symlink(target, dstPath); err != nil {
+		logging.Error("Failed to restore symlink %s: %s", dstPath, err)
+		return 1
+	}
+
+	return p.restoreMetadata(op)
+}
+
+// restoreMetadata restores the metadata of an entry, returning the number of failures
+func (p *RestorePlan) restoreMetadata(op Operation) int {
+	if err := p.source.RestoreMetadata(op.Path, p.targetPath(op), p.Options.Metadata); err != nil {
+		logging.Error("Failed to restore metadata of %s: %s", p.targetPath(op), err)
+		return 1
+	}
+
+	return 0
+}
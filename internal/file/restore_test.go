@@ -0,0 +1,112 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RestoreTestSuite struct {
+	backupDir string
+	targetDir string
+}
+
+var _ = Suite(&RestoreTestSuite{})
+
+func (r *RestoreTestSuite) SetUpTest(c *C) {
+	r.backupDir = c.MkDir() + "/"
+	r.targetDir = c.MkDir() + "/"
+
+	c.Assert(os.MkdirAll(filepath.Join(r.backupDir, "docs", "old"), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(r.backupDir, "docs", "a.txt"), []byte("a")), IsNil)
+	c.Assert(createFile(filepath.Join(r.backupDir, "docs", "b.md"), []byte("b")), IsNil)
+	c.Assert(createFile(filepath.Join(r.backupDir, "docs", "old", "c.txt"), []byte("c")), IsNil)
+	c.Assert(createFile(filepath.Join(r.backupDir, "other"), []byte("other")), IsNil)
+	c.Assert(os.Symlink("docs/a.txt", filepath.Join(r.backupDir, "link")), IsNil)
+}
+
+func (r *RestoreTestSuite) readTarget(c *C, path string) string {
+	data, err := ioutil.ReadFile(filepath.Join(r.targetDir, path))
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (r *RestoreTestSuite) TestRestoreSelectsPathsAndGlobs(c *C) {
+	plan, err := PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"docs/*.txt", "/docs/old", "link"}})
+	c.Assert(err, IsNil)
+
+	c.Check(operationPaths(plan.Directories), DeepEquals, []string{"docs/old"})
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{"docs/a.txt", "docs/old/c.txt"})
+	c.Check(operationPaths(plan.Symlinks), DeepEquals, []string{"link"})
+
+	c.Assert(plan.Apply(), IsNil)
+	c.Check(r.readTarget(c, "docs/a.txt"), Equals, "a")
+	c.Check(r.readTarget(c, "docs/old/c.txt"), Equals, "c")
+	target, err := os.Readlink(filepath.Join(r.targetDir, "link"))
+	c.Assert(err, IsNil)
+	c.Check(target, Equals, "docs/a.txt")
+
+	_, err = os.Lstat(filepath.Join(r.targetDir, "docs", "b.md"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	_, err = PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"missing"}})
+	c.Check(err, ErrorMatches, "nothing in the backup matches missing")
+}
+
+func (r *RestoreTestSuite) TestRestoreConflictPolicies(c *C) {
+	c.Assert(createFile(filepath.Join(r.targetDir, "other"), []byte("mine")), IsNil)
+	c.Assert(createFile(filepath.Join(r.targetDir, "other.restored"), []byte("mine too")), IsNil)
+
+	plan, err := PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"other"}})
+	c.Assert(err, IsNil)
+	c.Check(plan.Skipped, DeepEquals, []Operation{{Path: "other", Reason: ReasonExistsSkipped}})
+	c.Check(plan.Empty(), Equals, true)
+
+	plan, err = PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"other"}, Conflict: ConflictRename})
+	c.Assert(err, IsNil)
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "other", Target: "other.restored-2", Reason: ReasonExistsRenamed}})
+	c.Assert(plan.Apply(), IsNil)
+	c.Check(r.readTarget(c, "other"), Equals, "mine")
+	c.Check(r.readTarget(c, "other.restored-2"), Equals, "other")
+
+	plan, err = PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"other"}, Conflict: ConflictOverwrite})
+	c.Assert(err, IsNil)
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "other", Reason: ReasonExistsOverwritten}})
+	c.Assert(plan.Apply(), IsNil)
+	c.Check(r.readTarget(c, "other"), Equals, "other")
+
+	_, err = PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Conflict: "merge"})
+	c.Check(err, ErrorMatches, "unknown conflict policy.*")
+}
+
+func (r *RestoreTestSuite) TestRestoreSkipsEntriesBelowSkippedPaths(c *C) {
+	c.Assert(createFile(filepath.Join(r.targetDir, "docs"), []byte("not a directory")), IsNil)
+
+	plan, err := PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"docs"}})
+	c.Assert(err, IsNil)
+	c.Check(operationPaths(plan.Skipped), DeepEquals, []string{"docs"})
+	c.Check(plan.Empty(), Equals, true)
+}
+
+func (r *RestoreTestSuite) TestRestoreMetadata(c *C) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Assert(os.Chmod(filepath.Join(r.backupDir, "docs", "a.txt"), 0600), IsNil)
+	c.Assert(os.Chtimes(filepath.Join(r.backupDir, "docs", "a.txt"), mtime, mtime), IsNil)
+	c.Assert(os.Chtimes(filepath.Join(r.backupDir, "docs"), mtime, mtime), IsNil)
+
+	plan, err := PlanRestore(NewDirSource(r.backupDir), r.targetDir, RestoreOptions{Paths: []string{"docs"}, Metadata: Options{Archive: true}})
+	c.Assert(err, IsNil)
+	c.Assert(plan.Apply(), IsNil)
+
+	info, err := os.Stat(filepath.Join(r.targetDir, "docs", "a.txt"))
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+	c.Check(info.ModTime().Equal(mtime), Equals, true)
+
+	info, err = os.Stat(filepath.Join(r.targetDir, "docs"))
+	c.Assert(err, IsNil)
+	c.Check(info.ModTime().Equal(mtime), Equals, true)
+}
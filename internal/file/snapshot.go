@@ -0,0 +1,352 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// LatestSnapshot is the symlink in a snapshot backup location that points at the most recent
+	// complete snapshot
+	LatestSnapshot = "latest"
+	// SnapshotTimeFormat names each snapshot directory after the time it was taken, in UTC so names
+	// do not repeat when clocks go back
+	SnapshotTimeFormat = "2006-01-02T15-04-05Z"
+	// localSnapshotTimeFormat named snapshots after the local time they were taken before names
+	// were in UTC
+	localSnapshotTimeFormat = "2006-01-02T15-04-05"
+	// partialSnapshotSuffix is added to the hidden name a snapshot is written under until it is
+	// complete
+	partialSnapshotSuffix = ".partial"
+)
+
+// snapshotNumberPattern matches the number added to the names of snapshots taken in the same second
+var snapshotNumberPattern = regexp.MustCompile(`^(.*Z)-[1-9][0-9]*$`)
+
+// SnapshotName returns the name of the directory for a snapshot taken at the time
+func SnapshotName(t time.Time) string {
+	return t.UTC().Format(SnapshotTimeFormat)
+}
+
+// NewSnapshotName returns the name of the directory for a snapshot taken at the time in the backup
+// location. A number is added to the name if a snapshot, complete or not, already has it.
+func NewSnapshotName(dstDir string, t time.Time) string {
+	base := SnapshotName(t)
+
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		if _, err := os.Lstat(filepath.Join(dstDir, name)); err == nil {
+			continue
+		}
+		if _, err := os.Lstat(partialSnapshotDir(dstDir, name)); err == nil {
+			continue
+		}
+
+		return name
+	}
+}
+
+// partialSnapshotDir returns the directory the named snapshot is written to until it is complete
+func partialSnapshotDir(dstDir, name string) string {
+	return filepath.Join(dstDir, "."+name+partialSnapshotSuffix)
+}
+
+// CreatePartialSnapshot creates the directory the named snapshot is written to until it is
+// complete, and fails if another run is already writing a snapshot of the same name. The directory
+// has a hidden name, so a run that is interrupted never leaves a partial snapshot that is listed as
+// a snapshot, linked from or pruned.
+func CreatePartialSnapshot(dstDir, name string) (string, error) {
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	dir := partialSnapshotDir(dstDir, name)
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	return withTrailingSlash(dir), nil
+}
+
+// CompleteSnapshot gives the partial snapshot its name once it has been written without errors
+func CompleteSnapshot(dstDir, name string) error {
+	return os.Rename(partialSnapshotDir(dstDir, name), filepath.Join(dstDir, name))
+}
+
+// RemovePartialSnapshot deletes the partial snapshot of a run that finished with errors
+func RemovePartialSnapshot(dstDir, name string) error {
+	return removeSnapshotDir(partialSnapshotDir(dstDir, name))
+}
+
+// ListPartialSnapshots returns the names of the snapshots in the backup location that are being
+// written, or were left partly written by an interrupted run
+func ListPartialSnapshots(dstDir string) ([]string, error) {
+	entries, err := readDir(dstDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "."), partialSnapshotSuffix)
+		if entry.IsDir() && entry.Name() == "."+name+partialSnapshotSuffix && isSnapshotName(name) {
+			names = append(names, name)
+		}
+	}
+	sortSnapshotNames(names)
+
+	return names, nil
+}
+
+// LatestSnapshotDir returns the directory the latest symlink in the backup location points at, or
+// an empty string if there is no previous snapshot
+func LatestSnapshotDir(dstDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(dstDir, LatestSnapshot))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dstDir, target)
+	}
+
+	return withTrailingSlash(target), nil
+}
+
+// IsSnapshotLocation reports whether the directory is a snapshot backup location, rather than a
+// backup location of a source that has a latest entry of its own. It is one if latest is a symlink
+// to a snapshot directory alongside it and the directory has no manifest of its own.
+func IsSnapshotLocation(dir string) bool {
+	target, err := os.Readlink(filepath.Join(dir, LatestSnapshot))
+	if err != nil || filepath.Base(target) != target || !isSnapshotName(target) {
+		return false
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, target)); err != nil || !info.IsDir() {
+		return false
+	}
+
+	_, err = os.Lstat(ManifestPath(dir))
+	return os.IsNotExist(err)
+}
+
+// UpdateLatestSnapshot atomically points the latest symlink in the backup location at the named
+// snapshot
+func UpdateLatestSnapshot(dstDir, name string) error {
+	latest := filepath.Join(dstDir, LatestSnapshot)
+
+	for {
+		tmpPath := filepath.Join(dstDir, "."+LatestSnapshot+tempFileSuffix+tempNumber())
+
+		err := os.Symlink(name, tmpPath)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmpPath, latest); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// GenerateSnapshotDetails determines the operations needed to create a new snapshot of the source
+// location in an empty directory. Entries are compared with the previous snapshot in the base
+// directory, if any, the same way GenerateBackupDetails compares them with a backup location.
+// Unchanged files are linked from the previous snapshot and everything else is created afresh.
+func GenerateSnapshotDetails(srcIndex, baseIndex map[string]os.FileInfo, srcDir, baseDir, dstDir string, opts Options) *Plan {
+	// Changed files are written to a new directory with no earlier copy to append to or patch, so
+	// they are always copied in full
+	opts.Append = false
+	opts.Delta = false
+
+	changed := map[string]string{}
+	if baseDir != "" {
+		// A file whose metadata differs cannot share the previous snapshot's copy without changing
+		// that snapshot too, so it is copied like a file whose contents differ
+		base := GenerateBackupDetails(srcIndex, baseIndex, srcDir, baseDir, opts)
+		for _, ops := range [][]Operation{base.Files, base.Metadata} {
+			for _, op := range ops {
+				changed[op.Path] = op.Reason
+			}
+		}
+	}
+
+	// The hash cache describes the previous snapshot, which the new snapshot is not compared with
+	opts.Cache = nil
+	plan := GenerateBackupDetails(srcIndex, map[string]os.FileInfo{}, srcDir, dstDir, opts)
+	if baseDir == "" {
+		return plan
+	}
+	plan.BaseDir = withTrailingSlash(baseDir)
+
+	files := []Operation{}
+	for _, op := range plan.Files {
+		baseFile, inBase := baseIndex[op.Path]
+		if reason, ok := changed[op.Path]; ok {
+			files = append(files, Operation{Path: op.Path, Reason: reason})
+		} else if !inBase || !baseFile.Mode().IsRegular() {
+			files = append(files, op)
+		} else {
+			plan.Reuse = append(plan.Reuse, Operation{Path: op.Path, Reason: ReasonUnchanged})
+		}
+	}
+	plan.Files = files
+
+	return plan
+}
+
+// ParseSnapshotName returns the time a snapshot was taken from the name of its directory, in local
+// time. The number added to the names of snapshots taken in the same second is ignored, and names
+// from before names were in UTC are read as local time.
+func ParseSnapshotName(name string) (time.Time, error) {
+	name = strings.TrimSuffix(name, "/")
+	if m := snapshotNumberPattern.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	}
+
+	if t, err := time.Parse(SnapshotTimeFormat, name); err == nil {
+		return t.Local(), nil
+	}
+
+	return time.ParseInLocation(localSnapshotTimeFormat, name, time.Local)
+}
+
+// isSnapshotName reports whether the directory name is a snapshot taken by a snapshot backup
+func isSnapshotName(name string) bool {
+	_, err := ParseSnapshotName(name)
+	return err == nil
+}
+
+// ListSnapshots returns the names of the complete snapshots in the backup location, oldest first
+func ListSnapshots(dstDir string) ([]string, error) {
+	entries, err := readDir(dstDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && isSnapshotName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sortSnapshotNames(names)
+
+	return names, nil
+}
+
+// readDir returns the entries of the directory
+func readDir(dir string) ([]os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdir(-1)
+}
+
+// sortSnapshotNames sorts the snapshot names by the time they were taken, oldest first
+func sortSnapshotNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		ti, _ := ParseSnapshotName(names[i])
+		tj, _ := ParseSnapshotName(names[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+}
+
+// SnapshotsSize returns the number of bytes removing the snapshots would free, which is the size
+// of their files that are not also hard linked from outside them
+func SnapshotsSize(dstDir string, names []string) int64 {
+	size := int64(0)
+	links := map[inode]uint64{}
+
+	for _, name := range names {
+		for _, info := range ScanDirectory(withTrailingSlash(filepath.Join(dstDir, name))) {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+
+			id, ok := fileID(info)
+			if !ok {
+				size += info.Size()
+				continue
+			}
+
+			// Only the last link to a file frees its contents
+			links[id]++
+			if links[id] == linkCount(info) {
+				size += info.Size()
+			}
+		}
+	}
+
+	return size
+}
+
+// RemoveSnapshot deletes a snapshot from the backup location. The snapshot is first renamed so an
+// interrupted removal cannot leave a partial snapshot that looks complete. Files hard linked from
+// other snapshots only lose a link, so the snapshots that are kept are unaffected. The latest
+// snapshot is never removed.
+func RemoveSnapshot(dstDir, name string) error {
+	if !isSnapshotName(name) {
+		return fmt.Errorf("%s is not a snapshot", name)
+	}
+
+	latest, err := os.Readlink(filepath.Join(dstDir, LatestSnapshot))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if filepath.Base(latest) == name {
+		return fmt.Errorf("refusing to remove %s as it is the latest snapshot", name)
+	}
+
+	removing := filepath.Join(dstDir, "."+name+".removing")
+	if err := os.Rename(filepath.Join(dstDir, name), removing); err != nil {
+		return err
+	}
+
+	return removeSnapshotDir(removing)
+}
+
+// removeSnapshotDir deletes a snapshot directory that is no longer listed as a snapshot
+func removeSnapshotDir(removing string) error {
+	if err := os.RemoveAll(removing); err == nil {
+		return nil
+	}
+
+	// Directories copied with their permissions may not be writable, and as directories are never
+	// hard linked, making them writable does not affect the snapshots that are kept
+	filepath.Walk(removing, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(removing)
+}
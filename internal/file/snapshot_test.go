@@ -0,0 +1,238 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SnapshotTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&SnapshotTestSuite{})
+
+func (s *SnapshotTestSuite) SetUpTest(c *C) {
+	s.srcDir = c.MkDir() + "/"
+	s.dstDir = c.MkDir() + "/"
+}
+
+// takeSnapshot backs up the source to a new snapshot with the given name and options, as the
+// snapshot mode of the backup command does
+func (s *SnapshotTestSuite) takeSnapshot(c *C, name string, opts Options) *Plan {
+	baseDir, err := LatestSnapshotDir(s.dstDir)
+	c.Assert(err, IsNil)
+
+	baseIndex := map[string]os.FileInfo{}
+	if baseDir != "" {
+		baseIndex = ScanDirectory(baseDir)
+	}
+
+	snapshotDir := filepath.Join(s.dstDir, name) + "/"
+	plan := GenerateSnapshotDetails(ScanDirectory(s.srcDir), baseIndex, s.srcDir, baseDir, snapshotDir, opts)
+
+	partialDir, err := CreatePartialSnapshot(s.dstDir, name)
+	c.Assert(err, IsNil)
+	plan.DstDir = partialDir
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+	c.Assert(CompleteSnapshot(s.dstDir, name), IsNil)
+	c.Assert(UpdateLatestSnapshot(s.dstDir, name), IsNil)
+
+	return plan
+}
+
+func (s *SnapshotTestSuite) TestSnapshotLinksUnchangedFiles(c *C) {
+	c.Assert(os.Mkdir(filepath.Join(s.srcDir, "dir"), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "dir", "same"), []byte("same")), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "changed"), []byte("old")), IsNil)
+
+	plan := s.takeSnapshot(c, "2026-10-17T02-00-00", Options{QuickCheck: true})
+	c.Check(operationPaths(plan.Files), DeepEquals, []string{"changed", "dir/same"})
+	c.Check(plan.Reuse, HasLen, 0)
+
+	c.Assert(createFile(filepath.Join(s.srcDir, "changed"), []byte("new contents")), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "added"), []byte("added")), IsNil)
+
+	plan = s.takeSnapshot(c, "2026-10-18T02-00-00", Options{QuickCheck: true})
+	c.Check(plan.BaseDir, Equals, filepath.Join(s.dstDir, "2026-10-17T02-00-00")+"/")
+	c.Check(plan.Files, DeepEquals, []Operation{
+		{Path: "added", Reason: ReasonMissing},
+		{Path: "changed", Reason: ReasonSizeDiffers},
+	})
+	c.Check(plan.Reuse, DeepEquals, []Operation{{Path: "dir/same", Reason: ReasonUnchanged}})
+
+	first, err := os.Stat(filepath.Join(s.dstDir, "2026-10-17T02-00-00", "dir", "same"))
+	c.Assert(err, IsNil)
+	second, err := os.Stat(filepath.Join(s.dstDir, "2026-10-18T02-00-00", "dir", "same"))
+	c.Assert(err, IsNil)
+	c.Check(os.SameFile(first, second), Equals, true)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dstDir, "2026-10-17T02-00-00", "changed"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "old")
+	data, err = ioutil.ReadFile(filepath.Join(s.dstDir, LatestSnapshot, "changed"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "new contents")
+}
+
+func (s *SnapshotTestSuite) TestSnapshotCopiesGrownFilesInFull(c *C) {
+	c.Assert(createFile(filepath.Join(s.srcDir, "log"), make([]byte, deltaMinSize)), IsNil)
+	s.takeSnapshot(c, "2026-10-17T02-00-00", Options{Append: true, Delta: true})
+
+	grown := append(make([]byte, deltaMinSize), "more"...)
+	c.Assert(createFile(filepath.Join(s.srcDir, "log"), grown), IsNil)
+
+	plan := s.takeSnapshot(c, "2026-10-18T02-00-00", Options{Append: true, Delta: true})
+	c.Check(plan.Files, DeepEquals, []Operation{{Path: "log", Reason: ReasonSizeDiffers}})
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dstDir, LatestSnapshot, "log"))
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, grown)
+}
+
+func (s *SnapshotTestSuite) TestLatestSnapshotDir(c *C) {
+	dir, err := LatestSnapshotDir(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(dir, Equals, "")
+
+	c.Assert(os.Mkdir(filepath.Join(s.dstDir, "2026-10-17T02-00-00"), os.ModePerm), IsNil)
+	c.Assert(UpdateLatestSnapshot(s.dstDir, "2026-10-17T02-00-00"), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(s.dstDir, "2026-10-18T02-00-00"), os.ModePerm), IsNil)
+	c.Assert(UpdateLatestSnapshot(s.dstDir, "2026-10-18T02-00-00"), IsNil)
+
+	dir, err = LatestSnapshotDir(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(dir, Equals, filepath.Join(s.dstDir, "2026-10-18T02-00-00")+"/")
+
+	target, err := os.Readlink(filepath.Join(s.dstDir, LatestSnapshot))
+	c.Assert(err, IsNil)
+	c.Check(target, Equals, "2026-10-18T02-00-00")
+
+	names, err := ListSnapshots(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"2026-10-17T02-00-00", "2026-10-18T02-00-00"})
+}
+
+func (s *SnapshotTestSuite) TestIsSnapshotLocation(c *C) {
+	c.Assert(createFile(filepath.Join(s.srcDir, "file"), []byte("file")), IsNil)
+	s.takeSnapshot(c, "2026-10-17T02-00-00Z", Options{})
+	c.Check(IsSnapshotLocation(s.dstDir), Equals, true)
+
+	// A backup location of a source with a latest symlink of its own is not a snapshot location
+	c.Assert(os.Mkdir(filepath.Join(s.srcDir, "docs"), os.ModePerm), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "docs", "r.txt"), []byte("r")), IsNil)
+	c.Assert(os.Symlink("docs", filepath.Join(s.srcDir, LatestSnapshot)), IsNil)
+	plainDir := c.MkDir() + "/"
+	plan := GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(plainDir), s.srcDir, plainDir, Options{})
+	c.Assert(plan.Apply(ApplyOptions{}), IsNil)
+	c.Check(IsSnapshotLocation(plainDir), Equals, false)
+
+	// Nor is one whose latest symlink points at a directory named like a snapshot, as it has a
+	// manifest of its own
+	c.Assert(os.Mkdir(filepath.Join(s.srcDir, "2026-10-17T02-00-00Z"), os.ModePerm), IsNil)
+	c.Assert(os.Remove(filepath.Join(s.srcDir, LatestSnapshot)), IsNil)
+	c.Assert(os.Symlink("2026-10-17T02-00-00Z", filepath.Join(s.srcDir, LatestSnapshot)), IsNil)
+	plan = GenerateBackupDetails(ScanDirectory(s.srcDir), ScanDirectory(plainDir), s.srcDir, plainDir, Options{})
+	c.Assert(plan.Apply(ApplyOptions{Manifest: true}), IsNil)
+	c.Check(IsSnapshotLocation(plainDir), Equals, false)
+
+	c.Check(IsSnapshotLocation(c.MkDir()), Equals, false)
+}
+
+func (s *SnapshotTestSuite) TestCreatePartialSnapshotCreatesDestination(c *C) {
+	dstDir := filepath.Join(c.MkDir(), "snapshots")
+	partialDir, err := CreatePartialSnapshot(dstDir, "2026-10-17T02-00-00Z")
+	c.Assert(err, IsNil)
+	c.Check(partialDir, Equals, filepath.Join(dstDir, ".2026-10-17T02-00-00Z.partial")+"/")
+
+	_, err = CreatePartialSnapshot(dstDir, "2026-10-17T02-00-00Z")
+	c.Check(os.IsExist(err), Equals, true)
+}
+
+func (s *SnapshotTestSuite) TestPartialSnapshotsAreNotListed(c *C) {
+	c.Assert(createFile(filepath.Join(s.srcDir, "file"), []byte("file")), IsNil)
+	s.takeSnapshot(c, "2026-10-17T02-00-00Z", Options{})
+
+	partialDir, err := CreatePartialSnapshot(s.dstDir, "2026-10-18T02-00-00Z")
+	c.Assert(err, IsNil)
+	c.Assert(createFile(filepath.Join(partialDir, "file"), []byte("fi")), IsNil)
+
+	_, err = CreatePartialSnapshot(s.dstDir, "2026-10-18T02-00-00Z")
+	c.Check(os.IsExist(err), Equals, true)
+
+	names, err := ListSnapshots(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"2026-10-17T02-00-00Z"})
+	partial, err := ListPartialSnapshots(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(partial, DeepEquals, []string{"2026-10-18T02-00-00Z"})
+	c.Check(NewSnapshotName(s.dstDir, time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)), Equals, "2026-10-18T02-00-00Z-2")
+
+	c.Assert(RemovePartialSnapshot(s.dstDir, "2026-10-18T02-00-00Z"), IsNil)
+	partial, err = ListPartialSnapshots(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(partial, HasLen, 0)
+}
+
+func (s *SnapshotTestSuite) TestSnapshotName(c *C) {
+	taken := time.Date(2026, 10, 17, 2, 0, 0, 0, time.UTC)
+	c.Check(SnapshotName(taken), Equals, "2026-10-17T02-00-00Z")
+	c.Check(SnapshotName(taken.In(time.FixedZone("EST", -5*60*60))), Equals, "2026-10-17T02-00-00Z")
+	c.Check(NewSnapshotName(s.dstDir, taken), Equals, "2026-10-17T02-00-00Z")
+
+	// A second snapshot in the same second is numbered
+	c.Assert(os.Mkdir(filepath.Join(s.dstDir, "2026-10-17T02-00-00Z"), os.ModePerm), IsNil)
+	c.Check(NewSnapshotName(s.dstDir, taken), Equals, "2026-10-17T02-00-00Z-2")
+
+	for _, name := range []string{"2026-10-17T02-00-00Z", "2026-10-17T02-00-00Z-2"} {
+		t, err := ParseSnapshotName(name)
+		c.Assert(err, IsNil, Commentf(name))
+		c.Check(t.Equal(taken), Equals, true, Commentf(name))
+	}
+
+	// Snapshots named before names were in UTC are in local time
+	t, err := ParseSnapshotName("2026-10-17T02-00-00")
+	c.Assert(err, IsNil)
+	c.Check(t.Equal(time.Date(2026, 10, 17, 2, 0, 0, 0, time.Local)), Equals, true)
+
+	for _, name := range []string{"2026-10-17T02-00-00Z-0", "2026-10-17T02-00-00-2", "latest"} {
+		_, err := ParseSnapshotName(name)
+		c.Check(err, NotNil, Commentf(name))
+	}
+}
+
+func (s *SnapshotTestSuite) TestListSnapshotsSortsByTime(c *C) {
+	for _, name := range []string{"2026-10-17T02-00-00Z-10", "2026-10-17T02-00-00Z-2", "2026-10-17T02-00-00Z", "2026-10-16T02-00-00Z"} {
+		c.Assert(os.Mkdir(filepath.Join(s.dstDir, name), os.ModePerm), IsNil)
+	}
+
+	names, err := ListSnapshots(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"2026-10-16T02-00-00Z", "2026-10-17T02-00-00Z", "2026-10-17T02-00-00Z-2", "2026-10-17T02-00-00Z-10"})
+}
+
+func (s *SnapshotTestSuite) TestRemoveSnapshotKeepsLinkedFiles(c *C) {
+	c.Assert(createFile(filepath.Join(s.srcDir, "same"), []byte("same")), IsNil)
+	c.Assert(createFile(filepath.Join(s.srcDir, "changed"), []byte("old")), IsNil)
+	s.takeSnapshot(c, "2026-10-17T02-00-00", Options{QuickCheck: true})
+
+	c.Assert(createFile(filepath.Join(s.srcDir, "changed"), []byte("new contents")), IsNil)
+	s.takeSnapshot(c, "2026-10-18T02-00-00", Options{QuickCheck: true})
+
+	c.Check(SnapshotsSize(s.dstDir, []string{"2026-10-17T02-00-00"}), Equals, int64(len("old")))
+
+	c.Check(RemoveSnapshot(s.dstDir, "2026-10-18T02-00-00"), ErrorMatches, ".*latest snapshot")
+	c.Assert(RemoveSnapshot(s.dstDir, "2026-10-17T02-00-00"), IsNil)
+
+	names, err := ListSnapshots(s.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"2026-10-18T02-00-00"})
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dstDir, LatestSnapshot, "same"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "same")
+}
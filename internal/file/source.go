@@ -0,0 +1,151 @@
+package file
+
+import (
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+// ReadLinkFS is a file system whose symlinks can be read, like the archives opened by
+// OpenArchive. Symlinks in other file systems are not backed up.
+type ReadLinkFS interface {
+	fs.FS
+	// ReadLink returns the target of the named symlink
+	ReadLink(name string) (string, error)
+}
+
+// errNoReadLink is returned when reading a symlink in a file system that cannot read them
+var errNoReadLink = errors.New("symlinks cannot be read from this source")
+
+// ScanFS obtains the details of all files and directories in a file system, in the form returned
+// by ScanDirectory. Symlinks are not followed.
+func ScanFS(fsys fs.FS) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files[path] = info
+		return nil
+	})
+
+	return files, err
+}
+
+// openSource opens a file in the source for reading, from the source file system if the options
+// have one or from the source directory otherwise
+func openSource(srcDir, path string, opts Options) (io.ReadCloser, error) {
+	if opts.Source != nil {
+		return opts.Source.Open(filepath.ToSlash(path))
+	}
+
+	return os.Open(filepath.Join(srcDir, path))
+}
+
+// statSource returns the details of an entry in the source without following symlinks
+func statSource(srcDir, path string, opts Options) (os.FileInfo, error) {
+	if opts.Source != nil {
+		return fs.Stat(opts.Source, filepath.ToSlash(path))
+	}
+
+	return os.Lstat(filepath.Join(srcDir, path))
+}
+
+// readSourceLink returns the target of a symlink in the source
+func readSourceLink(srcDir, path string, opts Options) (string, error) {
+	if opts.Source == nil {
+		return os.Readlink(filepath.Join(srcDir, path))
+	}
+
+	if rl, ok := opts.Source.(ReadLinkFS); ok {
+		return rl.ReadLink(filepath.ToSlash(path))
+	}
+
+	return "", errNoReadLink
+}
+
+// hashSource generates the hash string of a file in the source, using the hash cache for files in
+// the source directory
+func hashSource(srcDir, path string, info os.FileInfo, hasher Hasher, opts Options) (string, error) {
+	if opts.Source == nil {
+		return cachedHash(opts.Cache, sideSource, srcDir, path, info, hasher)
+	}
+
+	r, err := opts.Source.Open(filepath.ToSlash(path))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	sum := hasher.New()
+	if _, err := io.Copy(sum, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// copySourceFile copies a file from the source file system to the destination file, throttling
+// the writes with the limiter, if any, and writing the contents to the hash, if any
+func copySourceFile(fsys fs.FS, path, dstPath string, limiter *throttle.Limiter, sum hash.Hash) error {
+	r, err := fsys.Open(filepath.ToSlash(path))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return replaceFile(dstPath, func(tmpFile *os.File) error {
+		_, err := io.Copy(teeHash(limiter.Writer(tmpFile), sum), r)
+		return err
+	})
+}
+
+// copySourceMetadata applies the metadata of an entry in the source file system selected by the
+// options to the destination entry, like CopyMetadata. Ownership is only known for entries of tar
+// archives, and extended attributes are not read from file systems.
+func copySourceMetadata(fsys fs.FS, path, dstPath string, opts Options) error {
+	srcFile, err := fs.Stat(fsys, filepath.ToSlash(path))
+	if err != nil {
+		return err
+	}
+
+	if opts.Archive && os.Geteuid() == 0 {
+		if uid, gid, ok := ownership(srcFile); ok {
+			if err := os.Lchown(dstPath, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !opts.Archive {
+		if opts.preservesModTime() && srcFile.Mode().IsRegular() {
+			return setTimes(dstPath, srcFile.ModTime(), srcFile.ModTime())
+		}
+		return nil
+	}
+
+	if srcFile.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(dstPath, srcFile.Mode()&permissionBits); err != nil {
+			return err
+		}
+	}
+
+	return setTimes(dstPath, srcFile.ModTime(), srcFile.ModTime())
+}
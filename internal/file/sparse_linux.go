@@ -0,0 +1,94 @@
+package file
+
+import (
+	"hash"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+const (
+	// seekData is the lseek whence that seeks to the next data region at or after the offset
+	seekData = 3
+	// seekHole is the lseek whence that seeks to the next hole at or after the offset
+	seekHole = 4
+)
+
+// copyData copies the contents of the source file to the destination file. Holes in the source
+// are skipped rather than written, so a sparse source file stays sparse at the destination. Writes
+// are throttled by the limiter, if any, and the logical contents are written to the hash, if any.
+func copyData(dst, src *os.File, limiter *throttle.Limiter, sum hash.Hash) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	offset := int64(0)
+	for offset < size {
+		data, err := src.Seek(offset, seekData)
+		if isErrno(err, syscall.ENXIO) {
+			// The rest of the file is a hole
+			break
+		}
+		if isErrno(err, syscall.EINVAL) || isErrno(err, syscall.EOPNOTSUPP) {
+			// The filesystem cannot report holes, so copy the rest of the file as data
+			return copyRange(dst, src, limiter, sum, offset, -1, size)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := hashZeros(sum, data-offset); err != nil {
+			return err
+		}
+
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+
+		if err := copyRange(dst, src, limiter, sum, data, hole-data, size); err != nil {
+			return err
+		}
+		offset = hole
+	}
+
+	if err := hashZeros(sum, size-offset); err != nil {
+		return err
+	}
+
+	return dst.Truncate(size)
+}
+
+// copyRange copies length bytes from offset in the source file to the same offset in the
+// destination file, or everything from the offset onwards when the length is negative
+func copyRange(dst, src *os.File, limiter *throttle.Limiter, sum hash.Hash, offset, length, size int64) error {
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if length < 0 {
+		if _, err := io.Copy(teeHash(limiter.Writer(dst), sum), src); err != nil {
+			return err
+		}
+		return dst.Truncate(size)
+	}
+
+	_, err := io.CopyN(teeHash(limiter.Writer(dst), sum), src, length)
+	return err
+}
+
+// isErrno reports whether the error was caused by the given system call error number
+func isErrno(err error, errno syscall.Errno) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+
+	return err == errno
+}
@@ -0,0 +1,116 @@
+package file
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+type SparseTestSuite struct {
+	dir string
+}
+
+var _ = Suite(&SparseTestSuite{})
+
+func (s *SparseTestSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *SparseTestSuite) TestCopyFilePreservesHoles(c *C) {
+	srcFile := filepath.Join(s.dir, "src")
+	dstFile := filepath.Join(s.dir, "dst")
+	size := int64(16 << 20)
+
+	f, err := os.Create(srcFile)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("data"), size/2)
+	c.Assert(err, IsNil)
+	c.Assert(f.Truncate(size), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	err = CopyFile(srcFile, dstFile)
+	c.Assert(err, IsNil)
+
+	srcInfo, err := os.Stat(srcFile)
+	c.Assert(err, IsNil)
+	dstInfo, err := os.Stat(dstFile)
+	c.Assert(err, IsNil)
+
+	c.Check(dstInfo.Size(), Equals, size)
+	if srcInfo.Sys().(*syscall.Stat_t).Blocks*512 < size {
+		c.Check(dstInfo.Sys().(*syscall.Stat_t).Blocks*512 < size, Equals, true)
+	}
+
+	srcData, err := ioutil.ReadFile(srcFile)
+	c.Assert(err, IsNil)
+	dstData, err := ioutil.ReadFile(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(srcData, dstData), Equals, true)
+}
+
+func (s *SparseTestSuite) TestHashFileMatchesSparseAndDenseCopies(c *C) {
+	sparseFile := filepath.Join(s.dir, "sparse")
+	denseFile := filepath.Join(s.dir, "dense")
+	size := int64(1 << 20)
+
+	f, err := os.Create(sparseFile)
+	c.Assert(err, IsNil)
+	c.Assert(f.Truncate(size), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(createFile(denseFile, make([]byte, size)), IsNil)
+
+	sparseSum, err := hashFile(sparseFile, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+	denseSum, err := hashFile(denseFile, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+
+	c.Check(sparseSum, Equals, denseSum)
+}
+
+func (s *SparseTestSuite) TestCopyFileCopiesFileEndingInHole(c *C) {
+	srcFile := filepath.Join(s.dir, "src")
+	dstFile := filepath.Join(s.dir, "dst")
+
+	c.Assert(createFile(dstFile, bytes.Repeat([]byte{'x'}, 1<<20)), IsNil)
+
+	f, err := os.Create(srcFile)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Truncate(1<<19), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(CopyFile(srcFile, dstFile), IsNil)
+
+	srcData, err := ioutil.ReadFile(srcFile)
+	c.Assert(err, IsNil)
+	dstData, err := ioutil.ReadFile(dstFile)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(srcData, dstData), Equals, true)
+}
+
+func (s *SparseTestSuite) TestCopyFileHashesLogicalContents(c *C) {
+	srcFile := filepath.Join(s.dir, "src")
+	dstFile := filepath.Join(s.dir, "dst")
+	size := int64(1 << 20)
+
+	f, err := os.Create(srcFile)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("data"), size/4)
+	c.Assert(err, IsNil)
+	c.Assert(f.Truncate(size), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	sum := hashers[DefaultHash].New()
+	c.Assert(copyFile(srcFile, dstFile, nil, sum), IsNil)
+
+	expected, err := hashFile(srcFile, hashers[DefaultHash])
+	c.Assert(err, IsNil)
+	c.Check(hex.EncodeToString(sum.Sum(nil)), Equals, expected)
+}
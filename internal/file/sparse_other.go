@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"hash"
+	"io"
+	"os"
+
+	"github.com/samphillips/backup/internal/throttle"
+)
+
+// copyData copies the contents of the source file to the destination file. Holes cannot be
+// detected on this platform, so sparse files are written out in full. Writes are throttled by the
+// limiter, if any, and the contents are written to the hash, if any.
+func copyData(dst, src *os.File, limiter *throttle.Limiter, sum hash.Hash) error {
+	_, err := io.Copy(teeHash(limiter.Writer(dst), sum), src)
+	return err
+}
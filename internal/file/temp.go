@@ -0,0 +1,81 @@
+package file
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tempFileSuffix is inserted between a destination file name and a random number to name the
+// temporary file it is written to
+const tempFileSuffix = ".backup-tmp-"
+
+var (
+	tempFilePattern = regexp.MustCompile(`^\..+\.backup-tmp-[0-9]+$`)
+	tempRand        = rand.New(rand.NewSource(time.Now().UnixNano()))
+	tempRandLock    sync.Mutex
+)
+
+// tempNumber returns a random number for a temporary file name
+func tempNumber() string {
+	tempRandLock.Lock()
+	defer tempRandLock.Unlock()
+
+	return strconv.FormatUint(uint64(tempRand.Uint32()), 10)
+}
+
+// createTempFile creates a new temporary file alongside the destination path, named
+// .<name>.backup-tmp-<random>. It has the permissions of the file at the destination path, so
+// renaming it over the file keeps them as overwriting the file in place would, or the default
+// permissions of a newly created file if there is none.
+func createTempFile(dstPath string) (*os.File, error) {
+	dir, name := filepath.Split(dstPath)
+
+	for {
+		tmpPath := filepath.Join(dir, "."+name+tempFileSuffix+tempNumber())
+
+		f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if info, err := os.Lstat(dstPath); err == nil && info.Mode().IsRegular() {
+			if err := f.Chmod(info.Mode().Perm()); err != nil {
+				f.Close()
+				os.Remove(tmpPath)
+				return nil, err
+			}
+		}
+
+		return f, nil
+	}
+}
+
+// isTempFile reports whether the path is a temporary file written by CopyFile
+func isTempFile(path string) bool {
+	return tempFilePattern.MatchString(filepath.Base(path))
+}
+
+// generateTempRemovals determines the temporary files left in the backup location by interrupted
+// copies. Files that also exist at the source are real files and are left alone.
+func generateTempRemovals(srcIndex, dstIndex map[string]os.FileInfo) []Operation {
+	removals := []Operation{}
+
+	for dstPath, dstFile := range dstIndex {
+		if _, ok := srcIndex[dstPath]; ok || !dstFile.Mode().IsRegular() || !isTempFile(dstPath) {
+			continue
+		}
+		removals = append(removals, Operation{Path: dstPath, Reason: ReasonStaleTempFile})
+	}
+
+	sortOperations(removals)
+
+	return removals
+}
@@ -0,0 +1,100 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type TempFileTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&TempFileTestSuite{})
+
+func (t *TempFileTestSuite) SetUpTest(c *C) {
+	t.srcDir = c.MkDir()
+	t.dstDir = c.MkDir()
+}
+
+func (t *TempFileTestSuite) TestCopyFileLeavesNoTempFiles(c *C) {
+	c.Assert(createFile(filepath.Join(t.srcDir, "file1"), []byte("new")), IsNil)
+	c.Assert(createFile(filepath.Join(t.dstDir, "file1"), []byte("old")), IsNil)
+
+	err := CopyFile(filepath.Join(t.srcDir, "file1"), filepath.Join(t.dstDir, "file1"))
+	c.Assert(err, IsNil)
+
+	entries, err := ioutil.ReadDir(t.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 1)
+
+	data, err := ioutil.ReadFile(filepath.Join(t.dstDir, "file1"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "new")
+}
+
+func (t *TempFileTestSuite) TestCopyFileDoesNotChangeOtherHardLinks(c *C) {
+	c.Assert(createFile(filepath.Join(t.srcDir, "file1"), []byte("new")), IsNil)
+	c.Assert(createFile(filepath.Join(t.dstDir, "file1"), []byte("old")), IsNil)
+	c.Assert(os.Link(filepath.Join(t.dstDir, "file1"), filepath.Join(t.dstDir, "file2")), IsNil)
+
+	err := CopyFile(filepath.Join(t.srcDir, "file1"), filepath.Join(t.dstDir, "file1"))
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(t.dstDir, "file2"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "old")
+}
+
+func (t *TempFileTestSuite) TestCopyFileKeepsDestinationPermissions(c *C) {
+	c.Assert(createFile(filepath.Join(t.srcDir, "file1"), []byte("new")), IsNil)
+	c.Assert(createFile(filepath.Join(t.dstDir, "file1"), []byte("old")), IsNil)
+	c.Assert(os.Chmod(filepath.Join(t.dstDir, "file1"), 0600), IsNil)
+
+	err := CopyFile(filepath.Join(t.srcDir, "file1"), filepath.Join(t.dstDir, "file1"))
+	c.Assert(err, IsNil)
+
+	info, err := os.Stat(filepath.Join(t.dstDir, "file1"))
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (t *TempFileTestSuite) TestCopyFileKeepsDestinationWhenSourceCannotBeRead(c *C) {
+	c.Assert(os.Mkdir(filepath.Join(t.srcDir, "file1"), 0755), IsNil)
+	c.Assert(createFile(filepath.Join(t.dstDir, "file1"), []byte("old")), IsNil)
+
+	err := CopyFile(filepath.Join(t.srcDir, "file1"), filepath.Join(t.dstDir, "file1"))
+	c.Check(err, Not(IsNil))
+
+	entries, err := ioutil.ReadDir(t.dstDir)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 1)
+
+	data, err := ioutil.ReadFile(filepath.Join(t.dstDir, "file1"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "old")
+}
+
+func (t *TempFileTestSuite) TestGenerateBackupDetailsRemovesStaleTempFiles(c *C) {
+	srcIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: time.Now()},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"dir1/.file2.backup-tmp-1234": &MockFileInfo{name: ".file2.backup-tmp-1234", mode: 0600},
+		".file1.backup-tmp-98765":     &MockFileInfo{name: ".file1.backup-tmp-98765", mode: 0600},
+		"file1.backup-tmp-1":          &MockFileInfo{name: "file1.backup-tmp-1", mode: 0600},
+	}
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, t.srcDir, t.dstDir, Options{})
+
+	c.Check(plan.Removals, DeepEquals, []Operation{
+		{Path: ".file1.backup-tmp-98765", Reason: ReasonStaleTempFile},
+		{Path: "dir1/.file2.backup-tmp-1234", Reason: ReasonStaleTempFile},
+	})
+	c.Check(operationPaths(GenerateRemovals(srcIndex, dstIndex)), DeepEquals, []string{"file1.backup-tmp-1"})
+}
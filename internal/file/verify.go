@@ -0,0 +1,272 @@
+package file
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samphillips/backup/internal/progress"
+)
+
+// Kinds of problem found when verifying a backup location against its manifest
+const (
+	ProblemMissing  = "missing"
+	ProblemExtra    = "extra"
+	ProblemCorrupt  = "corrupt"
+	ProblemMetadata = "metadata"
+)
+
+// Problem is a difference between the backup location and its manifest
+type Problem struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+// VerifyOptions controls how much of a backup location is verified
+type VerifyOptions struct {
+	// Sample is the fraction of the files whose contents are read, chosen at random. Zero reads
+	// every file.
+	Sample float64
+	// Jobs is the number of files read concurrently, at least one
+	Jobs int
+}
+
+// VerifyReport lists the problems found by Verify
+type VerifyReport struct {
+	Problems []Problem
+	// Entries is the number of entries in the manifest
+	Entries int
+	// Files is the number of files in the manifest, of which Read had their contents read
+	Files int
+	Read  int
+}
+
+// ParseSample parses a sample size given as a percentage, such as 5%, into a fraction
+func ParseSample(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("%q is not a percentage between 0 and 100", s)
+	}
+
+	return percent / 100, nil
+}
+
+// Verify compares the backup location with its manifest. Every entry is checked to exist with the
+// type, size, permissions, modification time and symlink target recorded, entries that are not in
+// the manifest are reported as extra, and the contents of files, or of a random sample of them,
+// are read again and compared with their recorded digest.
+func Verify(dstDir string, opts VerifyOptions) (*VerifyReport, error) {
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+
+	manifest, err := LoadManifest(dstDir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s has no manifest", dstDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Entries: len(manifest)}
+	index := ScanDirectory(dstDir)
+	files := []Operation{}
+
+	for path := range index {
+		if isStatePath(path) || isTempFile(path) {
+			continue
+		}
+		if _, ok := manifest[path]; !ok {
+			report.add(path, ProblemExtra, "not in the manifest")
+		}
+	}
+
+	for path, entry := range manifest {
+		if entry.Type == ManifestFile {
+			report.Files++
+		}
+
+		info, ok := index[path]
+		if !ok {
+			report.add(path, ProblemMissing, "not in the backup location")
+			continue
+		}
+
+		problem, detail := checkEntry(dstDir, entry, info)
+		if problem != "" {
+			report.add(path, problem, detail)
+		}
+
+		// A file whose permissions or modification time changed may have had its contents changed too
+		if entry.Type == ManifestFile && info.Mode().IsRegular() && problem != ProblemCorrupt {
+			files = append(files, Operation{Path: path})
+		}
+	}
+
+	files = sampleFiles(files, opts.Sample)
+	report.Read = len(files)
+
+	var lock sync.Mutex
+	bar := progress.Start(len(files) + 1)
+	runParallel(files, opts.Jobs, bar, func(op Operation) int {
+		if detail := checkContents(filepath.Join(dstDir, op.Path), manifest[op.Path]); detail != "" {
+			lock.Lock()
+			report.add(op.Path, ProblemCorrupt, detail)
+			lock.Unlock()
+			return 1
+		}
+		return 0
+	})
+	bar.Increment()
+	bar.Finish()
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Path < report.Problems[j].Path
+	})
+
+	return report, nil
+}
+
+func (r *VerifyReport) add(path, kind, detail string) {
+	r.Problems = append(r.Problems, Problem{Path: path, Kind: kind, Detail: detail})
+}
+
+// Write writes every problem found to the writer, one per line
+func (r *VerifyReport) Write(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "%s\t%s\t(%s)\n", p.Kind, p.Path, p.Detail)
+	}
+
+	return w.Flush()
+}
+
+// checkEntry compares an entry of the backup location with its manifest entry without reading its
+// contents, and returns the kind of problem and its details, if any
+func checkEntry(dstDir string, entry ManifestEntry, info os.FileInfo) (string, string) {
+	var kind string
+	switch {
+	case info.IsDir():
+		kind = ManifestDir
+	case info.Mode()&os.ModeSymlink != 0:
+		kind = ManifestSymlink
+	case info.Mode().IsRegular():
+		kind = ManifestFile
+	}
+	if kind != entry.Type {
+		return ProblemMetadata, fmt.Sprintf("is a %s, recorded as a %s", kind, entry.Type)
+	}
+
+	if kind == ManifestSymlink {
+		target, err := os.Readlink(filepath.Join(dstDir, entry.Path))
+		if err != nil {
+			return ProblemCorrupt, err.Error()
+		}
+		if target != entry.Target {
+			return ProblemCorrupt, fmt.Sprintf("links to %s, recorded as %s", target, entry.Target)
+		}
+	}
+
+	if kind == ManifestFile {
+		if size := logicalSize(filepath.Join(dstDir, entry.Path), info); size != entry.Size {
+			return ProblemCorrupt, fmt.Sprintf("size is %d bytes, recorded as %d", size, entry.Size)
+		}
+	}
+
+	if mode := info.Mode() & permissionBits; mode != entry.Mode {
+		return ProblemMetadata, fmt.Sprintf("permissions are %04o, recorded as %04o", unixPermissions(mode), unixPermissions(entry.Mode))
+	}
+
+	if !info.ModTime().Equal(entry.ModTime) {
+		return ProblemMetadata, fmt.Sprintf("modified %s, recorded as %s", info.ModTime().Format(time.RFC3339Nano), entry.ModTime.Format(time.RFC3339Nano))
+	}
+
+	return "", ""
+}
+
+// logicalSize returns the size of the contents of a file, which is recorded in the header of files
+// recorded as compressed, or -1 if a file recorded as compressed has no header for its algorithm
+func logicalSize(path string, info os.FileInfo) int64 {
+	algorithm := fileCompression(path)
+	if algorithm == "" {
+		return info.Size()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	if headerAlgorithm, size, ok := readCompressionHeader(f); ok && headerAlgorithm == algorithm {
+		return size
+	}
+
+	return -1
+}
+
+// checkContents reads the contents of a file, decompressing files recorded as compressed, and
+// returns why they do not match the size and digest recorded in the manifest entry, or an empty
+// string if they match
+func checkContents(path string, entry ManifestEntry) string {
+	algorithm, digest, ok := strings.Cut(entry.Digest, ":")
+	if !ok {
+		return "no digest recorded"
+	}
+
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return err.Error()
+	}
+
+	r, err := openLogical(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer r.Close()
+
+	sum := hasher.New()
+	n, err := io.Copy(sum, r)
+	if err != nil {
+		return err.Error()
+	}
+	if n != entry.Size {
+		return fmt.Sprintf("read %d bytes, recorded as %d", n, entry.Size)
+	}
+
+	if hex.EncodeToString(sum.Sum(nil)) != digest {
+		return fmt.Sprintf("%s digest differs from the manifest", hasher.Name())
+	}
+
+	return ""
+}
+
+// sampleFiles returns a random sample of the given fraction of the files, of at least one file,
+// or every file when the fraction is zero
+func sampleFiles(files []Operation, fraction float64) []Operation {
+	if fraction <= 0 || fraction >= 1 || len(files) == 0 {
+		return files
+	}
+
+	n := int(math.Ceil(float64(len(files)) * fraction))
+	rand.Shuffle(len(files), func(i, j int) {
+		files[i], files[j] = files[j], files[i]
+	})
+
+	return files[:n]
+}
@@ -0,0 +1,116 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "gopkg.in/check.v1"
+)
+
+type VerifyTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&VerifyTestSuite{})
+
+func (v *VerifyTestSuite) SetUpTest(c *C) {
+	v.srcDir = c.MkDir() + "/"
+	v.dstDir = c.MkDir() + "/"
+
+	c.Assert(os.Mkdir(filepath.Join(v.srcDir, "docs"), os.ModePerm), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(createFile(filepath.Join(v.srcDir, "docs", fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintf("file %d", i))), IsNil)
+	}
+	c.Assert(createFile(filepath.Join(v.srcDir, "export.csv"), bytes.Repeat([]byte("id,name,total\n1,widget,10\n"), 1000)), IsNil)
+	c.Assert(os.Symlink("docs/0.txt", filepath.Join(v.srcDir, "link")), IsNil)
+}
+
+// backup backs up the source directory with the options, writing the manifest
+func (v *VerifyTestSuite) backup(c *C, opts Options) {
+	plan := GenerateBackupDetails(ScanDirectory(v.srcDir), ScanDirectory(v.dstDir), v.srcDir, v.dstDir, opts)
+	c.Assert(plan.Apply(ApplyOptions{Manifest: true}), IsNil)
+}
+
+func (v *VerifyTestSuite) TestVerifiesUnchangedBackup(c *C) {
+	for _, opts := range []Options{{}, {Archive: true, Compression: CompressionZstd}} {
+		v.dstDir = c.MkDir() + "/"
+		v.backup(c, opts)
+
+		report, err := Verify(v.dstDir, VerifyOptions{Jobs: 2})
+		c.Assert(err, IsNil)
+		c.Check(report.Problems, HasLen, 0)
+		c.Check(report.Entries, Equals, 13)
+		c.Check(report.Files, Equals, 11)
+		c.Check(report.Read, Equals, 11)
+	}
+}
+
+func (v *VerifyTestSuite) TestReportsProblems(c *C) {
+	v.backup(c, Options{})
+
+	info, err := os.Stat(filepath.Join(v.dstDir, "docs", "2.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(createFile(filepath.Join(v.dstDir, "docs", "2.txt"), []byte("FILE 2")), IsNil)
+	c.Assert(os.Chtimes(filepath.Join(v.dstDir, "docs", "2.txt"), info.ModTime(), info.ModTime()), IsNil)
+	c.Assert(os.Chmod(filepath.Join(v.dstDir, "docs", "3.txt"), 0600), IsNil)
+	c.Assert(os.Remove(filepath.Join(v.dstDir, "docs", "4.txt")), IsNil)
+	c.Assert(createFile(filepath.Join(v.dstDir, "docs", "5.txt"), []byte("longer file 5")), IsNil)
+	c.Assert(createFile(filepath.Join(v.dstDir, "docs", "6.txt"), []byte("FILE 6")), IsNil)
+	c.Assert(os.Remove(filepath.Join(v.dstDir, "link")), IsNil)
+	c.Assert(os.Symlink("docs/1.txt", filepath.Join(v.dstDir, "link")), IsNil)
+	c.Assert(createFile(filepath.Join(v.dstDir, "extra"), []byte("extra")), IsNil)
+
+	report, err := Verify(v.dstDir, VerifyOptions{})
+	c.Assert(err, IsNil)
+
+	kinds := map[string][]string{}
+	for _, p := range report.Problems {
+		kinds[p.Path] = append(kinds[p.Path], p.Kind)
+	}
+	sort.Strings(kinds["docs/6.txt"])
+	c.Check(kinds, DeepEquals, map[string][]string{
+		"docs":       {ProblemMetadata},
+		"docs/2.txt": {ProblemCorrupt},
+		"docs/3.txt": {ProblemMetadata},
+		"docs/4.txt": {ProblemMissing},
+		"docs/5.txt": {ProblemCorrupt},
+		"docs/6.txt": {ProblemCorrupt, ProblemMetadata},
+		"extra":      {ProblemExtra},
+		"link":       {ProblemCorrupt},
+	})
+}
+
+func (v *VerifyTestSuite) TestReadsSample(c *C) {
+	v.backup(c, Options{})
+
+	report, err := Verify(v.dstDir, VerifyOptions{Sample: 0.05})
+	c.Assert(err, IsNil)
+	c.Check(report.Problems, HasLen, 0)
+	c.Check(report.Read, Equals, 1)
+
+	report, err = Verify(v.dstDir, VerifyOptions{Sample: 0.5})
+	c.Assert(err, IsNil)
+	c.Check(report.Read, Equals, 6)
+}
+
+func (v *VerifyTestSuite) TestRequiresManifest(c *C) {
+	_, err := Verify(v.dstDir, VerifyOptions{})
+	c.Check(err, ErrorMatches, ".* has no manifest")
+}
+
+func (v *VerifyTestSuite) TestParseSample(c *C) {
+	for s, expected := range map[string]float64{"": 0, "5%": 0.05, "100%": 1, "12.5": 0.125} {
+		sample, err := ParseSample(s)
+		c.Assert(err, IsNil, Commentf(s))
+		c.Check(sample, Equals, expected, Commentf(s))
+	}
+
+	for _, s := range []string{"0%", "101%", "five", "-5%"} {
+		_, err := ParseSample(s)
+		c.Check(err, NotNil, Commentf(s))
+	}
+}
@@ -0,0 +1,108 @@
+package file
+
+import (
+	"bytes"
+	"os"
+	"strings"
+)
+
+const (
+	// aclAccess is the extended attribute holding a POSIX access ACL
+	aclAccess = "system.posix_acl_access"
+	// aclDefault is the extended attribute holding a POSIX default ACL of a directory
+	aclDefault = "system.posix_acl_default"
+)
+
+// wantXattr reports whether the named extended attribute is preserved by the options. Only user
+// attributes are preserved unless running as root, when trusted and security attributes are
+// preserved too. The digests recorded at the backup location are never preserved.
+func wantXattr(name string, opts Options) bool {
+	if name == aclAccess || name == aclDefault {
+		return opts.ACLs
+	}
+
+	if !opts.Xattrs || isDigestXattr(name) {
+		return false
+	}
+
+	if strings.HasPrefix(name, "user.") {
+		return true
+	}
+
+	return os.Geteuid() == 0 && (strings.HasPrefix(name, "trusted.") || strings.HasPrefix(name, "security."))
+}
+
+// readXattrs returns the extended attributes of the path that are preserved by the options
+func readXattrs(path string, opts Options) (map[string][]byte, error) {
+	all, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string][]byte{}
+	for name, value := range all {
+		if wantXattr(name, opts) {
+			xattrs[name] = value
+		}
+	}
+
+	return xattrs, nil
+}
+
+// xattrsDiffer reports whether the preserved extended attributes of the two paths differ
+func xattrsDiffer(srcPath, dstPath string, opts Options) (bool, error) {
+	srcXattrs, err := readXattrs(srcPath, opts)
+	if err != nil {
+		return false, err
+	}
+
+	dstXattrs, err := readXattrs(dstPath, opts)
+	if err != nil {
+		return false, err
+	}
+
+	if len(srcXattrs) != len(dstXattrs) {
+		return true, nil
+	}
+
+	for name, value := range srcXattrs {
+		if dstValue, ok := dstXattrs[name]; !ok || !bytes.Equal(value, dstValue) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// copyXattrs makes the preserved extended attributes of the destination path match the source
+// path, removing any the source does not have
+func copyXattrs(srcPath, dstPath string, opts Options) error {
+	srcXattrs, err := readXattrs(srcPath, opts)
+	if err != nil {
+		return err
+	}
+
+	dstXattrs, err := readXattrs(dstPath, opts)
+	if err != nil {
+		return err
+	}
+
+	for name := range dstXattrs {
+		if _, ok := srcXattrs[name]; !ok {
+			if err := removeXattr(dstPath, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, value := range srcXattrs {
+		if dstValue, ok := dstXattrs[name]; ok && bytes.Equal(value, dstValue) {
+			continue
+		}
+		if err := setXattr(dstPath, name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
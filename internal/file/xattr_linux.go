@@ -0,0 +1,71 @@
+package file
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns every extended attribute of the path without following symlinks. Filesystems
+// without extended attribute support are treated as having none.
+func listXattrs(path string) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return xattrs, nil
+	}
+	if err != nil || size == 0 {
+		return xattrs, err
+	}
+
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		value, err := getXattr(path, string(name))
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[string(name)] = value
+	}
+
+	return xattrs, nil
+}
+
+// getXattr returns the value of the named extended attribute without following symlinks
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+// setXattr sets the named extended attribute without following symlinks
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// removeXattr removes the named extended attribute without following symlinks
+func removeXattr(path, name string) error {
+	return unix.Lremovexattr(path, name)
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"errors"
+)
+
+// errXattrsUnsupported is returned when setting extended attributes on this platform
+var errXattrsUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// listXattrs returns no extended attributes as they are not supported on this platform
+func listXattrs(path string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+// getXattr is not supported on this platform
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errXattrsUnsupported
+}
+
+// setXattr is not supported on this platform
+func setXattr(path, name string, value []byte) error {
+	return errXattrsUnsupported
+}
+
+// removeXattr is not supported on this platform
+func removeXattr(path, name string) error {
+	return errXattrsUnsupported
+}
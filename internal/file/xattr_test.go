@@ -0,0 +1,78 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type XattrTestSuite struct {
+	srcDir string
+	dstDir string
+}
+
+var _ = Suite(&XattrTestSuite{})
+
+func (x *XattrTestSuite) SetUpTest(c *C) {
+	x.srcDir = c.MkDir()
+	x.dstDir = c.MkDir()
+
+	probe := filepath.Join(x.srcDir, "probe")
+	c.Assert(createFile(probe, []byte{}), IsNil)
+	if err := setXattr(probe, "user.backup.probe", []byte{'1'}); err != nil {
+		c.Skip("extended attributes are not supported: " + err.Error())
+	}
+	c.Assert(os.Remove(probe), IsNil)
+}
+
+func (x *XattrTestSuite) TestCopyMetadataCopiesAndRemovesUserXattrs(c *C) {
+	srcFile := filepath.Join(x.srcDir, "file1")
+	dstFile := filepath.Join(x.dstDir, "file1")
+
+	c.Assert(createFile(srcFile, []byte{'a'}), IsNil)
+	c.Assert(createFile(dstFile, []byte{'a'}), IsNil)
+	c.Assert(setXattr(srcFile, "user.colour", []byte("blue")), IsNil)
+	c.Assert(setXattr(dstFile, "user.stale", []byte("yes")), IsNil)
+
+	err := CopyMetadata(srcFile, dstFile, Options{Xattrs: true})
+	c.Check(err, IsNil)
+
+	xattrs, err := readXattrs(dstFile, Options{Xattrs: true})
+	c.Check(err, IsNil)
+	c.Check(xattrs, DeepEquals, map[string][]byte{
+		"user.colour": []byte("blue"),
+	})
+}
+
+func (x *XattrTestSuite) TestGenerateBackupDetailsAddsXattrDifferences(c *C) {
+	c.Assert(createFile(filepath.Join(x.srcDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(createFile(filepath.Join(x.dstDir, "file1"), []byte{'a'}), IsNil)
+	c.Assert(setXattr(filepath.Join(x.srcDir, "file1"), "user.colour", []byte("blue")), IsNil)
+
+	srcIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: time.Unix(1, 0)},
+	}
+
+	dstIndex := map[string]os.FileInfo{
+		"file1": &MockFileInfo{name: "file1", size: 1, mode: 0644, modTime: time.Unix(1, 0)},
+	}
+
+	plan := GenerateBackupDetails(srcIndex, dstIndex, x.srcDir, x.dstDir, Options{})
+	c.Check(plan.Metadata, HasLen, 0)
+
+	plan = GenerateBackupDetails(srcIndex, dstIndex, x.srcDir, x.dstDir, Options{Xattrs: true})
+	c.Check(plan.Files, HasLen, 0)
+	c.Check(plan.Metadata, DeepEquals, []Operation{
+		{Path: "file1", Reason: ReasonXattrsDiffer},
+	})
+}
+
+func (*XattrTestSuite) TestWantXattrSelectsACLsSeparately(c *C) {
+	c.Check(wantXattr(aclAccess, Options{Xattrs: true}), Equals, false)
+	c.Check(wantXattr(aclAccess, Options{ACLs: true}), Equals, true)
+	c.Check(wantXattr(aclDefault, Options{ACLs: true}), Equals, true)
+	c.Check(wantXattr("user.colour", Options{ACLs: true}), Equals, false)
+	c.Check(wantXattr("user.colour", Options{Xattrs: true}), Equals, true)
+}
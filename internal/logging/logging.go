@@ -2,6 +2,7 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	golog "log"
 	"os"
 	"strings"
@@ -53,8 +54,15 @@ func init() {
 	log.Warn = golog.New(os.Stdout, ColourOrange("[WARN] "), flags)
 	log.Error = golog.New(os.Stdout, ColourRed("[ERROR] "), flags)
 	log.Fatal = golog.New(os.Stdout, ColourRed("[FATAL] "), flags)
+	log.Level = logLevels[INFO]
+}
 
-	SetLogLevel(INFO)
+// SetOutput sends every log message to the writer instead of standard output, so standard output
+// can carry data
+func SetOutput(w io.Writer) {
+	for _, l := range []*golog.Logger{log.Debug, log.Info, log.Warn, log.Error, log.Fatal} {
+		l.SetOutput(w)
+	}
 }
 
 // SetLogLevel sets the logger to log up to a certain level
@@ -0,0 +1,180 @@
+package repo
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/samphillips/backup/internal/file"
+	"github.com/samphillips/backup/internal/logging"
+	"github.com/samphillips/backup/internal/progress"
+)
+
+// BackupStats counts what a backup stored
+type BackupStats struct {
+	// Files is the number of files in the snapshot
+	Files int
+	// ChunkedFiles is the number of files read and chunked because they changed
+	ChunkedFiles int
+	// Bytes is the logical size of the chunked files
+	Bytes int64
+	// NewBytes is the size of the chunks that were not already stored
+	NewBytes int64
+	// Failed is the number of files that could not be read, which are left out of the snapshot
+	Failed int
+}
+
+// backup holds the state of a backup into the repository
+type backup struct {
+	repo            *Repository
+	srcDir          string
+	srcIndex        map[string]os.FileInfo
+	children        map[string][]string
+	changed         map[string]bool
+	parent          map[string]*Node
+	includeSymlinks bool
+	stats           BackupStats
+}
+
+// Backup stores a snapshot of the scanned source directory. Only the files the plan copies are
+// read and chunked, the contents of every other file are taken from the parent snapshot the plan
+// was generated against. Files that cannot be read are logged and left out of the snapshot.
+func (r *Repository) Backup(srcDir string, srcIndex map[string]os.FileInfo, plan *file.Plan, parent *Snapshot, parentNodes map[string]*Node, includeSymlinks bool) (*Snapshot, BackupStats, error) {
+	b := &backup{
+		repo:            r,
+		srcDir:          srcDir,
+		srcIndex:        srcIndex,
+		children:        map[string][]string{},
+		changed:         map[string]bool{},
+		parent:          parentNodes,
+		includeSymlinks: includeSymlinks,
+	}
+
+	for path := range srcIndex {
+		dir := filepath.Dir(path)
+		b.children[dir] = append(b.children[dir], path)
+	}
+
+	for _, op := range plan.Files {
+		b.changed[op.Path] = true
+	}
+
+	logging.Info("Storing changed files in repository")
+	bar := progress.Start(len(plan.Files) + 1)
+	tree, err := b.saveTree(".", func() { bar.Increment() })
+	bar.Increment()
+	bar.Finish()
+
+	if err != nil {
+		return nil, b.stats, err
+	}
+
+	if err := r.Flush(); err != nil {
+		return nil, b.stats, err
+	}
+
+	snapshot := &Snapshot{Time: time.Now().UTC(), Source: srcDir, Tree: tree}
+	if parent != nil {
+		snapshot.Parent = parent.ID
+	}
+
+	if err := r.SaveSnapshot(snapshot); err != nil {
+		return nil, b.stats, err
+	}
+
+	return snapshot, b.stats, nil
+}
+
+// saveTree stores the listing of the directory, and the listings of the directories inside it
+func (b *backup) saveTree(dir string, chunked func()) (string, error) {
+	paths := b.children[dir]
+	sort.Strings(paths)
+
+	tree := &Tree{Nodes: []Node{}}
+	for _, path := range paths {
+		info := b.srcIndex[path]
+		node := Node{Name: filepath.Base(path), Mode: info.Mode(), ModTime: info.ModTime()}
+
+		switch {
+		case info.IsDir():
+			subtree, err := b.saveTree(path, chunked)
+			if err != nil {
+				return "", err
+			}
+			node.Type = NodeDir
+			node.Subtree = subtree
+		case info.Mode()&os.ModeSymlink != 0:
+			if !b.includeSymlinks {
+				continue
+			}
+			target, err := os.Readlink(filepath.Join(b.srcDir, path))
+			if err != nil {
+				logging.Warn("Error reading file %s symlink: %s", path, err)
+				continue
+			}
+			node.Type = NodeSymlink
+			node.Target = target
+		case info.Mode().IsRegular():
+			node.Type = NodeFile
+			node.Size = info.Size()
+
+			if prev, ok := b.parent[path]; ok && !b.changed[path] && prev.Type == NodeFile {
+				node.Content = prev.Content
+			} else {
+				content, err := b.saveFile(path)
+				chunked()
+				if err != nil {
+					logging.Error("Failed to store file %s: %s", filepath.Join(b.srcDir, path), err)
+					b.stats.Failed++
+					continue
+				}
+				node.Content = content
+			}
+			b.stats.Files++
+		default:
+			logging.Warn("Skipping %s as it is not a regular file, directory or symlink", path)
+			continue
+		}
+
+		tree.Nodes = append(tree.Nodes, node)
+	}
+
+	return b.repo.SaveTree(tree)
+}
+
+// saveFile splits the file into chunks and stores any chunk not already stored
+func (b *backup) saveFile(path string) ([]string, error) {
+	f, err := os.Open(filepath.Join(b.srcDir, path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	logging.Debug("Chunking %s", path)
+	b.stats.ChunkedFiles++
+
+	content := []string{}
+	chunker := NewChunker(f, b.repo.config.Chunker)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id, stored, err := b.repo.SaveBlob(BlobData, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		b.stats.Bytes += int64(len(chunk))
+		if stored {
+			b.stats.NewBytes += int64(len(chunk))
+		}
+		content = append(content, id)
+	}
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"io"
+)
+
+// Chunker parameters used by new repositories. They are recorded in the repository config, since
+// changing them would stop new chunks matching the chunks already stored.
+const (
+	// DefaultMinChunkSize is the smallest chunk cut, other than the last chunk of a file
+	DefaultMinChunkSize = 512 << 10
+	// DefaultAvgChunkSize is the chunk size the cut points are tuned to average
+	DefaultAvgChunkSize = 1 << 20
+	// DefaultMaxChunkSize is the largest chunk cut
+	DefaultMaxChunkSize = 8 << 20
+)
+
+// gear holds the random value each byte adds to the rolling hash. It is generated from a fixed seed
+// so every run cuts the same data into the same chunks.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+
+	// splitmix64
+	state := uint64(0x6261636b7570) // "backup"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// ChunkerParams are the sizes the chunker aims for
+type ChunkerParams struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+// DefaultChunkerParams returns the chunker parameters used by new repositories
+func DefaultChunkerParams() ChunkerParams {
+	return ChunkerParams{Min: DefaultMinChunkSize, Avg: DefaultAvgChunkSize, Max: DefaultMaxChunkSize}
+}
+
+// Chunker splits a stream into content-defined chunks using FastCDC. Cut points depend only on
+// the bytes just before them, so inserting or removing data only changes the chunks around the
+// change and the rest of the stream still splits into the same chunks.
+type Chunker struct {
+	r      io.Reader
+	params ChunkerParams
+	maskS  uint64
+	maskL  uint64
+
+	buf []byte
+	eof bool
+}
+
+// NewChunker creates a chunker reading from the reader
+func NewChunker(r io.Reader, params ChunkerParams) *Chunker {
+	bits := uint(0)
+	for 1<<(bits+1) <= params.Avg {
+		bits++
+	}
+
+	// Cuts are harder to find before the average size and easier after it, which keeps chunk sizes
+	// close to the average
+	return &Chunker{
+		r:      r,
+		params: params,
+		maskS:  ^uint64(0) << (64 - (bits + 2)),
+		maskL:  ^uint64(0) << (64 - (bits - 2)),
+		buf:    make([]byte, 0, params.Max),
+	}
+}
+
+// Next returns the next chunk of the stream, or io.EOF once the stream is exhausted
+func (c *Chunker) Next() ([]byte, error) {
+	for !c.eof && len(c.buf) < cap(c.buf) {
+		n, err := c.r.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cutPoint(c.buf)
+	chunk := append([]byte{}, c.buf[:cut]...)
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+
+	return chunk, nil
+}
+
+// cutPoint returns the length of the chunk at the start of the data
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.params.Min {
+		return n
+	}
+
+	normal := c.params.Avg
+	if normal > n {
+		normal = n
+	}
+
+	fp := uint64(0)
+	i := c.params.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
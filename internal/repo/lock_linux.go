@@ -0,0 +1,31 @@
+package repo
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockRepository takes a shared or exclusive lock on the lock file, creating it if needed. It does
+// not wait for a conflicting lock to be released. The lock is held until the file is closed or the
+// process exits.
+func lockRepository(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,228 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PruneStats describes the data removed, or that would be removed, from a repository
+type PruneStats struct {
+	// UnusedBlobs is the number of blobs no snapshot refers to
+	UnusedBlobs int
+	// UnusedBytes is the size of the blobs no snapshot refers to
+	UnusedBytes int64
+	// DeletedPacks is the number of packs that only held unused blobs
+	DeletedPacks int
+	// RepackedPacks is the number of packs holding both used and unused blobs, whose used blobs are
+	// rewritten to new packs
+	RepackedPacks int
+}
+
+// forget removes a snapshot from the repository, leaving the data it refers to
+func (r *Repository) forget(s *Snapshot) error {
+	return os.Remove(filepath.Join(r.dir, snapshotDir, s.ID+".json"))
+}
+
+// Prune removes the snapshots, then every blob that no remaining snapshot refers to. Blobs shared
+// with a remaining snapshot are kept. Packs holding only unused blobs are deleted and packs holding
+// some are rewritten without them. New packs and the new index are written before any pack is
+// deleted, so an interrupted prune only ever leaves unused data behind. Nothing is changed when
+// running dry. The repository must be opened with OpenExclusive, so no backup that may refer to
+// blobs no snapshot refers to yet is in progress.
+func (r *Repository) Prune(forget []*Snapshot, dryRun bool) (PruneStats, error) {
+	stats := PruneStats{}
+
+	if !r.exclusive {
+		return stats, errors.New("the repository must be opened exclusively to prune it")
+	}
+
+	used, err := r.usedBlobs(forget)
+	if err != nil {
+		return stats, err
+	}
+
+	if !dryRun {
+		for _, s := range forget {
+			if err := r.forget(s); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	packs := map[string][]string{}
+	for id, loc := range r.blobs {
+		packs[loc.Pack] = append(packs[loc.Pack], id)
+		if !used[id] {
+			stats.UnusedBlobs++
+			stats.UnusedBytes += loc.Length
+		}
+	}
+
+	remove := []string{}
+	repack := []string{}
+	for pack, blobs := range packs {
+		unused := 0
+		for _, id := range blobs {
+			if !used[id] {
+				unused++
+			}
+		}
+
+		switch {
+		case unused == len(blobs):
+			stats.DeletedPacks++
+			remove = append(remove, pack)
+		case unused > 0:
+			stats.RepackedPacks++
+			remove = append(remove, pack)
+			repack = append(repack, pack)
+		}
+	}
+
+	if dryRun || len(remove) == 0 {
+		return stats, nil
+	}
+
+	// The used blobs are copied out of the packs being rewritten one at a time, so only the blob
+	// being copied and the new pack being filled are held in memory
+	sort.Strings(repack)
+	for _, pack := range repack {
+		ids := packs[pack]
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			if !used[id] {
+				continue
+			}
+
+			data, err := r.LoadBlob(id)
+			if err != nil {
+				return stats, err
+			}
+
+			// Forgetting where the blob is stored makes SaveBlob store it again in a new pack
+			t := r.blobs[id].Type
+			delete(r.blobs, id)
+			if _, _, err := r.SaveBlob(t, data); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	// Blobs still stored in the removed packs are unused, as the used ones now have new locations
+	for _, pack := range remove {
+		for _, id := range packs[pack] {
+			if loc, ok := r.blobs[id]; ok && loc.Pack == pack {
+				delete(r.blobs, id)
+			}
+		}
+	}
+
+	if err := r.Flush(); err != nil {
+		return stats, err
+	}
+
+	if err := r.rewriteIndex(); err != nil {
+		return stats, err
+	}
+
+	for _, pack := range remove {
+		if err := os.Remove(r.packPath(pack)); err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// usedBlobs returns the IDs of every blob referred to by a snapshot other than those forgotten
+func (r *Repository) usedBlobs(forget []*Snapshot) (map[string]bool, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	forgotten := map[string]bool{}
+	for _, s := range forget {
+		forgotten[s.ID] = true
+	}
+
+	used := map[string]bool{}
+	for _, s := range snapshots {
+		if forgotten[s.ID] {
+			continue
+		}
+		if err := r.markTree(s.Tree, used); err != nil {
+			return nil, err
+		}
+	}
+
+	return used, nil
+}
+
+// markTree marks the tree and every blob below it as used. Subtrees already marked are shared with
+// a tree already walked, so are not walked again.
+func (r *Repository) markTree(treeID string, used map[string]bool) error {
+	if used[treeID] {
+		return nil
+	}
+	used[treeID] = true
+
+	tree, err := r.LoadTree(treeID)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range tree.Nodes {
+		for _, id := range node.Content {
+			used[id] = true
+		}
+
+		if node.Type == NodeDir && node.Subtree != "" {
+			if err := r.markTree(node.Subtree, used); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteIndex replaces every index file with a single index of the blobs currently stored
+func (r *Repository) rewriteIndex() error {
+	r.lock.Lock()
+	data, err := json.Marshal(indexFile{Blobs: r.blobs})
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:]) + ".json"
+	if err := writeFileAtomic(filepath.Join(r.dir, indexDir, name), data); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(r.dir, indexDir))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.Name() == name || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.dir, indexDir, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
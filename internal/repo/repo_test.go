@@ -0,0 +1,261 @@
+package repo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samphillips/backup/internal/file"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RepoTestSuite struct {
+	srcDir  string
+	repoDir string
+}
+
+var _ = Suite(&RepoTestSuite{})
+
+var testParams = ChunkerParams{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+
+func (s *RepoTestSuite) SetUpTest(c *C) {
+	s.srcDir = c.MkDir() + "/"
+	s.repoDir = c.MkDir() + "/"
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunks(c *C, data []byte) [][]byte {
+	chunker := NewChunker(bytes.NewReader(data), testParams)
+	result := [][]byte{}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return result
+		}
+		c.Assert(err, IsNil)
+		result = append(result, chunk)
+	}
+}
+
+func (s *RepoTestSuite) TestChunkerCutsWithinLimits(c *C) {
+	data := randomData(1, 1<<20)
+	result := chunks(c, data)
+
+	c.Check(bytes.Join(result, nil), DeepEquals, data)
+	for _, chunk := range result[:len(result)-1] {
+		c.Check(len(chunk) >= testParams.Min && len(chunk) <= testParams.Max, Equals, true)
+	}
+}
+
+func (s *RepoTestSuite) TestChunkerResynchronisesAfterInsertion(c *C) {
+	data := randomData(1, 1<<20)
+	inserted := append(append(append([]byte{}, data[:1000]...), []byte("inserted")...), data[1000:]...)
+
+	original := map[string]bool{}
+	for _, chunk := range chunks(c, data) {
+		original[string(chunk)] = true
+	}
+
+	result := chunks(c, inserted)
+	changed := 0
+	for _, chunk := range result {
+		if !original[string(chunk)] {
+			changed++
+		}
+	}
+
+	c.Check(changed <= 2, Equals, true, Commentf("%d of %d chunks changed", changed, len(result)))
+}
+
+func (s *RepoTestSuite) backup(c *C, r *Repository) (*Snapshot, BackupStats) {
+	srcIndex := file.ScanDirectory(s.srcDir)
+
+	parent, err := r.LatestSnapshot(s.srcDir)
+	c.Assert(err, IsNil)
+
+	parentNodes, parentIndex := map[string]*Node{}, map[string]os.FileInfo{}
+	if parent != nil {
+		parentNodes, parentIndex, err = r.Index(parent.Tree)
+		c.Assert(err, IsNil)
+	}
+
+	plan := file.GenerateBackupDetails(srcIndex, parentIndex, s.srcDir, s.repoDir, file.Options{QuickCheck: true})
+
+	snapshot, stats, err := r.Backup(s.srcDir, srcIndex, plan, parent, parentNodes, true)
+	c.Assert(err, IsNil)
+
+	return snapshot, stats
+}
+
+func (s *RepoTestSuite) readFile(c *C, r *Repository, node *Node) []byte {
+	var data []byte
+	for _, id := range node.Content {
+		chunk, err := r.LoadBlob(id)
+		c.Assert(err, IsNil)
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func (s *RepoTestSuite) TestBackupStoresDuplicateDataOnce(c *C) {
+	r, err := Init(s.repoDir)
+	c.Assert(err, IsNil)
+	r.config.Chunker = testParams
+
+	data := randomData(1, 256<<10)
+	c.Assert(os.Mkdir(filepath.Join(s.srcDir, "dir1"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file1"), data, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "dir1", "file2"), data, 0644), IsNil)
+	c.Assert(os.Symlink("file1", filepath.Join(s.srcDir, "link1")), IsNil)
+
+	snapshot, stats := s.backup(c, r)
+	c.Check(stats.Files, Equals, 2)
+	c.Check(stats.Bytes, Equals, int64(2*len(data)))
+	c.Check(stats.NewBytes, Equals, int64(len(data)))
+
+	r, err = Open(s.repoDir)
+	c.Assert(err, IsNil)
+
+	nodes, _, err := r.Index(snapshot.Tree)
+	c.Assert(err, IsNil)
+	c.Check(nodes["dir1"].Type, Equals, NodeDir)
+	c.Check(nodes["link1"].Target, Equals, "file1")
+	c.Check(bytes.Equal(s.readFile(c, r, nodes["dir1/file2"]), data), Equals, true)
+}
+
+func (s *RepoTestSuite) TestBackupOnlyChunksChangedFiles(c *C) {
+	r, err := Init(s.repoDir)
+	c.Assert(err, IsNil)
+	r.config.Chunker = testParams
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file1"), randomData(1, 64<<10), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file2"), randomData(2, 64<<10), 0644), IsNil)
+
+	first, _ := s.backup(c, r)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file2"), randomData(3, 64<<10), 0644), IsNil)
+
+	second, stats := s.backup(c, r)
+	c.Check(stats.ChunkedFiles, Equals, 1)
+	c.Check(second.Parent, Equals, first.ID)
+
+	snapshots, err := r.Snapshots()
+	c.Assert(err, IsNil)
+	c.Check(snapshots, HasLen, 2)
+
+	nodes, _, err := r.Index(second.Tree)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(s.readFile(c, r, nodes["file2"]), randomData(3, 64<<10)), Equals, true)
+}
+
+func (s *RepoTestSuite) TestPruneKeepsDataSharedWithKeptSnapshots(c *C) {
+	r, err := Init(s.repoDir)
+	c.Assert(err, IsNil)
+	r.config.Chunker = testParams
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file1"), randomData(1, 64<<10), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file2"), randomData(2, 64<<10), 0644), IsNil)
+
+	first, _ := s.backup(c, r)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "file2"), randomData(3, 64<<10), 0644), IsNil)
+
+	second, _ := s.backup(c, r)
+
+	_, err = r.Prune([]*Snapshot{first}, true)
+	c.Check(err, ErrorMatches, ".* opened exclusively .*")
+
+	// A repository open for backing up cannot be pruned until it is closed
+	_, err = OpenExclusive(s.repoDir)
+	c.Check(err, Equals, ErrLocked)
+	c.Assert(r.Close(), IsNil)
+
+	r, err = OpenExclusive(s.repoDir)
+	c.Assert(err, IsNil)
+	_, err = Open(s.repoDir)
+	c.Check(err, Equals, ErrLocked)
+
+	dryRun, err := r.Prune([]*Snapshot{first}, true)
+	c.Assert(err, IsNil)
+	snapshots, err := r.Snapshots()
+	c.Assert(err, IsNil)
+	c.Check(snapshots, HasLen, 2)
+
+	stats, err := r.Prune([]*Snapshot{first}, false)
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, dryRun)
+	c.Check(stats.RepackedPacks, Equals, 1)
+	c.Check(stats.UnusedBytes >= 64<<10 && stats.UnusedBytes < 72<<10, Equals, true, Commentf("%d bytes unused", stats.UnusedBytes))
+	c.Assert(r.Close(), IsNil)
+
+	r, err = OpenExclusive(s.repoDir)
+	c.Assert(err, IsNil)
+
+	snapshots, err = r.Snapshots()
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 1)
+	c.Check(snapshots[0].ID, Equals, second.ID)
+
+	nodes, _, err := r.Index(second.Tree)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(s.readFile(c, r, nodes["file1"]), randomData(1, 64<<10)), Equals, true)
+	c.Check(bytes.Equal(s.readFile(c, r, nodes["file2"]), randomData(3, 64<<10)), Equals, true)
+
+	stats, err = r.Prune(nil, false)
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, PruneStats{})
+}
+
+func (s *RepoTestSuite) TestRestoreSnapshot(c *C) {
+	r, err := Init(s.repoDir)
+	c.Assert(err, IsNil)
+	r.config.Chunker = testParams
+
+	data := randomData(1, 64<<10)
+	c.Assert(os.Mkdir(filepath.Join(s.srcDir, "dir1"), 0750), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.srcDir, "dir1", "file1"), data, 0600), IsNil)
+	c.Assert(os.Symlink("dir1/file1", filepath.Join(s.srcDir, "link1")), IsNil)
+
+	first, _ := s.backup(c, r)
+
+	snapshot, err := r.FindSnapshot(first.ID[:8])
+	c.Assert(err, IsNil)
+	c.Check(snapshot.ID, Equals, first.ID)
+
+	source, err := r.RestoreSource(snapshot)
+	c.Assert(err, IsNil)
+
+	targetDir := c.MkDir()
+	plan, err := file.PlanRestore(source, targetDir, file.RestoreOptions{Metadata: file.Options{Archive: true}})
+	c.Assert(err, IsNil)
+	c.Assert(plan.Apply(), IsNil)
+
+	restored, err := ioutil.ReadFile(filepath.Join(targetDir, "dir1", "file1"))
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(restored, data), Equals, true)
+
+	info, err := os.Stat(filepath.Join(targetDir, "dir1", "file1"))
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+	srcInfo, err := os.Stat(filepath.Join(s.srcDir, "dir1", "file1"))
+	c.Assert(err, IsNil)
+	c.Check(info.ModTime().Equal(srcInfo.ModTime()), Equals, true)
+
+	target, err := os.Readlink(filepath.Join(targetDir, "link1"))
+	c.Assert(err, IsNil)
+	c.Check(target, Equals, "dir1/file1")
+
+	_, err = r.FindSnapshot("zz")
+	c.Check(err, ErrorMatches, "no snapshot starts with zz")
+}
@@ -0,0 +1,392 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// configFile holds the repository config at the root of a repository
+	configFile = "config.json"
+	// dataDir holds the pack files of a repository
+	dataDir = "data"
+	// indexDir holds the index files listing which pack each blob is stored in
+	indexDir = "index"
+	// snapshotDir holds a file for each snapshot of a repository
+	snapshotDir = "snapshots"
+	// packSize is the size pack files are filled to before they are written
+	packSize = 16 << 20
+	// version is the repository format version written by this version of backup
+	version = 1
+	// hashSHA256 names the hash that blob and pack IDs are calculated with
+	hashSHA256 = "sha256"
+	// lockName is the file at the root of a repository locked by every process with it open
+	lockName = "lock"
+)
+
+var (
+	// ErrNotRepository is returned when opening a directory that is not a repository
+	ErrNotRepository = errors.New("not a backup repository")
+	// ErrLocked is returned when opening a repository that another process holds a conflicting
+	// lock on
+	ErrLocked = errors.New("repository is in use by another backup, restore or prune")
+)
+
+// BlobType identifies what a blob holds
+type BlobType string
+
+const (
+	// BlobData is a chunk of the contents of a file
+	BlobData BlobType = "data"
+	// BlobTree is a directory listing
+	BlobTree BlobType = "tree"
+)
+
+// Config describes how a repository stores its data
+type Config struct {
+	Version int           `json:"version"`
+	Hash    string        `json:"hash"`
+	Chunker ChunkerParams `json:"chunker"`
+}
+
+// location is where a blob is stored
+type location struct {
+	Type   BlobType `json:"type"`
+	Pack   string   `json:"pack"`
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+}
+
+// indexFile lists the blobs stored in the packs written by one run
+type indexFile struct {
+	Blobs map[string]location `json:"blobs"`
+}
+
+// Repository is a deduplicating backup repository. File contents are split into content-defined
+// chunks, and each distinct chunk and directory listing is stored once as a blob, named by its
+// SHA-256 hash, in a pack file.
+type Repository struct {
+	dir       string
+	config    Config
+	lockFile  *os.File
+	exclusive bool
+
+	lock    sync.Mutex
+	blobs   map[string]location
+	pending map[string]location
+	pack    bytes.Buffer
+	index   map[string]location
+}
+
+// Exists reports whether the directory holds a repository
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, configFile))
+	return err == nil
+}
+
+// Init creates a new repository in the directory, which must not already hold one
+func Init(dir string) (*Repository, error) {
+	if Exists(dir) {
+		return nil, fmt.Errorf("%s is already a backup repository", dir)
+	}
+
+	for _, sub := range []string{dataDir, indexDir, snapshotDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	config := Config{Version: version, Hash: hashSHA256, Chunker: DefaultChunkerParams()}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, configFile), append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	return Open(dir)
+}
+
+// Open opens the repository in the directory for backing up and restoring, and reads its index.
+// The repository is locked so it cannot be pruned until it is closed, but it can be opened by other
+// backups and restores.
+func Open(dir string) (*Repository, error) {
+	return open(dir, false)
+}
+
+// OpenExclusive opens the repository in the directory for pruning, and reads its index. The
+// repository is locked so it cannot be opened by anything else until it is closed.
+func OpenExclusive(dir string) (*Repository, error) {
+	return open(dir, true)
+}
+
+func open(dir string, exclusive bool) (*Repository, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, configFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotRepository
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Repository{
+		dir:     dir,
+		blobs:   map[string]location{},
+		pending: map[string]location{},
+		index:   map[string]location{},
+	}
+
+	if err := json.Unmarshal(data, &r.config); err != nil {
+		return nil, err
+	}
+	if r.config.Version != version || r.config.Hash != hashSHA256 {
+		return nil, fmt.Errorf("unsupported repository version %d using %s", r.config.Version, r.config.Hash)
+	}
+
+	// The lock is taken before the index is read, so the index cannot be changed by a prune while
+	// the repository is open
+	if r.lockFile, err = lockRepository(filepath.Join(dir, lockName), exclusive); err != nil {
+		return nil, err
+	}
+	r.exclusive = exclusive
+
+	if err := r.loadIndex(); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Close releases the lock on the repository
+func (r *Repository) Close() error {
+	if r.lockFile == nil {
+		return nil
+	}
+
+	err := r.lockFile.Close()
+	r.lockFile = nil
+
+	return err
+}
+
+// Config returns how the repository stores its data
+func (r *Repository) Config() Config {
+	return r.config
+}
+
+// loadIndex reads the location of every stored blob from the index files
+func (r *Repository) loadIndex() error {
+	files, err := ioutil.ReadDir(filepath.Join(r.dir, indexDir))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(r.dir, indexDir, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		idx := indexFile{}
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return fmt.Errorf("invalid index file %s: %s", f.Name(), err)
+		}
+
+		for id, loc := range idx.Blobs {
+			r.blobs[id] = loc
+		}
+	}
+
+	return nil
+}
+
+// HasBlob reports whether the blob is stored in the repository
+func (r *Repository) HasBlob(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	_, ok := r.blobs[id]
+	if !ok {
+		_, ok = r.pending[id]
+	}
+
+	return ok
+}
+
+// SaveBlob stores the data as a blob unless an identical blob is already stored, returning the ID
+// of the blob and whether it was newly stored
+func (r *Repository) SaveBlob(t BlobType, data []byte) (string, bool, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.blobs[id]; ok {
+		return id, false, nil
+	}
+	if _, ok := r.pending[id]; ok {
+		return id, false, nil
+	}
+
+	r.pending[id] = location{Type: t, Offset: int64(r.pack.Len()), Length: int64(len(data))}
+	r.pack.Write(data)
+
+	if r.pack.Len() >= packSize {
+		if err := r.writePack(); err != nil {
+			return "", false, err
+		}
+	}
+
+	return id, true, nil
+}
+
+// LoadBlob reads a stored blob and checks it has not been corrupted
+func (r *Repository) LoadBlob(id string) ([]byte, error) {
+	r.lock.Lock()
+	loc, ok := r.blobs[id]
+	pending, isPending := r.pending[id]
+	var data []byte
+	if isPending {
+		data = append(data, r.pack.Bytes()[pending.Offset:pending.Offset+pending.Length]...)
+	}
+	r.lock.Unlock()
+
+	if isPending {
+		return data, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("blob %s is not in the repository", id)
+	}
+
+	f, err := os.Open(r.packPath(loc.Pack))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data = make([]byte, loc.Length)
+	if _, err := io.ReadFull(io.NewSectionReader(f, loc.Offset, loc.Length), data); err != nil {
+		return nil, err
+	}
+
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("blob %s in pack %s is corrupt", id, loc.Pack)
+	}
+
+	return data, nil
+}
+
+// Flush writes any blobs not yet written to a pack file, and an index file listing the packs
+// written since the last flush
+func (r *Repository) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.writePack(); err != nil {
+		return err
+	}
+
+	if len(r.index) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(indexFile{Blobs: r.index})
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	if err := writeFileAtomic(filepath.Join(r.dir, indexDir, hex.EncodeToString(sum[:])+".json"), data); err != nil {
+		return err
+	}
+
+	r.index = map[string]location{}
+
+	return nil
+}
+
+// writePack writes the pending blobs to a pack file named by the hash of its contents. The lock
+// must be held.
+func (r *Repository) writePack() error {
+	if r.pack.Len() == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(r.pack.Bytes())
+	id := hex.EncodeToString(sum[:])
+
+	if err := os.MkdirAll(filepath.Dir(r.packPath(id)), os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.packPath(id), r.pack.Bytes()); err != nil {
+		return err
+	}
+
+	for blob, loc := range r.pending {
+		loc.Pack = id
+		r.blobs[blob] = loc
+		r.index[blob] = loc
+	}
+
+	r.pending = map[string]location{}
+	r.pack.Reset()
+
+	return nil
+}
+
+// packPath returns the path of a pack file, which are spread across subdirectories by the start
+// of their ID
+func (r *Repository) packPath(id string) string {
+	return filepath.Join(r.dir, dataDir, id[:2], id)
+}
+
+// writeFileAtomic writes the data to a temporary file alongside the path, syncs it and renames it
+// over the path
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/samphillips/backup/internal/file"
+)
+
+// snapshotSource restores the entries of a snapshot from the repository
+type snapshotSource struct {
+	repo  *Repository
+	nodes map[string]*Node
+	index map[string]os.FileInfo
+}
+
+// RestoreSource returns a source that restores the entries of the snapshot
+func (r *Repository) RestoreSource(s *Snapshot) (file.RestoreSource, error) {
+	nodes, index, err := r.Index(s.Tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshotSource{repo: r, nodes: nodes, index: index}, nil
+}
+
+func (s *snapshotSource) Index() (map[string]os.FileInfo, error) {
+	return s.index, nil
+}
+
+func (s *snapshotSource) Open(path string) (io.ReadCloser, error) {
+	node, ok := s.nodes[path]
+	if !ok || node.Type != NodeFile {
+		return nil, fmt.Errorf("%s is not a file in the snapshot", path)
+	}
+
+	return &contentReader{repo: s.repo, content: node.Content}, nil
+}
+
+func (s *snapshotSource) Readlink(path string) (string, error) {
+	node, ok := s.nodes[path]
+	if !ok || node.Type != NodeSymlink {
+		return "", fmt.Errorf("%s is not a symlink in the snapshot", path)
+	}
+
+	return node.Target, nil
+}
+
+// RestoreMetadata restores the permissions and modification time recorded in the snapshot in
+// archive mode. Snapshots do not record ownership or extended attributes.
+func (s *snapshotSource) RestoreMetadata(path, dstPath string, opts file.Options) error {
+	node, ok := s.nodes[path]
+	if !ok || !opts.Archive || node.Type == NodeSymlink {
+		return nil
+	}
+
+	if err := os.Chmod(dstPath, node.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dstPath, node.ModTime, node.ModTime)
+}
+
+// contentReader reads the chunks of a file from the repository in order, loading each one when it
+// is reached
+type contentReader struct {
+	repo    *Repository
+	content []string
+	chunk   []byte
+}
+
+func (c *contentReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if len(c.content) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk, err := c.repo.LoadBlob(c.content[0])
+		if err != nil {
+			return 0, err
+		}
+		c.chunk, c.content = chunk, c.content[1:]
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+
+	return n, nil
+}
+
+func (c *contentReader) Close() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot records the state of a source directory at the time of a backup
+type Snapshot struct {
+	ID     string    `json:"-"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Tree   string    `json:"tree"`
+	Parent string    `json:"parent,omitempty"`
+}
+
+// SaveSnapshot writes the snapshot, naming it by the hash of its contents
+func (r *Repository) SaveSnapshot(s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	s.ID = hex.EncodeToString(sum[:])
+
+	return writeFileAtomic(filepath.Join(r.dir, snapshotDir, s.ID+".json"), append(data, '\n'))
+}
+
+// Snapshots returns every snapshot in the repository, oldest first
+func (r *Repository) Snapshots() ([]*Snapshot, error) {
+	files, err := ioutil.ReadDir(filepath.Join(r.dir, snapshotDir))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*Snapshot{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(r.dir, snapshotDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		s := &Snapshot{ID: strings.TrimSuffix(f.Name(), ".json")}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	return snapshots, nil
+}
+
+// LatestSnapshot returns the most recent snapshot of the source directory, or nil if there is none
+func (r *Repository) LatestSnapshot(source string) (*Snapshot, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Source == source {
+			return snapshots[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// FindSnapshot returns the snapshot whose ID starts with the prefix, or the most recent snapshot
+// if the prefix is empty
+func (r *Repository) FindSnapshot(prefix string) (*Snapshot, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" {
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("the repository has no snapshots")
+		}
+		return snapshots[len(snapshots)-1], nil
+	}
+
+	var found *Snapshot
+	for _, s := range snapshots {
+		if !strings.HasPrefix(s.ID, prefix) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one snapshot starts with %s", prefix)
+		}
+		found = s
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot starts with %s", prefix)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Types of tree nodes
+const (
+	NodeFile    = "file"
+	NodeDir     = "dir"
+	NodeSymlink = "symlink"
+)
+
+// Node is an entry in a directory listing
+type Node struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	Content []string    `json:"content,omitempty"`
+	Subtree string      `json:"subtree,omitempty"`
+}
+
+// Tree is a directory listing, sorted by name
+type Tree struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// nodeInfo presents a node as file info, so a snapshot can be compared with a source directory
+// like a backup location
+type nodeInfo struct {
+	node *Node
+}
+
+func (n nodeInfo) Name() string       { return n.node.Name }
+func (n nodeInfo) Size() int64        { return n.node.Size }
+func (n nodeInfo) Mode() os.FileMode  { return n.node.Mode }
+func (n nodeInfo) ModTime() time.Time { return n.node.ModTime }
+func (n nodeInfo) IsDir() bool        { return n.node.Type == NodeDir }
+func (n nodeInfo) Sys() interface{}   { return nil }
+
+// SaveTree stores the directory listing as a blob and returns its ID
+func (r *Repository) SaveTree(tree *Tree) (string, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return "", err
+	}
+
+	id, _, err := r.SaveBlob(BlobTree, data)
+	return id, err
+}
+
+// LoadTree reads a stored directory listing
+func (r *Repository) LoadTree(id string) (*Tree, error) {
+	data, err := r.LoadBlob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &Tree{}
+	if err := json.Unmarshal(data, tree); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// Walk calls the function for every node below the tree, parents before their children, with the
+// path of the node relative to the tree
+func (r *Repository) Walk(treeID string, fn func(path string, node *Node) error) error {
+	return r.walk(treeID, "", fn)
+}
+
+func (r *Repository) walk(treeID, prefix string, fn func(path string, node *Node) error) error {
+	tree, err := r.LoadTree(treeID)
+	if err != nil {
+		return err
+	}
+
+	for i := range tree.Nodes {
+		node := &tree.Nodes[i]
+		path := filepath.Join(prefix, node.Name)
+
+		if err := fn(path, node); err != nil {
+			return err
+		}
+
+		if node.Type == NodeDir && node.Subtree != "" {
+			if err := r.walk(node.Subtree, path, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Index returns every node below the tree by path, along with file info for each node in the form
+// returned by ScanDirectory
+func (r *Repository) Index(treeID string) (map[string]*Node, map[string]os.FileInfo, error) {
+	nodes := map[string]*Node{}
+	index := map[string]os.FileInfo{}
+
+	err := r.Walk(treeID, func(path string, node *Node) error {
+		nodes[path] = node
+		index[path] = nodeInfo{node: node}
+		return nil
+	})
+
+	return nodes, index, err
+}
@@ -0,0 +1,107 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy decides which snapshots to keep. Each count keeps the newest snapshot in that many of the
+// most recent periods that have a snapshot, so a daily count of 7 keeps the last snapshot of each
+// of the last 7 days a backup ran on. A snapshot kept by any rule is kept.
+type Policy struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// Empty reports whether the policy keeps nothing
+func (p Policy) Empty() bool {
+	return p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 && p.Yearly <= 0
+}
+
+// String describes the rules of the policy
+func (p Policy) String() string {
+	rules := []string{}
+	for _, r := range p.rules() {
+		if r.count > 0 {
+			rules = append(rules, fmt.Sprintf("%d %s", r.count, r.name))
+		}
+	}
+
+	return "keep " + strings.Join(rules, ", ")
+}
+
+// Decision is whether a snapshot is kept and which rules keep it
+type Decision struct {
+	Keep    bool
+	Reasons []string
+}
+
+// rule keeps the newest snapshot of each period, identified by a key of the snapshot time
+type rule struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+func (p Policy) rules() []rule {
+	return []rule{
+		{name: "last", count: p.Last, key: nil},
+		{name: "daily", count: p.Daily, key: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{name: "weekly", count: p.Weekly, key: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{name: "monthly", count: p.Monthly, key: func(t time.Time) string { return t.Format("2006-01") }},
+		{name: "yearly", count: p.Yearly, key: func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// Apply decides which of the snapshots taken at the times to keep, returning a decision for each
+// time in the order given. Periods are taken in the location of each time, and of snapshots taken
+// at the same time the one given last is the newest.
+func (p Policy) Apply(times []time.Time) []Decision {
+	order := make([]int, len(times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if times[order[i]].Equal(times[order[j]]) {
+			return order[i] > order[j]
+		}
+		return times[order[i]].After(times[order[j]])
+	})
+
+	decisions := make([]Decision, len(times))
+	for _, r := range p.rules() {
+		remaining := r.count
+		last := ""
+
+		for n, i := range order {
+			if remaining <= 0 {
+				break
+			}
+
+			if r.key == nil {
+				decisions[i].Keep = true
+				decisions[i].Reasons = append(decisions[i].Reasons, r.name)
+				remaining--
+				continue
+			}
+
+			// The first time seen of each period is the newest in it
+			if key := r.key(times[i]); n == 0 || key != last {
+				decisions[i].Keep = true
+				decisions[i].Reasons = append(decisions[i].Reasons, r.name)
+				remaining--
+				last = key
+			}
+		}
+	}
+
+	return decisions
+}
@@ -0,0 +1,83 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RetentionTestSuite struct{}
+
+var _ = Suite(&RetentionTestSuite{})
+
+// daily returns a time at 2am on each of the days before the given day, newest last
+func daily(year int, month time.Month, day, days int) []time.Time {
+	times := []time.Time{}
+	end := time.Date(year, month, day, 2, 0, 0, 0, time.UTC)
+	for i := days - 1; i >= 0; i-- {
+		times = append(times, end.AddDate(0, 0, -i))
+	}
+
+	return times
+}
+
+func kept(times []time.Time, decisions []Decision) []string {
+	result := []string{}
+	for i, d := range decisions {
+		if d.Keep {
+			result = append(result, times[i].Format("2006-01-02T15"))
+		}
+	}
+
+	return result
+}
+
+func (*RetentionTestSuite) TestKeepLast(c *C) {
+	times := daily(2026, 10, 17, 5)
+
+	c.Check(kept(times, Policy{Last: 2}.Apply(times)), DeepEquals, []string{"2026-10-16T02", "2026-10-17T02"})
+}
+
+func (*RetentionTestSuite) TestKeepLastOfSnapshotsTakenAtTheSameTime(c *C) {
+	times := daily(2026, 10, 17, 2)
+	times = append(times, times[1])
+
+	decisions := Policy{Last: 1}.Apply(times)
+	c.Check(decisions[1].Keep, Equals, false)
+	c.Check(decisions[2].Keep, Equals, true)
+}
+
+func (*RetentionTestSuite) TestKeepDailyKeepsNewestOfEachDay(c *C) {
+	times := append(daily(2026, 10, 17, 3), time.Date(2026, 10, 17, 14, 0, 0, 0, time.UTC))
+
+	decisions := Policy{Daily: 2}.Apply(times)
+	c.Check(kept(times, decisions), DeepEquals, []string{"2026-10-16T02", "2026-10-17T14"})
+	c.Check(decisions[3].Reasons, DeepEquals, []string{"daily"})
+}
+
+func (*RetentionTestSuite) TestKeepWeeklyMonthlyAndYearly(c *C) {
+	times := daily(2026, 10, 17, 400)
+
+	c.Check(kept(times, Policy{Weekly: 2}.Apply(times)), DeepEquals, []string{"2026-10-11T02", "2026-10-17T02"})
+	c.Check(kept(times, Policy{Monthly: 2}.Apply(times)), DeepEquals, []string{"2026-09-30T02", "2026-10-17T02"})
+	c.Check(kept(times, Policy{Yearly: 3}.Apply(times)), DeepEquals, []string{"2025-12-31T02", "2026-10-17T02"})
+}
+
+func (*RetentionTestSuite) TestRulesCombine(c *C) {
+	times := daily(2026, 10, 17, 40)
+
+	decisions := Policy{Last: 1, Daily: 2, Monthly: 2}.Apply(times)
+	c.Check(kept(times, decisions), DeepEquals, []string{"2026-09-30T02", "2026-10-16T02", "2026-10-17T02"})
+	c.Check(decisions[len(times)-1].Reasons, DeepEquals, []string{"last", "daily", "monthly"})
+}
+
+func (*RetentionTestSuite) TestEmptyPolicyKeepsNothing(c *C) {
+	times := daily(2026, 10, 17, 3)
+
+	c.Check(Policy{}.Empty(), Equals, true)
+	c.Check(kept(times, Policy{}.Apply(times)), HasLen, 0)
+	c.Check(Policy{Last: 7, Weekly: 4}.String(), Equals, "keep 7 last, 4 weekly")
+}
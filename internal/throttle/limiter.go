@@ -0,0 +1,129 @@
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// chunkSize is the most bytes a single write waits for, keeping the rate smooth
+	chunkSize = 32 << 10
+	// maxSleep bounds each wait so that schedule changes take effect promptly
+	maxSleep = 250 * time.Millisecond
+)
+
+// Limiter is a token bucket limiting the total rate of bytes written through it. A single limiter
+// is shared by every concurrent copy, and its rate is looked up from the schedule as it runs.
+type Limiter struct {
+	schedule Schedule
+	now      func() time.Time
+	sleep    func(time.Duration)
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter using the schedule's rate at each moment
+func New(schedule Schedule) *Limiter {
+	return &Limiter{
+		schedule: schedule,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Wait blocks until n bytes may be written
+func (l *Limiter) Wait(n int) {
+	remaining := float64(n)
+
+	for remaining > 0 {
+		wait := l.take(&remaining)
+		if wait > 0 {
+			l.sleep(wait)
+		}
+	}
+}
+
+// take removes as many of the remaining bytes from the bucket as it holds, returning how long to
+// wait before trying again
+func (l *Limiter) take(remaining *float64) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	rate := float64(l.schedule.Rate(now))
+
+	if rate <= 0 {
+		*remaining = 0
+		l.last = now
+		return 0
+	}
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	l.last = now
+
+	// Allow at most one second of burst after being idle
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+
+	if l.tokens > 0 {
+		taken := l.tokens
+		if taken > *remaining {
+			taken = *remaining
+		}
+		l.tokens -= taken
+		*remaining -= taken
+	}
+
+	if *remaining <= 0 {
+		return 0
+	}
+
+	wait := time.Duration(*remaining / rate * float64(time.Second))
+	if wait > maxSleep {
+		wait = maxSleep
+	}
+
+	return wait
+}
+
+// Writer wraps the writer so that writes through it are limited. A nil limiter returns the
+// writer unchanged.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+
+	return &limitedWriter{w: w, limiter: l}
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	limiter *Limiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		lw.limiter.Wait(len(chunk))
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
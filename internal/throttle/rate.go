@@ -0,0 +1,149 @@
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// units maps the accepted rate suffixes to their size in bytes
+var units = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// ParseRate parses a rate such as 20MiB/s, 500K or 1.5GB into bytes per second. A rate of off or
+// 0 means unlimited and is returned as 0.
+func ParseRate(rate string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	s = strings.TrimSuffix(s, "/s")
+
+	if s == "off" || s == "unlimited" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	unit, ok := units[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q: unknown unit %q", rate, s[i:])
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+
+	return int64(n * unit), nil
+}
+
+// window is a daily time range with its own rate
+type window struct {
+	start time.Duration
+	end   time.Duration
+	rate  int64
+}
+
+// contains reports whether the time of day falls within the window. Windows whose end is before
+// their start wrap around midnight, and windows whose start and end are equal cover the whole day.
+func (w window) contains(t time.Duration) bool {
+	switch {
+	case w.start == w.end:
+		return true
+	case w.start < w.end:
+		return t >= w.start && t < w.end
+	default:
+		return t >= w.start || t < w.end
+	}
+}
+
+// Schedule holds the rate to use at each time of day
+type Schedule struct {
+	windows  []window
+	fallback int64
+}
+
+// ParseSchedule parses a schedule such as 08:00-18:00=10MiB,18:00-08:00=off, whose entries are
+// separated by commas. The rate of the first window containing the time of day is used, and the
+// fallback rate is used outside every window.
+func ParseSchedule(schedule string, fallback int64) (Schedule, error) {
+	s := Schedule{fallback: fallback}
+
+	if strings.TrimSpace(schedule) == "" {
+		return s, nil
+	}
+
+	entries := strings.FieldsFunc(schedule, func(r rune) bool {
+		return r == ','
+	})
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return s, fmt.Errorf("invalid schedule entry %q: expected HH:MM-HH:MM=rate", entry)
+		}
+
+		times := strings.SplitN(parts[0], "-", 2)
+		if len(times) != 2 {
+			return s, fmt.Errorf("invalid schedule entry %q: expected HH:MM-HH:MM=rate", entry)
+		}
+
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return s, err
+		}
+
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return s, err
+		}
+
+		rate, err := ParseRate(parts[1])
+		if err != nil {
+			return s, err
+		}
+
+		s.windows = append(s.windows, window{start: start, end: end, rate: rate})
+	}
+
+	return s, nil
+}
+
+// Rate returns the rate in bytes per second at the given time, or 0 if unlimited
+func (s Schedule) Rate(t time.Time) int64 {
+	hour, min, sec := t.Clock()
+	timeOfDay := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+
+	for _, w := range s.windows {
+		if w.contains(timeOfDay) {
+			return w.rate
+		}
+	}
+
+	return s.fallback
+}
+
+// parseTimeOfDay parses a HH:MM time into the duration since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: expected HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
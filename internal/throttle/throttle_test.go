@@ -0,0 +1,126 @@
+package throttle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ThrottleTestSuite struct{}
+
+var _ = Suite(&ThrottleTestSuite{})
+
+func (*ThrottleTestSuite) TestParseRateParsesUnits(c *C) {
+	rates := map[string]int64{
+		"20MiB/s": 20 << 20,
+		"20M":     20 << 20,
+		"1.5KiB":  1536,
+		"10MB":    10 * 1000 * 1000,
+		"1g":      1 << 30,
+		"512":     512,
+		"off":     0,
+		"0":       0,
+	}
+
+	for rate, expected := range rates {
+		parsed, err := ParseRate(rate)
+		c.Check(err, IsNil, Commentf(rate))
+		c.Check(parsed, Equals, expected, Commentf(rate))
+	}
+}
+
+func (*ThrottleTestSuite) TestParseRateRejectsInvalidRates(c *C) {
+	for _, rate := range []string{"fast", "10XB", "-1M", ""} {
+		_, err := ParseRate(rate)
+		c.Check(err, Not(IsNil), Commentf(rate))
+	}
+}
+
+func (*ThrottleTestSuite) TestScheduleRateUsesWindowsAndFallback(c *C) {
+	schedule, err := ParseSchedule("08:00-18:00=10MiB,22:00-02:00=1MiB", 5<<20)
+	c.Assert(err, IsNil)
+
+	day := func(hour, min int) time.Time {
+		return time.Date(2020, 6, 1, hour, min, 0, 0, time.Local)
+	}
+
+	c.Check(schedule.Rate(day(8, 0)), Equals, int64(10<<20))
+	c.Check(schedule.Rate(day(17, 59)), Equals, int64(10<<20))
+	c.Check(schedule.Rate(day(18, 0)), Equals, int64(5<<20))
+	c.Check(schedule.Rate(day(23, 0)), Equals, int64(1<<20))
+	c.Check(schedule.Rate(day(1, 30)), Equals, int64(1<<20))
+	c.Check(schedule.Rate(day(2, 0)), Equals, int64(5<<20))
+}
+
+func (*ThrottleTestSuite) TestParseScheduleAcceptsOff(c *C) {
+	schedule, err := ParseSchedule("08:00-18:00=10MiB,18:00-08:00=off", 1)
+	c.Assert(err, IsNil)
+
+	c.Check(schedule.Rate(time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)), Equals, int64(10<<20))
+	c.Check(schedule.Rate(time.Date(2020, 6, 1, 20, 0, 0, 0, time.Local)), Equals, int64(0))
+}
+
+func (*ThrottleTestSuite) TestParseScheduleRejectsInvalidEntries(c *C) {
+	for _, schedule := range []string{"08:00-18:00=1M;18:00-08:00=off", "08:00=1M", "8-18=1M", "08:00-18:00", "08:00-25:00=1M", "08:00-18:00=fast"} {
+		_, err := ParseSchedule(schedule, 0)
+		c.Check(err, Not(IsNil), Commentf(schedule))
+	}
+}
+
+func (*ThrottleTestSuite) TestLimiterWaitsForRate(c *C) {
+	schedule, err := ParseSchedule("", 1000)
+	c.Assert(err, IsNil)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	slept := time.Duration(0)
+
+	l := New(schedule)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	l.Wait(3000)
+
+	c.Check(slept, Equals, 3*time.Second)
+}
+
+func (*ThrottleTestSuite) TestLimiterFollowsScheduleChanges(c *C) {
+	schedule, err := ParseSchedule("12:00-12:01=1000", 0)
+	c.Assert(err, IsNil)
+
+	now := time.Date(2020, 6, 1, 12, 0, 59, 0, time.Local)
+	slept := time.Duration(0)
+
+	l := New(schedule)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// The limit is lifted at 12:01, one second into the wait
+	l.Wait(1000000)
+
+	c.Check(slept, Equals, time.Second)
+}
+
+func (*ThrottleTestSuite) TestWriterWritesEverything(c *C) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte{'a'}, 100000)
+
+	w := New(Schedule{}).Writer(&buf)
+	n, err := w.Write(data)
+
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len(data))
+	c.Check(buf.Bytes(), DeepEquals, data)
+
+	var nilLimiter *Limiter
+	c.Check(nilLimiter.Writer(&buf), Equals, &buf)
+}